@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+)
+
+// Sample rates the audio mode can stream at.
+var audioRates = []int{8000, 11025, 16000, 22050, 32000, 44100, 48000, 96000}
+
+// Most samples made for one read of an audio stream.
+const audioSamplesPerRead = 65536
+
+// wavStream is a WAV file of the resampled selection of a request that is made as it is read. Any part of it can be read
+// without making the parts before it, which lets http.ServeContent answer range requests.
+type wavStream struct {
+	Request    rdsRequest
+	Rate       int
+	NumSamples int
+	Header     []byte
+	Offset     int64
+}
+
+func (stream *wavStream) size() int64 {
+	return int64(len(stream.Header)) + int64(stream.NumSamples)*2
+}
+
+func (stream *wavStream) Read(p []byte) (int, error) {
+	if stream.Offset >= stream.size() {
+		return 0, io.EOF
+	}
+	numRead := 0
+	if stream.Offset < int64(len(stream.Header)) {
+		numRead = copy(p, stream.Header[stream.Offset:])
+		stream.Offset += int64(numRead)
+	}
+	if numRead == len(p) || stream.Offset >= stream.size() {
+		return numRead, nil
+	}
+
+	dataOffset := stream.Offset - int64(len(stream.Header))
+	firstSample := int(dataOffset / 2)
+	lastSample := int((dataOffset + int64(len(p)-numRead) + 1) / 2) // One past the last sample that is needed
+	lastSample = int(math.Min(float64(lastSample), float64(stream.NumSamples)))
+	lastSample = int(math.Min(float64(lastSample), float64(firstSample+audioSamplesPerRead)))
+	samples := resampleSelection(stream.Request, float64(stream.Rate), firstSample, lastSample-firstSample)
+	pcm := wavSamples(samples, stream.Request.Zmin, stream.Request.Zmax)
+	copied := copy(p[numRead:], pcm[dataOffset%2:])
+	stream.Offset += int64(copied)
+	return numRead + copied, nil
+}
+
+func (stream *wavStream) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += stream.Offset
+	case io.SeekEnd:
+		offset += stream.size()
+	default:
+		return 0, errors.New("wavStream.Seek: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("wavStream.Seek: negative position")
+	}
+	stream.Offset = offset
+	return offset, nil
+}
+
+type audioServer struct{}
+
+func (s *audioServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var audioRequest rdsRequest
+	var ok bool
+
+	//url - /sds/audio/<LocationName>/path/to/filename?rate=&x1=&x2=&cxmode=&demod=&tune=&bandwidth=&zmin=&zmax=
+	audioRequest.getQueryParams(r)
+	rate, ok := getURLQueryParamInt(r, "rate")
+	if !ok {
+		rate = defaultAudioRate
+	}
+	if !intInSlice(rate, audioRates) {
+		log.Println("rate must be one of", audioRates, "got:", rate)
+		w.WriteHeader(400)
+		return
+	}
+
+	if !audioRequest.openRegionFile(r.URL.Path, 3) {
+		w.WriteHeader(400)
+		return
+	}
+	if audioRequest.FileType != 1000 || audioRequest.SubsizeSet {
+		log.Println("Audio mode only supports type 1000 files read as one line. got:", audioRequest.FileType)
+		w.WriteHeader(400)
+		return
+	}
+	if !audioRequest.getRegionQueryParams(r) {
+		w.WriteHeader(400)
+		return
+	}
+
+	fileRate := 1.0
+	if audioRequest.Filexdelta > 0 {
+		fileRate = 1 / audioRequest.Filexdelta
+	}
+	numSamples := int(float64(audioRequest.Xsize) * float64(rate) / fileRate)
+	if numSamples < 1 || int64(numSamples)*2+wavHeaderSize > math.MaxUint32 {
+		log.Println("Audio would give", numSamples, "samples, which does not fit in a WAV file")
+		w.WriteHeader(400)
+		return
+	}
+	// The whole stream is scaled the same way so that each range of it matches
+	if !audioRequest.Zset {
+		audioRequest.findZminMax()
+	}
+
+	start := time.Now()
+	stream := &wavStream{Request: audioRequest, Rate: rate, NumSamples: numSamples, Header: wavHeader(numSamples, rate)}
+	w.Header().Add("Access-Control-Allow-Origin", "*")
+	w.Header().Add("Access-Control-Expose-Headers", "rate,numsamples,zmin,zmax,Content-Range,Accept-Ranges")
+	w.Header().Add("rate", strconv.Itoa(rate))
+	w.Header().Add("numsamples", strconv.Itoa(numSamples))
+	w.Header().Add("zmin", strconv.FormatFloat(audioRequest.Zmin, 'f', -1, 64))
+	w.Header().Add("zmax", strconv.FormatFloat(audioRequest.Zmax, 'f', -1, 64))
+	w.Header().Set("Content-Type", "audio/wav")
+	http.ServeContent(w, r, path.Base(audioRequest.FileName)+".wav", time.Unix(0, audioRequest.fileModTime()), stream)
+	log.Println("Streamed audio of", numSamples, "samples in", time.Since(start))
+}
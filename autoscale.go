@@ -0,0 +1,176 @@
+package main
+
+import (
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Number of bins in the histogram of the sampled lines used to find percentiles and the noise floor.
+const autoscaleBins = 1024
+
+type autoscaleMode struct {
+	Kind      string // minmax, percentile, sigma or floor
+	Low, High float64
+}
+
+// parseAutoscale reads an autoscale option. The forms are
+// minmax, p<low>-p<high> (percentiles), mean±<k>sigma or <k>sigma, and floor:<above> or floor:<below>:<above> (relative to the median).
+func parseAutoscale(param string) (autoscaleMode, bool) {
+	switch {
+	case param == "minmax":
+		return autoscaleMode{Kind: "minmax"}, true
+	case strings.HasPrefix(param, "p"):
+		bounds := strings.Split(param, "-")
+		if len(bounds) != 2 || !strings.HasPrefix(bounds[1], "p") {
+			return autoscaleMode{}, false
+		}
+		low, lowErr := strconv.ParseFloat(bounds[0][1:], 64)
+		high, highErr := strconv.ParseFloat(bounds[1][1:], 64)
+		if lowErr != nil || highErr != nil || low < 0 || high > 100 || low >= high {
+			return autoscaleMode{}, false
+		}
+		return autoscaleMode{"percentile", low, high}, true
+	case strings.HasSuffix(param, "sigma"):
+		k, err := strconv.ParseFloat(strings.TrimPrefix(strings.TrimSuffix(param, "sigma"), "mean±"), 64)
+		if err != nil || k <= 0 {
+			return autoscaleMode{}, false
+		}
+		return autoscaleMode{"sigma", k, k}, true
+	case strings.HasPrefix(param, "floor:"):
+		fields := strings.Split(strings.TrimPrefix(param, "floor:"), ":")
+		var below, above float64
+		var belowErr, aboveErr error
+		switch len(fields) {
+		case 1:
+			above, aboveErr = strconv.ParseFloat(fields[0], 64)
+		case 2:
+			below, belowErr = strconv.ParseFloat(fields[0], 64)
+			above, aboveErr = strconv.ParseFloat(fields[1], 64)
+		default:
+			return autoscaleMode{}, false
+		}
+		if belowErr != nil || aboveErr != nil || below < 0 || above <= 0 {
+			return autoscaleMode{}, false
+		}
+		return autoscaleMode{"floor", below, above}, true
+	}
+	return autoscaleMode{}, false
+}
+
+// zminmaxSampleSegments returns the parts of the file that are used to estimate its range. These are the same lines and sections
+// that findZminMax looks at: the whole file when it is smaller than MaxBytesZminZmax, otherwise the first, last and evenly spaced middle lines,
+// or four evenly spaced sections of a large file with only one line.
+func (request *rdsRequest) zminmaxSampleSegments() []lineSegment {
+	bytesPerAtom, complexFlag := getFileTypeInfo(request.FileFormat)
+	bytesPerElement := bytesPerAtom
+	if complexFlag {
+		bytesPerElement = bytesPerElement * 2
+	}
+
+	var segments []lineSegment
+	if (int(float64(request.FileXSize*request.FileYSize) * (bytesPerElement))) < configuration.MaxBytesZminZmax {
+		for line := 0; line < request.FileYSize; line++ {
+			segments = append(segments, rowSegments(line, 0, request.FileXSize)...)
+		}
+	} else if request.FileYSize == 1 {
+		numSubSections := 4
+		spaceBytes := (float64(request.FileXSize) * bytesPerElement) - float64(configuration.MaxBytesZminZmax)
+		elementsPerSpace := int((spaceBytes / bytesPerElement)) / (numSubSections - 1)
+		elementsPerSection := int(float64(configuration.MaxBytesZminZmax)/bytesPerElement) / numSubSections
+		// Each section is kept within the file
+		section := func(xstart int) []lineSegment {
+			xstart = int(math.Max(math.Min(float64(xstart), float64(request.FileXSize)), 0))
+			return rowSegments(0, xstart, int(math.Min(float64(elementsPerSection), float64(request.FileXSize-xstart))))
+		}
+		for i := 0; i < numSubSections-1; i++ {
+			segments = append(segments, section(i*(elementsPerSection+elementsPerSpace))...)
+		}
+		segments = append(segments, section(request.FileXSize-elementsPerSection)...)
+	} else {
+		numMiddlesLines := int(math.Max(float64((configuration.MaxBytesZminZmax/request.FileXSize)-2), 0))
+		segments = append(segments, rowSegments(0, 0, request.FileXSize)...)
+		segments = append(segments, rowSegments(request.FileYSize-1, 0, request.FileXSize)...)
+		for i := 0; i < numMiddlesLines; i++ {
+			segments = append(segments, rowSegments(int(((request.FileYSize)/numMiddlesLines)*i), 0, request.FileXSize)...)
+		}
+	}
+	return segments
+}
+
+// histogramPercentile estimates a percentile of the values counted in a histogram, interpolating linearly within the bin that holds it.
+func histogramPercentile(hist histogramResult, percentile float64) float64 {
+	var inRange int64
+	for _, count := range hist.Counts {
+		inRange += count
+	}
+	target := percentile / 100 * float64(inRange)
+	var cumulative float64
+	for bin, count := range hist.Counts {
+		if count > 0 && cumulative+float64(count) >= target {
+			fraction := (target - cumulative) / float64(count)
+			return hist.Edges[bin] + fraction*(hist.Edges[bin+1]-hist.Edges[bin])
+		}
+		cumulative += float64(count)
+	}
+	return hist.Zmax
+}
+
+// findAutoscaleZminMax sets Zmin and Zmax from the sampled lines of the file using the autoscale of the request. The result is remembered per
+// file, cxmode and autoscale. zminmaxtileMutex must be held by the caller.
+func (request *rdsRequest) findAutoscaleZminMax(mode autoscaleMode) {
+	start := time.Now()
+	key := request.rangeIndexKey() + request.Autoscale
+	zminmax, ok := zminzmaxFileMap[key]
+	if ok {
+		request.Zmin = zminmax.Zmin
+		request.Zmax = zminmax.Zmax
+		return
+	}
+
+	segments := request.zminmaxSampleSegments()
+	accumulators := make([]statsAccumulator, scanWorkers)
+	scanSegments(*request, segments, func(worker int, segment lineSegment, data []float64) {
+		for i, value := range data {
+			accumulators[worker].add(value, segment.Xstart+i, segment.Row)
+		}
+	})
+	var moments statsAccumulator
+	for i := range accumulators {
+		moments.merge(accumulators[i])
+	}
+
+	var histRequest rdsRequest
+	histRequest = *request
+	histRequest.Zmin = moments.min
+	histRequest.Zmax = moments.max
+	constant := moments.min == moments.max // Every value is the same, so there is no range to make a histogram of
+	switch mode.Kind {
+	case "percentile":
+		if constant {
+			request.Zmin, request.Zmax = moments.min, moments.max
+			break
+		}
+		hist := computeSegmentsHistogram(histRequest, segments, autoscaleBins, false)
+		request.Zmin = histogramPercentile(hist, mode.Low)
+		request.Zmax = histogramPercentile(hist, mode.High)
+	case "sigma":
+		sigma := math.Sqrt(moments.m2 / math.Max(float64(moments.count), 1))
+		request.Zmin = math.Max(moments.mean-mode.Low*sigma, moments.min)
+		request.Zmax = math.Min(moments.mean+mode.High*sigma, moments.max)
+	case "floor":
+		floor := moments.min
+		if !constant {
+			floor = histogramPercentile(computeSegmentsHistogram(histRequest, segments, autoscaleBins, false), 50)
+		}
+		request.Zmin = floor - mode.Low
+		request.Zmax = floor + mode.High
+	default:
+		request.Zmin = moments.min
+		request.Zmax = moments.max
+	}
+	zminzmaxFileMap[key] = Zminzmax{request.Zmin, request.Zmax}
+	log.Println("Found autoscale", request.Autoscale, "Zmin, Zmax to be", request.Zmin, request.Zmax, " in ", time.Since(start))
+}
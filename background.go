@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Most rows read to find a median baseline. Reference ranges with more rows are sampled at evenly spaced rows.
+const maxBaselineMedianRows = 1025
+
+// Number of columns whose median is found at once, which bounds the memory used for a median baseline.
+const baselineMedianColumns = 1024
+
+// backgroundModel holds what is removed from each value of a file as it is read. Baseline has one value per column
+// and RowOffset and RowScale one value per row. Any of them may be nil when that step is not used.
+type backgroundModel struct {
+	Baseline       []float64 `json:"baseline"`
+	Operation      string    `json:"operation"`
+	RowOffset      []float64 `json:"rowoffset"`
+	RowScale       []float64 `json:"rowscale"`
+	ReferenceFirst int       `json:"referencefirst"`
+	ReferenceLast  int       `json:"referencelast"`
+}
+
+// backgroundEntry is the model of a file and options. model is set before done is closed.
+type backgroundEntry struct {
+	done  chan struct{}
+	model *backgroundModel
+}
+
+var backgroundModels = make(map[string]*backgroundEntry)
+var backgroundModelsMutex = &sync.Mutex{}
+
+// apply removes the background from data, which holds the values of row starting at column xstart.
+func (model *backgroundModel) apply(data []float64, row, xstart int) {
+	loThresh := 1.0e-20
+	if model.Baseline != nil {
+		for i := range data {
+			if model.Operation == "divide" {
+				divisor := model.Baseline[xstart+i]
+				if math.Abs(divisor) < loThresh {
+					divisor = math.Copysign(loThresh, divisor)
+				}
+				data[i] = data[i] / divisor
+			} else {
+				data[i] = data[i] - model.Baseline[xstart+i]
+			}
+		}
+	}
+	if model.RowOffset != nil {
+		for i := range data {
+			data[i] = (data[i] - model.RowOffset[row]) / model.RowScale[row]
+		}
+	}
+}
+
+// backgroundRequested reports whether any background option is set on the request.
+func (request *rdsRequest) backgroundRequested() bool {
+	return (request.Baseline != "none" && request.Baseline != "") || (request.RowNorm != "none" && request.RowNorm != "")
+}
+
+// backgroundOptionsKey describes the background options of the request.
+func (request *rdsRequest) backgroundOptionsKey() string {
+	return fmt.Sprintf("bg%s%s%s%s", request.Baseline, request.BaselineOp, strings.Replace(request.BaselineRows, ":", "to", 1), request.RowNorm)
+}
+
+// baselineReferenceRows returns the range of rows used for the baseline. It is the whole file unless baselinerows gives a valid range.
+func (request *rdsRequest) baselineReferenceRows() (int, int) {
+	if request.BaselineRows == "" {
+		return 0, request.FileYSize
+	}
+	bounds := strings.Split(request.BaselineRows, ":")
+	if len(bounds) == 2 {
+		first, firstErr := strconv.Atoi(bounds[0])
+		last, lastErr := strconv.Atoi(bounds[1])
+		if firstErr == nil && lastErr == nil && first >= 0 && last <= request.FileYSize && first < last {
+			return first, last
+		}
+	}
+	log.Println("Invalid baselinerows", request.BaselineRows, "using the whole file")
+	return 0, request.FileYSize
+}
+
+// meanBaseline returns the mean of the finite values of each column over rows [first,last).
+func meanBaseline(request rdsRequest, first, last int) []float64 {
+	regionRequest := request
+	regionRequest.Xstart, regionRequest.Xsize = 0, request.FileXSize
+	regionRequest.Ystart, regionRequest.Ysize = first, last-first
+	sums := make([][]float64, scanWorkers)
+	counts := make([][]int64, scanWorkers)
+	for worker := range sums {
+		sums[worker] = make([]float64, request.FileXSize)
+		counts[worker] = make([]int64, request.FileXSize)
+	}
+	scanRegion(regionRequest, func(worker int, segment lineSegment, data []float64) {
+		for i, value := range data {
+			if math.IsNaN(value) || math.IsInf(value, 0) {
+				continue
+			}
+			sums[worker][segment.Xstart+i] += value
+			counts[worker][segment.Xstart+i]++
+		}
+	})
+	baseline := make([]float64, request.FileXSize)
+	for column := range baseline {
+		var sum float64
+		var count int64
+		for worker := range sums {
+			sum += sums[worker][column]
+			count += counts[worker][column]
+		}
+		if count > 0 {
+			baseline[column] = sum / float64(count)
+		}
+	}
+	return baseline
+}
+
+// medianBaseline returns the median of the finite values of each column over rows [first,last), from at most maxBaselineMedianRows
+// evenly spaced rows. Columns are done baselineMedianColumns at a time.
+func medianBaseline(request rdsRequest, first, last int) []float64 {
+	numRows := int(math.Min(float64(last-first), maxBaselineMedianRows))
+	rows := make([]int, numRows)
+	rowIndex := make(map[int]int, numRows)
+	for i := range rows {
+		rows[i] = first + int(float64(i)*float64(last-first)/float64(numRows))
+		rowIndex[rows[i]] = i
+	}
+
+	baseline := make([]float64, request.FileXSize)
+	for xstart := 0; xstart < request.FileXSize; xstart += baselineMedianColumns {
+		xsize := int(math.Min(baselineMedianColumns, float64(request.FileXSize-xstart)))
+		segments := make([]lineSegment, len(rows))
+		for i, row := range rows {
+			segments[i] = lineSegment{row, xstart, xsize}
+		}
+		block := make([][]float64, len(rows))
+		scanSegments(request, segments, func(worker int, segment lineSegment, data []float64) {
+			block[rowIndex[segment.Row]] = data
+		})
+		column := make([]float64, 0, len(rows))
+		for x := 0; x < xsize; x++ {
+			column = column[:0]
+			for i := range block {
+				if value := block[i][x]; !math.IsNaN(value) && !math.IsInf(value, 0) {
+					column = append(column, value)
+				}
+			}
+			if len(column) == 0 {
+				continue
+			}
+			sort.Float64s(column)
+			middle := len(column) / 2
+			if len(column)%2 == 0 {
+				baseline[xstart+x] = (column[middle-1] + column[middle]) / 2
+			} else {
+				baseline[xstart+x] = column[middle]
+			}
+		}
+	}
+	return baseline
+}
+
+// rowNormalization returns the offset and scale of each row of the file, read with the baseline already removed.
+// The offset is the row mean, and the scale is the row standard deviation for zscore or one for mean.
+func rowNormalization(request rdsRequest, rowNorm string) ([]float64, []float64) {
+	fileRequest := request
+	fileRequest.Xstart, fileRequest.Xsize = 0, request.FileXSize
+	fileRequest.Ystart, fileRequest.Ysize = 0, request.FileYSize
+	rows := make([]statsAccumulator, request.FileYSize)
+	rowsMutex := &sync.Mutex{}
+	scanRegion(fileRequest, func(worker int, segment lineSegment, data []float64) {
+		var partial statsAccumulator
+		for i, value := range data {
+			partial.add(value, segment.Xstart+i, segment.Row)
+		}
+		rowsMutex.Lock()
+		rows[segment.Row].merge(partial)
+		rowsMutex.Unlock()
+	})
+
+	offset := make([]float64, request.FileYSize)
+	scale := make([]float64, request.FileYSize)
+	for row := range rows {
+		offset[row] = rows[row].mean
+		scale[row] = 1
+		if rowNorm == "zscore" && rows[row].count > 0 {
+			stddev := math.Sqrt(rows[row].m2 / float64(rows[row].count))
+			if stddev > 0 {
+				scale[row] = stddev
+			}
+		}
+	}
+	return offset, scale
+}
+
+// buildBackground computes the background model of the file of the request from its background options.
+func buildBackground(request rdsRequest) *backgroundModel {
+	request.Background = nil
+	model := &backgroundModel{Operation: request.BaselineOp}
+	model.ReferenceFirst, model.ReferenceLast = request.baselineReferenceRows()
+	switch request.Baseline {
+	case "mean":
+		model.Baseline = meanBaseline(request, model.ReferenceFirst, model.ReferenceLast)
+	case "median":
+		model.Baseline = medianBaseline(request, model.ReferenceFirst, model.ReferenceLast)
+	}
+	if request.RowNorm == "mean" || request.RowNorm == "zscore" {
+		baselineRequest := request
+		baselineRequest.Background = &backgroundModel{Baseline: model.Baseline, Operation: model.Operation}
+		model.RowOffset, model.RowScale = rowNormalization(baselineRequest, request.RowNorm)
+	}
+	return model
+}
+
+// loadBackground sets the background model of the request when any background option is given. Models are computed
+// once per file and options, then kept in memory and, when the cache is on, on disk.
+func (request *rdsRequest) loadBackground() {
+	if !request.backgroundRequested() {
+		return
+	}
+	request.Background = nil
+	key := request.rangeIndexKey()
+	backgroundModelsMutex.Lock()
+	entry, found := backgroundModels[key]
+	if !found {
+		entry = &backgroundEntry{done: make(chan struct{})}
+		backgroundModels[key] = entry
+	}
+	backgroundModelsMutex.Unlock()
+
+	// Only requests for the same file and options wait while a model is found
+	if found {
+		<-entry.done
+	} else {
+		defer close(entry.done)
+		entry.model = request.findBackground(key)
+	}
+	request.Background = entry.model
+}
+
+// findBackground returns the background model of the request from the cache, or computes it and stores it in the cache.
+func (request *rdsRequest) findBackground(key string) *backgroundModel {
+	if *useCache {
+		modelJSON, inCache := getDataFromCache(key, "backgrounds/")
+		if inCache {
+			model := &backgroundModel{}
+			if json.Unmarshal(modelJSON, model) == nil {
+				return model
+			}
+		}
+	}
+	start := time.Now()
+	model := buildBackground(*request)
+	log.Println("Computed background", key, "in", time.Since(start))
+	if *useCache {
+		modelJSON, marshalError := json.Marshal(model)
+		if marshalError == nil {
+			go putItemInCache(key, "backgrounds/", modelJSON)
+		}
+	}
+	return model
+}
@@ -1,8 +1,19 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
 	"log"
 	"math"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 )
 
 type colorPoint struct {
@@ -14,7 +25,7 @@ type colorPoint struct {
 
 func makeColorPalette(controlColors []colorPoint, numColors int) []colorPoint {
 
-	colorsPerPosition := numColors / 100.0
+	colorsPerPosition := float64(numColors) / 100.0
 	lastPoint := controlColors[0]
 	//If first control color is not at 0 then copy color for range
 	lastIndexFilled := 0
@@ -44,79 +55,322 @@ func makeColorPalette(controlColors []colorPoint, numColors int) []colorPoint {
 	return outColors
 }
 
-func getColorConrolPoints(colorMap string) []colorPoint {
-	var outColors []colorPoint
-	switch colorMap {
-	case "Greyscale":
-		outColors = make([]colorPoint, 3)
-		outColors[0] = colorPoint{0, 0, 0, 0}
-		outColors[1] = colorPoint{60, 50, 50, 50}
-		outColors[2] = colorPoint{100, 100, 100, 100}
-	case "Ramp Colormap":
-		outColors = make([]colorPoint, 7)
-		outColors[0] = colorPoint{0, 0, 0, 15}
-		outColors[1] = colorPoint{10, 0, 0, 50}
-		outColors[2] = colorPoint{31, 0, 65, 75}
-		outColors[3] = colorPoint{50, 0, 80, 0}
-		outColors[4] = colorPoint{70, 75, 80, 0}
-		outColors[5] = colorPoint{83, 100, 60, 0}
-		outColors[6] = colorPoint{100, 100, 0, 0}
-	case "Color Wheel":
-		outColors = make([]colorPoint, 7)
-		outColors[0] = colorPoint{0, 100, 100, 0}
-		outColors[1] = colorPoint{20, 0, 80, 40}
-		outColors[2] = colorPoint{30, 0, 100, 100}
-		outColors[3] = colorPoint{50, 10, 10, 0}
-		outColors[4] = colorPoint{65, 100, 0, 0}
-		outColors[5] = colorPoint{88, 100, 40, 0}
-		outColors[6] = colorPoint{100, 100, 100, 0}
-	case "Spectrum":
-		outColors = make([]colorPoint, 7)
-		outColors[0] = colorPoint{0, 0, 75, 0}
-		outColors[1] = colorPoint{22, 0, 90, 90}
-		outColors[2] = colorPoint{37, 0, 0, 85}
-		outColors[3] = colorPoint{49, 90, 0, 85}
-		outColors[4] = colorPoint{68, 90, 0, 0}
-		outColors[5] = colorPoint{80, 90, 90, 0}
-		outColors[6] = colorPoint{100, 95, 95, 95}
-	case "calewhite":
-		outColors = make([]colorPoint, 7)
-		outColors[0] = colorPoint{0, 100, 100, 100}
-		outColors[1] = colorPoint{16.666, 0, 0, 100}
-		outColors[2] = colorPoint{33.333, 0, 100, 100}
-		outColors[3] = colorPoint{50, 0, 100, 0}
-		outColors[4] = colorPoint{66.666, 100, 100, 0}
-		outColors[5] = colorPoint{83.333, 100, 0, 0}
-		outColors[6] = colorPoint{100, 100, 0, 100}
-	case "HotDesat":
-		outColors = make([]colorPoint, 8)
-		outColors[0] = colorPoint{0, 27.84, 27.84, 85.88}
-		outColors[1] = colorPoint{14.2857, 0, 0, 35.69}
-		outColors[2] = colorPoint{28.571, 0, 100, 100}
-		outColors[3] = colorPoint{42.857, 0, 49.8, 0}
-		outColors[4] = colorPoint{57.14286, 100, 100, 0}
-		outColors[5] = colorPoint{71.42857, 100, 37.65, 0}
-		outColors[6] = colorPoint{85.7143, 41.96, 0, 0}
-		outColors[7] = colorPoint{100, 87.84, 29.8, 29.8}
-	case "Sunset":
-		outColors = make([]colorPoint, 7)
-		outColors[0] = colorPoint{0, 10, 0, 23}
-		outColors[1] = colorPoint{18, 34, 0, 60}
-		outColors[2] = colorPoint{36, 58, 20, 47}
-		outColors[3] = colorPoint{55, 74, 20, 28}
-		outColors[4] = colorPoint{72, 90, 43, 0}
-		outColors[5] = colorPoint{87, 100, 72, 0}
-		outColors[6] = colorPoint{100, 100, 100, 76}
+// Control points of the built in colormaps. Positions and colors are in percent.
+var builtinColorMaps = map[string][]colorPoint{
+	"Greyscale": {{0, 0, 0, 0}, {60, 50, 50, 50}, {100, 100, 100, 100}},
+	"RampColormap": {{0, 0, 0, 15}, {10, 0, 0, 50}, {31, 0, 65, 75}, {50, 0, 80, 0}, {70, 75, 80, 0},
+		{83, 100, 60, 0}, {100, 100, 0, 0}},
+	"ColorWheel": {{0, 100, 100, 0}, {20, 0, 80, 40}, {30, 0, 100, 100}, {50, 10, 10, 0}, {65, 100, 0, 0},
+		{88, 100, 40, 0}, {100, 100, 100, 0}},
+	"Spectrum": {{0, 0, 75, 0}, {22, 0, 90, 90}, {37, 0, 0, 85}, {49, 90, 0, 85}, {68, 90, 0, 0},
+		{80, 90, 90, 0}, {100, 95, 95, 95}},
+	"calewhite": {{0, 100, 100, 100}, {16.666, 0, 0, 100}, {33.333, 0, 100, 100}, {50, 0, 100, 0},
+		{66.666, 100, 100, 0}, {83.333, 100, 0, 0}, {100, 100, 0, 100}},
+	"HotDesat": {{0, 27.84, 27.84, 85.88}, {14.2857, 0, 0, 35.69}, {28.571, 0, 100, 100}, {42.857, 0, 49.8, 0},
+		{57.14286, 100, 100, 0}, {71.42857, 100, 37.65, 0}, {85.7143, 41.96, 0, 0}, {100, 87.84, 29.8, 29.8}},
+	"Sunset": {{0, 10, 0, 23}, {18, 34, 0, 60}, {36, 58, 20, 47}, {55, 74, 20, 28}, {72, 90, 43, 0},
+		{87, 100, 72, 0}, {100, 100, 100, 76}},
+	// The perceptual colormaps of matplotlib, sampled at ten evenly spaced points.
+	"viridis": hexColorPoints("440154", "482878", "3E4A89", "31688E", "26828E", "1F9E89", "35B779", "6DCD59", "B4DE2C", "FDE725"),
+	"magma":   hexColorPoints("000004", "180F3E", "451077", "721F81", "9F2F7F", "CD4071", "F1605D", "FD9567", "FEC98D", "FCFDBF"),
+	"inferno": hexColorPoints("000004", "1B0C42", "4B0C6B", "781C6D", "A52C60", "CF4446", "ED6925", "FB9A06", "F7D03C", "FCFFA4"),
+	"plasma":  hexColorPoints("0D0887", "47039F", "7301A8", "9C179E", "BD3786", "D8576B", "ED7953", "FA9E3B", "FDC926", "F0F921"),
+	"cividis": hexColorPoints("00204D", "00336F", "39486B", "575C6D", "707173", "8A8779", "A69D75", "C4B56C", "E4CF5B", "FFEA46"),
+	"turbo":   hexColorPoints("30123B", "4662D7", "36AAF9", "1AE4B6", "72FE5E", "C7EF34", "FABA39", "F66B19", "CB2A04", "7A0403"),
+}
+
+// Other names the built in colormaps have been known by.
+var colorMapAliases = map[string]string{
+	"Ramp Colormap": "RampColormap",
+	"Color Wheel":   "ColorWheel",
+}
+
+// Names of uploaded colormaps, which are also the names of the files they are kept in.
+var colorMapNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// colorMapDefinition is a colormap from the config file or an upload. It has either control points of [position, red, green, blue],
+// with the position from 0 to 100 and colors from 0 to 255, or a table of 256 [red, green, blue] colors from 0 to 255.
+type colorMapDefinition struct {
+	Name          string      `json:"name"`
+	ControlPoints [][]float64 `json:"controlPoints,omitempty"`
+	Table         [][]float64 `json:"table,omitempty"`
+}
+
+type colorMapEntry struct {
+	Points  []colorPoint
+	Source  string
+	Version string // Hash of the colors, so output made with other colors of the same name is not taken from the cache
+}
+
+// newColorMapEntry makes the entry of a config file or uploaded colormap, with a version from its control points.
+func newColorMapEntry(points []colorPoint, source string) colorMapEntry {
+	hash := fnv.New64a()
+	for _, point := range points {
+		fmt.Fprintf(hash, "%g,%g,%g,%g;", point.position, point.red, point.green, point.blue)
+	}
+	return colorMapEntry{points, source, fmt.Sprintf("%x", hash.Sum64())}
+}
+
+var userColorMaps = make(map[string]colorMapEntry)
+var colorMapsMutex = &sync.RWMutex{}
+
+// hexColorPoints spreads colors written as RRGGBB evenly from 0 to 100.
+func hexColorPoints(colors ...string) []colorPoint {
+	points := make([]colorPoint, len(colors))
+	for i, color := range colors {
+		value, _ := strconv.ParseUint(color, 16, 32)
+		points[i] = colorPoint{
+			position: 100 * float64(i) / float64(len(colors)-1),
+			red:      float64(value>>16) * 100 / 255,
+			green:    float64(value>>8&0xff) * 100 / 255,
+			blue:     float64(value&0xff) * 100 / 255,
+		}
+	}
+	return points
+}
+
+// controlPoints checks a colormap definition and converts it to control points in percent.
+func (definition colorMapDefinition) controlPoints() ([]colorPoint, error) {
+	inRange := func(color []float64) bool {
+		for _, value := range color {
+			if !(value >= 0 && value <= 255) {
+				return false
+			}
+		}
+		return true
+	}
+	var points []colorPoint
+	switch {
+	case definition.ControlPoints != nil && definition.Table != nil:
+		return nil, fmt.Errorf("colormap %s has both controlPoints and a table", definition.Name)
+	case definition.Table != nil:
+		if len(definition.Table) != 256 {
+			return nil, fmt.Errorf("colormap %s table has %d colors, it must have 256", definition.Name, len(definition.Table))
+		}
+		for i, color := range definition.Table {
+			if len(color) != 3 || !inRange(color) {
+				return nil, fmt.Errorf("colormap %s table color %d must be red, green and blue from 0 to 255", definition.Name, i)
+			}
+			points = append(points, colorPoint{100 * float64(i) / 255, color[0] * 100 / 255, color[1] * 100 / 255, color[2] * 100 / 255})
+		}
 	default:
+		if len(definition.ControlPoints) < 2 {
+			return nil, fmt.Errorf("colormap %s needs at least two control points or a table", definition.Name)
+		}
+		for i, point := range definition.ControlPoints {
+			if len(point) != 4 || !inRange(point[1:]) {
+				return nil, fmt.Errorf("colormap %s control point %d must be position, red, green and blue with colors from 0 to 255", definition.Name, i)
+			}
+			if point[0] < 0 || point[0] > 100 || (i > 0 && point[0] <= points[i-1].position) {
+				return nil, fmt.Errorf("colormap %s control point %d must be after the one before it and from 0 to 100", definition.Name, i)
+			}
+			points = append(points, colorPoint{point[0], point[1] * 100 / 255, point[2] * 100 / 255, point[3] * 100 / 255})
+		}
+		if points[0].position != 0 || points[len(points)-1].position != 100 {
+			return nil, fmt.Errorf("colormap %s control points must start at 0 and end at 100", definition.Name)
+		}
+	}
+	return points, nil
+}
+
+// loadColorMaps replaces the user colormaps with those of the config file and those uploaded to the cache. Colormaps that are not
+// valid are logged and skipped.
+func loadColorMaps() {
+	colorMaps := make(map[string]colorMapEntry)
+	for _, definition := range configuration.ColorMaps {
+		points, err := definition.controlPoints()
+		if _, builtin := lookupBuiltinColorMap(definition.Name); err == nil && builtin {
+			err = fmt.Errorf("colormap %s is built in", definition.Name)
+		}
+		if err != nil {
+			log.Println("Skipping colormap from config file:", err)
+			continue
+		}
+		colorMaps[definition.Name] = newColorMapEntry(points, "config")
+	}
+	files, _ := ioutil.ReadDir(configuration.CacheLocation + "colormaps/")
+	for _, file := range files {
+		name := strings.TrimSuffix(file.Name(), ".json")
+		definitionJSON, _ := getDataFromCache(file.Name(), "colormaps/")
+		var definition colorMapDefinition
+		err := json.Unmarshal(definitionJSON, &definition)
+		definition.Name = name
+		var points []colorPoint
+		if err == nil {
+			points, err = definition.controlPoints()
+		}
+		if _, taken := colorMaps[name]; err == nil && taken {
+			err = fmt.Errorf("colormap %s is in the config file", name)
+		}
+		if err != nil {
+			log.Println("Skipping uploaded colormap:", err)
+			continue
+		}
+		colorMaps[name] = newColorMapEntry(points, "uploaded")
+	}
+	colorMapsMutex.Lock()
+	userColorMaps = colorMaps
+	colorMapsMutex.Unlock()
+}
+
+func lookupBuiltinColorMap(colorMap string) ([]colorPoint, bool) {
+	if alias, ok := colorMapAliases[colorMap]; ok {
+		colorMap = alias
+	}
+	points, ok := builtinColorMaps[colorMap]
+	return points, ok
+}
+
+// lookupColorMap returns the control points of a built in, config file or uploaded colormap.
+func lookupColorMap(colorMap string) ([]colorPoint, bool) {
+	if points, ok := lookupBuiltinColorMap(colorMap); ok {
+		return points, true
+	}
+	colorMapsMutex.RLock()
+	defer colorMapsMutex.RUnlock()
+	entry, ok := userColorMaps[colorMap]
+	return entry.Points, ok
+}
+
+// colorMapVersion returns the version of a config file or uploaded colormap for the cache file names of output drawn with it, as
+// their colors can change while the name stays the same. Built in colormaps never change so have none.
+func colorMapVersion(colorMap string) string {
+	if _, ok := lookupBuiltinColorMap(colorMap); ok {
+		return ""
+	}
+	colorMapsMutex.RLock()
+	defer colorMapsMutex.RUnlock()
+	if entry, ok := userColorMaps[colorMap]; ok {
+		return "cm" + entry.Version
+	}
+	return ""
+}
+
+// getColorConrolPoints returns the control points of a colormap. Requests are checked for unknown colormaps before any output is
+// made, so the fallback to RampColormap is only a safeguard.
+func getColorConrolPoints(colorMap string) []colorPoint {
+	points, ok := lookupColorMap(colorMap)
+	if !ok {
 		log.Println("Unknown Colormap", colorMap, "using default RampColormap")
-		outColors = make([]colorPoint, 7)
-		outColors[0] = colorPoint{0, 0, 0, 15}
-		outColors[1] = colorPoint{10, 0, 0, 50}
-		outColors[2] = colorPoint{31, 0, 65, 75}
-		outColors[3] = colorPoint{50, 0, 80, 0}
-		outColors[4] = colorPoint{70, 75, 80, 0}
-		outColors[5] = colorPoint{83, 100, 60, 0}
-		outColors[6] = colorPoint{100, 100, 0, 0}
+		points = builtinColorMaps["RampColormap"]
 	}
-	return outColors
+	return points
+}
+
+type colorMapInfo struct {
+	Name   string `json:"name"`
+	Source string `json:"source"`
+}
+
+// listColorMaps returns every colormap that can be requested, sorted by name.
+func listColorMaps() []colorMapInfo {
+	var colorMaps []colorMapInfo
+	for name := range builtinColorMaps {
+		colorMaps = append(colorMaps, colorMapInfo{name, "builtin"})
+	}
+	for alias := range colorMapAliases {
+		colorMaps = append(colorMaps, colorMapInfo{alias, "builtin"})
+	}
+	colorMapsMutex.RLock()
+	for name, entry := range userColorMaps {
+		colorMaps = append(colorMaps, colorMapInfo{name, entry.Source})
+	}
+	colorMapsMutex.RUnlock()
+	sort.Slice(colorMaps, func(i, j int) bool { return colorMaps[i].Name < colorMaps[j].Name })
+	return colorMaps
+}
+
+type colorMapServer struct{}
+
+func (s *colorMapServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	//url - /sds/colormaps lists the colormaps
+	//url - /sds/colormaps/<name> GET returns the 256 colors of a colormap, POST uploads one and DELETE removes an uploaded one
+	pathData := strings.Split(r.URL.Path, "/")
+	name := ""
+	if len(pathData) > 3 {
+		name = pathData[3]
+	}
+	var responseJSON []byte
+	var marshalError error
+	switch {
+	case name == "" && r.Method == http.MethodGet:
+		responseJSON, marshalError = json.Marshal(listColorMaps())
+	case r.Method == http.MethodGet:
+		points, ok := lookupColorMap(name)
+		if !ok {
+			log.Println("Unknown colormap", name)
+			w.WriteHeader(404)
+			return
+		}
+		table := make([][]float64, 0, 256)
+		for _, color := range makeColorPalette(points, 256) {
+			table = append(table, []float64{color.red, color.green, color.blue})
+		}
+		responseJSON, marshalError = json.Marshal(colorMapDefinition{Name: name, Table: table})
+	case r.Method == http.MethodPost || r.Method == http.MethodPut:
+		if !colorMapNamePattern.MatchString(name) {
+			log.Println("Uploaded colormap names must be 1 to 64 letters, digits, _ or -. got:", name)
+			w.WriteHeader(400)
+			return
+		}
+		colorMapsMutex.RLock()
+		entry, exists := userColorMaps[name]
+		colorMapsMutex.RUnlock()
+		if _, builtin := lookupBuiltinColorMap(name); builtin || (exists && entry.Source != "uploaded") {
+			log.Println("Colormap", name, "is built in or in the config file and cannot be replaced")
+			w.WriteHeader(400)
+			return
+		}
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+		var definition colorMapDefinition
+		if err == nil {
+			err = json.Unmarshal(body, &definition)
+		}
+		definition.Name = name
+		var points []colorPoint
+		if err == nil {
+			points, err = definition.controlPoints()
+		}
+		if err != nil {
+			log.Println("Invalid colormap upload:", err)
+			w.WriteHeader(400)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		definitionJSON, _ := json.Marshal(definition)
+		putItemInCache(name+".json", "colormaps/", definitionJSON)
+		colorMapsMutex.Lock()
+		userColorMaps[name] = newColorMapEntry(points, "uploaded")
+		colorMapsMutex.Unlock()
+		responseJSON, marshalError = json.Marshal(colorMapInfo{name, "uploaded"})
+	case r.Method == http.MethodDelete:
+		colorMapsMutex.Lock()
+		entry, exists := userColorMaps[name]
+		if exists && entry.Source == "uploaded" {
+			delete(userColorMaps, name)
+		}
+		colorMapsMutex.Unlock()
+		if !exists || entry.Source != "uploaded" {
+			log.Println("Only uploaded colormaps can be deleted. got:", name)
+			w.WriteHeader(404)
+			return
+		}
+		// Checked against the pattern when it was uploaded, so the name is a plain file name
+		if err := os.Remove(configuration.CacheLocation + "colormaps/" + name + ".json"); err != nil {
+			log.Println("Error removing colormap file", err)
+		}
+		responseJSON, marshalError = json.Marshal(colorMapInfo{name, "uploaded"})
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if marshalError != nil {
+		log.Println("Error Encoding colormaps", marshalError)
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Add("Access-Control-Allow-Origin", "*")
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(responseJSON)
 }
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Number of palette colors values are mapped onto when neither the request nor the config file give one.
+const defaultNumColors = 1000
+
+// Fewest and most palette colors a request may ask for.
+const (
+	minNumColors = 2
+	maxNumColors = 65536
+)
+
+// Decades a log color scale spans when zmin is not above zero, so there is no range of the data to take the log of.
+const logScaleDecades = 3
+
+// configNumColors returns the number of palette colors of the config file, or the default when it does not give one.
+func configNumColors() int {
+	if configuration.NumColors < minNumColors || configuration.NumColors > maxNumColors {
+		return defaultNumColors
+	}
+	return configuration.NumColors
+}
+
+type colorScale struct {
+	Kind  string
+	Gamma float64
+}
+
+// parseColorScale reads a cscale option, one of linear, log, sqrt or gamma:<g> with g greater than zero.
+func parseColorScale(param string) (colorScale, bool) {
+	switch {
+	case param == "linear" || param == "log":
+		return colorScale{Kind: param}, true
+	case param == "sqrt":
+		return colorScale{"gamma", 0.5}, true
+	case strings.HasPrefix(param, "gamma:"):
+		gamma, err := strconv.ParseFloat(strings.TrimPrefix(param, "gamma:"), 64)
+		if err != nil || !(gamma > 0) || math.IsInf(gamma, 0) {
+			return colorScale{}, false
+		}
+		return colorScale{"gamma", gamma}, true
+	}
+	return colorScale{}, false
+}
+
+// scale maps a value to its position from 0 at zmin to 1 at zmax. The position is linear in the value for linear, and for gamma it
+// is the linear position to the power gamma, so a gamma below one spreads the low values over more colors. A log scale is
+// logarithmic from zmin to zmax when zmin is above zero, otherwise it spans logScaleDecades from zmin. Positions outside 0 to 1 are
+// values outside zmin and zmax.
+func (scale colorScale) scale(value, zmin, zmax float64) float64 {
+	position := (value - zmin) / (zmax - zmin)
+	switch scale.Kind {
+	case "log":
+		if zmin > 0 {
+			return math.Log(value/zmin) / math.Log(zmax/zmin)
+		}
+		return math.Log10(1+(math.Pow(10, logScaleDecades)-1)*position) / logScaleDecades
+	case "gamma":
+		if position < 0 { // A negative position to a fractional power is NaN, it is below zmin however it is scaled
+			return position
+		}
+		return math.Pow(position, scale.Gamma)
+	}
+	return position
+}
+
+// colorOptions are the choices of how values are turned into colors, other than the colormap and range.
+type colorOptions struct {
+	Scale          colorScale
+	Reverse        bool
+	NumColors      int
+	NaNColor       *[4]byte // Color of NaN values, the first color of the colormap when nil
+	UnderColor     *[4]byte // Color of values below zmin, the first color of the colormap when nil
+	OverColor      *[4]byte // Color of values above zmax, the last color of the colormap when nil
+	IntensityAlpha bool     // Colors from the colormap are as opaque as their position on the color scale
+}
+
+// parseOutputColor reads a color for values outside the colormap. It is transparent or a color of RRGGBB or RRGGBBAA hex digits.
+func parseOutputColor(param string) ([4]byte, bool) {
+	if param == "transparent" {
+		return [4]byte{0, 0, 0, 0}, true
+	}
+	return parseMaskColor(param)
+}
+
+// getOutputColorParam reads an optional color url argument, returning nil when it is not given or not a color.
+func getOutputColorParam(r *http.Request, keyname string) *[4]byte {
+	param, ok := getURLQueryParamString(r, keyname)
+	if !ok {
+		return nil
+	}
+	color, ok := parseOutputColor(param)
+	if !ok {
+		log.Println("Unknown", keyname, param, "using the colormap")
+		return nil
+	}
+	return &color
+}
+
+// colorizeValues converts values to RGBA using a colormap of NumColors colors, running from zmin to zmax with the color scale. NaN
+// values and values outside zmin and zmax get their own colors when the options give them, otherwise the color at the nearest end.
+// The colormap is reversed when Reverse is set.
+func colorizeValues(dataIn []float64, zmin, zmax float64, colorMap string, options colorOptions) []byte {
+	colorPalette := makeColorPalette(getColorConrolPoints(colorMap), options.NumColors)
+	if options.Reverse {
+		for i, j := 0, len(colorPalette)-1; i < j; i, j = i+1, j-1 {
+			colorPalette[i], colorPalette[j] = colorPalette[j], colorPalette[i]
+		}
+	}
+	paletteColor := func(index int, alpha byte) [4]byte {
+		return [4]byte{byte(colorPalette[index].red), byte(colorPalette[index].green), byte(colorPalette[index].blue), alpha}
+	}
+	endColor := func(color *[4]byte, index int, alpha byte) [4]byte {
+		if color != nil {
+			return *color
+		}
+		return paletteColor(index, alpha)
+	}
+	// With intensity alpha, values below zmin are as transparent as zmin and values above zmax as opaque as zmax
+	underAlpha := byte(255)
+	if options.IntensityAlpha {
+		underAlpha = 0
+	}
+	scaled := zmax != zmin && !math.IsNaN(zmax-zmin)
+
+	dataOut := new(bytes.Buffer)
+	dataOut.Grow(4 * len(dataIn))
+	for i := 0; i < len(dataIn); i++ {
+		var color [4]byte
+		switch {
+		case math.IsNaN(dataIn[i]):
+			color = endColor(options.NaNColor, 0, 255)
+		case !scaled:
+			color = paletteColor(0, 255)
+		case dataIn[i] < zmin:
+			color = endColor(options.UnderColor, 0, underAlpha)
+		case dataIn[i] > zmax:
+			color = endColor(options.OverColor, options.NumColors-1, 255)
+		default:
+			position := options.Scale.scale(dataIn[i], zmin, zmax)
+			if math.IsNaN(position) { // Values below zero on a log scale from a positive zmin
+				position = 0
+			}
+			position = math.Min(math.Max(position, 0), 1)
+			colorIndex := math.Round(position*float64(options.NumColors)) - 1
+			colorIndex = math.Min(math.Max(colorIndex, 0), float64(options.NumColors-1)) //Ensure colorIndex is within the colorPalette
+			alpha := byte(255)
+			if options.IntensityAlpha {
+				alpha = byte(math.Round(255 * position))
+			}
+			color = paletteColor(int(colorIndex), alpha)
+		}
+		dataOut.Write(color[:])
+	}
+	return dataOut.Bytes()
+}
+
+// colorOptions returns the color options of a request.
+func (request *rdsRequest) colorOptions() colorOptions {
+	scale, _ := parseColorScale(request.CScale)
+	return colorOptions{
+		Scale:          scale,
+		Reverse:        request.ReverseColors,
+		NumColors:      request.NumColors,
+		NaNColor:       request.NaNColor,
+		UnderColor:     request.UnderColor,
+		OverColor:      request.OverColor,
+		IntensityAlpha: request.Alpha == "intensity",
+	}
+}
+
+// createColorOutput converts the processed values of a request to RGBA with its colormap and color options.
+func (request *rdsRequest) createColorOutput(processedData []float64) []byte {
+	return colorizeValues(processedData, request.Zmin, request.Zmax, request.ColorMap, request.colorOptions())
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strings"
+)
+
+// openCompare opens the file given by compare and checks that it can be compared element by element with the file of the request.
+// It does nothing when no compare file is given.
+func (request *rdsRequest) openCompare(wholeLine bool) bool {
+	if request.CompareSource == "" {
+		return true
+	}
+	compare, ok := request.openMatchingFile(request.CompareSource, wholeLine, request.CompareXOffset, request.CompareYOffset)
+	if !ok {
+		return false
+	}
+	request.Compare = compare
+	return true
+}
+
+// openMatchingFile opens a second file that is read alongside the file of the request. It is read with the same cxmode, tune and subsize as
+// the request, and wholeLine reads it as a single line, as lds does. Every element of the request file, moved by the offsets, must lie in the second file.
+func (request *rdsRequest) openMatchingFile(source string, wholeLine bool, xoffset, yoffset int) (*rdsRequest, bool) {
+	compare := *request
+	compare.CompareSource = ""
+	compare.Compare = nil
+	compare.Expr = ""
+	compare.Expression = nil
+	compare.Baseline, compare.RowNorm = "none", "none"
+	compare.Background = nil
+
+	// The path comes from the query rather than the cleaned url path, so it must not be able to leave its location
+	for _, segment := range strings.Split(source, "/") {
+		if segment == ".." {
+			log.Println("File", source, "must not contain ..")
+			return nil, false
+		}
+	}
+	var ok bool
+	compare.Reader, compare.FileName, ok = openDataSource(source, 0)
+	if !ok {
+		log.Println("Unable to open file", source)
+		return nil, false
+	}
+	compare.SourcePath = source
+	if !strings.Contains(compare.FileName, ".tmp") && !strings.Contains(compare.FileName, ".prm") {
+		log.Println("Invalid File Type", compare.FileName)
+		return nil, false
+	}
+	compare.processBlueFileHeader()
+	if wholeLine {
+		if compare.FileType != 1000 {
+			log.Println("File", source, "for a line plot must be a type 1000 file")
+			return nil, false
+		}
+		compare.FileXSize = int(float64(compare.FileDataSize) / bytesPerAtomMap[string(compare.FileFormat[1])])
+		if string(compare.FileFormat[0]) == "C" {
+			compare.FileXSize = compare.FileXSize / 2
+		}
+		compare.FileYSize = 1
+	} else {
+		if request.SubsizeSet {
+			compare.FileXSize = request.Subsize
+		} else if compare.FileType == 1000 {
+			log.Println("For type 1000 files, a subsize needs to be set")
+			return nil, false
+		}
+		compare.computeYSize()
+	}
+
+	if compare.FileFormat[0] != request.FileFormat[0] {
+		log.Println("File format", compare.FileFormat, "of", source, "is not compatible with", request.FileFormat, ". Both must be scalar or both complex")
+		return nil, false
+	}
+	if compare.Filexdelta != request.Filexdelta {
+		log.Println("xdelta", compare.Filexdelta, "of", source, "does not match", request.Filexdelta)
+		return nil, false
+	}
+	if compare.FileType == 2000 && request.FileType == 2000 && compare.Fileydelta != request.Fileydelta {
+		log.Println("ydelta", compare.Fileydelta, "of", source, "does not match", request.Fileydelta)
+		return nil, false
+	}
+	if xoffset < 0 || yoffset < 0 {
+		log.Println("Offsets must not be negative", xoffset, yoffset)
+		return nil, false
+	}
+	if request.FileXSize+xoffset > compare.FileXSize || request.FileYSize+yoffset > compare.FileYSize {
+		log.Println("File", source, "of", compare.FileXSize, "by", compare.FileYSize, "is too small for a file of", request.FileXSize, "by", request.FileYSize,
+			"at offset", xoffset, yoffset)
+		return nil, false
+	}
+	return &compare, true
+}
+
+// compareOptionsKey describes the compare file and options of the request.
+func (request *rdsRequest) compareOptionsKey() string {
+	return fmt.Sprintf("cmp%s%s%d_%d", request.Compare.rangeIndexKey(), request.CompareOp, request.CompareXOffset, request.CompareYOffset)
+}
+
+// compareLine replaces each value of data with its difference, ratio or dB ratio to the matching value of compareData.
+func compareLine(data, compareData []float64, compareOp string) {
+	loThresh := 1.0e-20
+	for i := range data {
+		switch compareOp {
+		case "ratio":
+			divisor := compareData[i]
+			if math.Abs(divisor) < loThresh {
+				divisor = math.Copysign(loThresh, divisor)
+			}
+			data[i] = data[i] / divisor
+		case "dbratio":
+			data[i] = 10 * math.Log10(math.Max(data[i], loThresh)/math.Max(compareData[i], loThresh))
+		default: // diff
+			data[i] = data[i] - compareData[i]
+		}
+	}
+}
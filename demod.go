@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Most samples the demod mode returns in one request.
+const maxDemodSamples = 1 << 24
+
+// Output sample rate of the demod mode for WAV output when rate is not given.
+const defaultAudioRate = 48000
+
+// demodLine reads xsize samples of a row of complex data starting at xstart and demodulates them. The samples are low-pass filtered
+// to the bandwidth of the request first when one is given. am gives the envelope, fm the instantaneous frequency in Hz and
+// pm the phase in radians. Samples either side of the line are read so the filter and fm are not affected by where the line starts.
+// Fewer than xsize values are returned when the line runs past the end of the file.
+func (request *rdsRequest) demodLine(row, xstart, xsize int) []float64 {
+	xdelta := request.Filexdelta
+	if xdelta <= 0 {
+		xdelta = 1
+	}
+	var taps []float64
+	pad := 1
+	cutoff := request.Bandwidth / 2 * xdelta // cycles per sample
+	if request.Bandwidth > 0 && cutoff < 0.5 {
+		taps = designLowPassCutoff(lowPassTaps(cutoff, request.FilterTaps), cutoff, request.FilterWindow)
+		pad += len(taps) / 2
+	}
+	first := int(math.Max(math.Min(float64(xstart-pad), float64(request.FileXSize)), 0))
+	end := int(math.Max(math.Min(float64(xstart+xsize+pad), float64(request.FileXSize)), float64(first)))
+	iq := getRawLineData(*request, row, first, end-first)
+
+	re := make([]float64, len(iq)/2)
+	im := make([]float64, len(iq)/2)
+	for i := range re {
+		re[i] = iq[2*i]
+		im[i] = iq[2*i+1]
+	}
+	if taps != nil {
+		re = firDecimate(re, 1, taps)
+		im = firDecimate(im, 1, taps)
+	}
+
+	// Past the end of the file fewer samples are read, and the line is cut short as getRawLineData does
+	outSize := int(math.Max(math.Min(float64(xsize), float64(len(re)-(xstart-first))), 0))
+	outData := make([]float64, outSize)
+	for i := range outData {
+		j := xstart - first + i
+		switch request.Demod {
+		case "am":
+			outData[i] = math.Hypot(re[j], im[j])
+		case "pm":
+			outData[i] = math.Atan2(im[j], re[j])
+		case "fm":
+			if j == 0 { // First sample of the row, there is no sample before it
+				continue
+			}
+			// Phase of the sample times the conjugate of the sample before it
+			real := re[j]*re[j-1] + im[j]*im[j-1]
+			imag := im[j]*re[j-1] - re[j]*im[j-1]
+			outData[i] = math.Atan2(imag, real) / (2 * math.Pi * xdelta)
+		}
+	}
+	return outData
+}
+
+type demodServer struct{}
+
+func (s *demodServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var demodRequest rdsRequest
+	var ok bool
+
+	//url - /sds/demod/<LocationName>/path/to/filename?demod=&tune=&bandwidth=&x1=&x2=&rate=&outfmt=
+	demodRequest.getQueryParams(r)
+	if demodRequest.Demod == "" {
+		log.Println("demod must be am, fm or pm")
+		w.WriteHeader(400)
+		return
+	}
+	outputFmt, ok := getURLQueryParamString(r, "outfmt")
+	if !ok {
+		outputFmt = "SF"
+	}
+	if outputFmt != "WAV" && outputFmt != "SB" && outputFmt != "SI" && outputFmt != "SL" && outputFmt != "SF" && outputFmt != "SD" {
+		log.Println("Demod outfmt must be WAV, SB, SI, SL, SF or SD. got:", outputFmt)
+		w.WriteHeader(400)
+		return
+	}
+
+	start := time.Now()
+	if !demodRequest.openRegionFile(r.URL.Path, 3) {
+		w.WriteHeader(400)
+		return
+	}
+	if demodRequest.FileType != 1000 || string(demodRequest.FileFormat[0]) != "C" {
+		log.Println("Demod mode only supports complex type 1000 files. got:", demodRequest.FileType, demodRequest.FileFormat)
+		w.WriteHeader(400)
+		return
+	}
+	if !demodRequest.getRegionQueryParams(r) {
+		w.WriteHeader(400)
+		return
+	}
+
+	fileRate := 1.0
+	if demodRequest.Filexdelta > 0 {
+		fileRate = 1 / demodRequest.Filexdelta
+	}
+	rate, ok := getURLQueryParamFloat(r, "rate")
+	if !ok {
+		rate = fileRate
+		if outputFmt == "WAV" {
+			rate = defaultAudioRate
+		}
+	}
+	if rate <= 0 || (outputFmt == "WAV" && (rate != math.Round(rate) || rate > math.MaxInt32/2)) {
+		log.Println("rate must be greater than zero, and a whole number for WAV. got:", rate)
+		w.WriteHeader(400)
+		return
+	}
+	numSamples := int(float64(demodRequest.Xsize) * rate / fileRate)
+	if numSamples < 1 || numSamples > maxDemodSamples {
+		log.Println("Demod would give", numSamples, "samples, must be from 1 to", maxDemodSamples)
+		w.WriteHeader(400)
+		return
+	}
+
+	samples := resampleSelection(demodRequest, rate, 0, numSamples)
+	var data []byte
+	if outputFmt == "WAV" {
+		if !demodRequest.Zset {
+			demodRequest.findZminMax()
+		}
+		data = append(wavHeader(numSamples, int(rate)), wavSamples(samples, demodRequest.Zmin, demodRequest.Zmax)...)
+		w.Header().Add("Content-Type", "audio/wav")
+	} else {
+		data = createOutput(samples, outputFmt, 0, 0, "")
+	}
+	log.Println("Demodulated", numSamples, "samples in", time.Since(start))
+
+	w.Header().Add("Access-Control-Allow-Origin", "*")
+	w.Header().Add("Access-Control-Expose-Headers", "demod,rate,numsamples,zmin,zmax")
+	w.Header().Add("demod", demodRequest.Demod)
+	w.Header().Add("rate", strconv.FormatFloat(rate, 'f', -1, 64))
+	w.Header().Add("numsamples", strconv.Itoa(numSamples))
+	w.Header().Add("zmin", fmt.Sprintf("%f", demodRequest.Zmin))
+	w.Header().Add("zmax", fmt.Sprintf("%f", demodRequest.Zmax))
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
@@ -0,0 +1,461 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Limits that keep an expression cheap to parse and evaluate.
+const maxExpressionLength = 1024
+const maxExpressionDepth = 64
+
+// Most files an expression may use besides the file of the request. They are named b, c, d and so on.
+const maxExpressionFiles = 8
+
+// exprEnv holds the values an expression is evaluated with: one value per file, then the column and row of the element.
+type exprEnv struct {
+	Values []float64
+	X, Y   float64
+}
+
+type exprNode func(env *exprEnv) float64
+
+type exprFunction struct {
+	MinArgs, MaxArgs int // MaxArgs of -1 allows any number of arguments
+	Call             func(args []float64) float64
+}
+
+var exprFunctions = map[string]exprFunction{
+	"abs":   {1, 1, func(args []float64) float64 { return math.Abs(args[0]) }},
+	"sqrt":  {1, 1, func(args []float64) float64 { return math.Sqrt(args[0]) }},
+	"exp":   {1, 1, func(args []float64) float64 { return math.Exp(args[0]) }},
+	"log":   {1, 1, func(args []float64) float64 { return math.Log(args[0]) }},
+	"log10": {1, 1, func(args []float64) float64 { return math.Log10(args[0]) }},
+	"sin":   {1, 1, func(args []float64) float64 { return math.Sin(args[0]) }},
+	"cos":   {1, 1, func(args []float64) float64 { return math.Cos(args[0]) }},
+	"tan":   {1, 1, func(args []float64) float64 { return math.Tan(args[0]) }},
+	"floor": {1, 1, func(args []float64) float64 { return math.Floor(args[0]) }},
+	"ceil":  {1, 1, func(args []float64) float64 { return math.Ceil(args[0]) }},
+	"round": {1, 1, func(args []float64) float64 { return math.Round(args[0]) }},
+	"atan2": {2, 2, func(args []float64) float64 { return math.Atan2(args[0], args[1]) }},
+	"pow":   {2, 2, func(args []float64) float64 { return math.Pow(args[0], args[1]) }},
+	"hypot": {2, 2, func(args []float64) float64 { return math.Hypot(args[0], args[1]) }},
+	"min": {2, -1, func(args []float64) float64 {
+		value := args[0]
+		for _, arg := range args[1:] {
+			value = math.Min(value, arg)
+		}
+		return value
+	}},
+	"max": {2, -1, func(args []float64) float64 {
+		value := args[0]
+		for _, arg := range args[1:] {
+			value = math.Max(value, arg)
+		}
+		return value
+	}},
+	"clamp": {3, 3, func(args []float64) float64 { return math.Max(args[1], math.Min(args[0], args[2])) }},
+	"if": {3, 3, func(args []float64) float64 {
+		if args[0] != 0 {
+			return args[1]
+		}
+		return args[2]
+	}},
+}
+
+var exprConstants = map[string]float64{
+	"pi":  math.Pi,
+	"nan": math.NaN(),
+	"inf": math.Inf(1),
+}
+
+type exprToken struct {
+	Text     string
+	Number   float64
+	IsNumber bool
+	Position int
+}
+
+// tokenizeExpression splits an expression into numbers, names and operators.
+func tokenizeExpression(expr string) ([]exprToken, error) {
+	var tokens []exprToken
+	for i := 0; i < len(expr); {
+		c := rune(expr[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case unicode.IsDigit(c) || c == '.':
+			end := i
+			for end < len(expr) && (unicode.IsDigit(rune(expr[end])) || expr[end] == '.') {
+				end++
+			}
+			if end < len(expr) && (expr[end] == 'e' || expr[end] == 'E') {
+				exponent := end + 1
+				if exponent < len(expr) && (expr[exponent] == '+' || expr[exponent] == '-') {
+					exponent++
+				}
+				if exponent < len(expr) && unicode.IsDigit(rune(expr[exponent])) {
+					end = exponent
+					for end < len(expr) && unicode.IsDigit(rune(expr[end])) {
+						end++
+					}
+				}
+			}
+			number, err := strconv.ParseFloat(expr[i:end], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number %q at position %d", expr[i:end], i+1)
+			}
+			tokens = append(tokens, exprToken{Text: expr[i:end], Number: number, IsNumber: true, Position: i + 1})
+			i = end
+		case unicode.IsLetter(c) || c == '_':
+			end := i
+			for end < len(expr) && (unicode.IsLetter(rune(expr[end])) || unicode.IsDigit(rune(expr[end])) || expr[end] == '_') {
+				end++
+			}
+			tokens = append(tokens, exprToken{Text: expr[i:end], Position: i + 1})
+			i = end
+		default:
+			operator := string(c)
+			if i+1 < len(expr) {
+				switch expr[i : i+2] {
+				case "<=", ">=", "==", "!=", "&&", "||":
+					operator = expr[i : i+2]
+				}
+			}
+			if !strings.Contains("+-*/%^(),<>!", operator) && len(operator) == 1 {
+				return nil, fmt.Errorf("unexpected character %q at position %d", operator, i+1)
+			}
+			tokens = append(tokens, exprToken{Text: operator, Position: i + 1})
+			i += len(operator)
+		}
+	}
+	return tokens, nil
+}
+
+// exprParser is a recursive descent parser that turns the tokens of an expression into a tree of closures.
+type exprParser struct {
+	Tokens   []exprToken
+	Next     int
+	Depth    int
+	NumFiles int
+}
+
+func (parser *exprParser) peek() string {
+	if parser.Next < len(parser.Tokens) {
+		return parser.Tokens[parser.Next].Text
+	}
+	return ""
+}
+
+func (parser *exprParser) position() int {
+	if parser.Next < len(parser.Tokens) {
+		return parser.Tokens[parser.Next].Position
+	}
+	return -1
+}
+
+func (parser *exprParser) unexpected() error {
+	if parser.Next >= len(parser.Tokens) {
+		return fmt.Errorf("unexpected end of expression")
+	}
+	return fmt.Errorf("unexpected %q at position %d", parser.peek(), parser.position())
+}
+
+func (parser *exprParser) expect(text string) error {
+	if parser.peek() != text {
+		if parser.Next >= len(parser.Tokens) {
+			return fmt.Errorf("expected %q at end of expression", text)
+		}
+		return fmt.Errorf("expected %q at position %d, got %q", text, parser.position(), parser.peek())
+	}
+	parser.Next++
+	return nil
+}
+
+// binaryLevels are the binary operators from the lowest precedence to the highest. ^ is handled separately since it is right associative.
+var binaryLevels = [][]string{
+	{"||"},
+	{"&&"},
+	{"<", "<=", ">", ">=", "==", "!="},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+func binaryOperator(operator string, left, right exprNode) exprNode {
+	truth := func(b bool) float64 {
+		if b {
+			return 1
+		}
+		return 0
+	}
+	switch operator {
+	case "||":
+		return func(env *exprEnv) float64 { return truth(left(env) != 0 || right(env) != 0) }
+	case "&&":
+		return func(env *exprEnv) float64 { return truth(left(env) != 0 && right(env) != 0) }
+	case "<":
+		return func(env *exprEnv) float64 { return truth(left(env) < right(env)) }
+	case "<=":
+		return func(env *exprEnv) float64 { return truth(left(env) <= right(env)) }
+	case ">":
+		return func(env *exprEnv) float64 { return truth(left(env) > right(env)) }
+	case ">=":
+		return func(env *exprEnv) float64 { return truth(left(env) >= right(env)) }
+	case "==":
+		return func(env *exprEnv) float64 { return truth(left(env) == right(env)) }
+	case "!=":
+		return func(env *exprEnv) float64 { return truth(left(env) != right(env)) }
+	case "+":
+		return func(env *exprEnv) float64 { return left(env) + right(env) }
+	case "-":
+		return func(env *exprEnv) float64 { return left(env) - right(env) }
+	case "*":
+		return func(env *exprEnv) float64 { return left(env) * right(env) }
+	case "/":
+		return func(env *exprEnv) float64 { return left(env) / right(env) }
+	case "%":
+		return func(env *exprEnv) float64 { return math.Mod(left(env), right(env)) }
+	default: // ^
+		return func(env *exprEnv) float64 { return math.Pow(left(env), right(env)) }
+	}
+}
+
+func (parser *exprParser) parseBinary(level int) (exprNode, error) {
+	if level == len(binaryLevels) {
+		return parser.parseUnary()
+	}
+	left, err := parser.parseBinary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		operator := parser.peek()
+		found := false
+		for _, candidate := range binaryLevels[level] {
+			if operator == candidate {
+				found = true
+			}
+		}
+		if !found {
+			return left, nil
+		}
+		parser.Next++
+		right, err := parser.parseBinary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = binaryOperator(operator, left, right)
+	}
+}
+
+func (parser *exprParser) parseUnary() (exprNode, error) {
+	parser.Depth++
+	defer func() { parser.Depth-- }()
+	if parser.Depth > maxExpressionDepth {
+		return nil, fmt.Errorf("expression is nested more than %d deep", maxExpressionDepth)
+	}
+	switch parser.peek() {
+	case "-":
+		parser.Next++
+		operand, err := parser.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(env *exprEnv) float64 { return -operand(env) }, nil
+	case "+":
+		parser.Next++
+		return parser.parseUnary()
+	case "!":
+		parser.Next++
+		operand, err := parser.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(env *exprEnv) float64 {
+			if operand(env) == 0 {
+				return 1
+			}
+			return 0
+		}, nil
+	}
+	base, err := parser.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	if parser.peek() == "^" {
+		parser.Next++
+		exponent, err := parser.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return binaryOperator("^", base, exponent), nil
+	}
+	return base, nil
+}
+
+func (parser *exprParser) parsePrimary() (exprNode, error) {
+	if parser.Next >= len(parser.Tokens) {
+		return nil, parser.unexpected()
+	}
+	token := parser.Tokens[parser.Next]
+	switch {
+	case token.IsNumber:
+		parser.Next++
+		number := token.Number
+		return func(env *exprEnv) float64 { return number }, nil
+	case token.Text == "(":
+		parser.Next++
+		parser.Depth++
+		defer func() { parser.Depth-- }()
+		node, err := parser.parseBinary(0)
+		if err != nil {
+			return nil, err
+		}
+		return node, parser.expect(")")
+	case unicode.IsLetter(rune(token.Text[0])) || token.Text[0] == '_':
+		parser.Next++
+		name := strings.ToLower(token.Text)
+		if parser.peek() == "(" {
+			return parser.parseCall(name, token.Position)
+		}
+		if value, ok := exprConstants[name]; ok {
+			return func(env *exprEnv) float64 { return value }, nil
+		}
+		switch name {
+		case "x":
+			return func(env *exprEnv) float64 { return env.X }, nil
+		case "y":
+			return func(env *exprEnv) float64 { return env.Y }, nil
+		}
+		if len(name) == 1 && name[0] >= 'a' && int(name[0]-'a') <= parser.NumFiles {
+			file := int(name[0] - 'a')
+			return func(env *exprEnv) float64 { return env.Values[file] }, nil
+		}
+		return nil, fmt.Errorf("unknown name %q at position %d", token.Text, token.Position)
+	}
+	return nil, parser.unexpected()
+}
+
+func (parser *exprParser) parseCall(name string, position int) (exprNode, error) {
+	function, ok := exprFunctions[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %q at position %d", name, position)
+	}
+	parser.Next++ // (
+	var args []exprNode
+	if parser.peek() != ")" {
+		for {
+			arg, err := parser.parseBinary(0)
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+			if parser.peek() != "," {
+				break
+			}
+			parser.Next++
+		}
+	}
+	if err := parser.expect(")"); err != nil {
+		return nil, err
+	}
+	if len(args) < function.MinArgs || (function.MaxArgs >= 0 && len(args) > function.MaxArgs) {
+		return nil, fmt.Errorf("function %q at position %d called with %d arguments", name, position, len(args))
+	}
+	return func(env *exprEnv) float64 {
+		values := make([]float64, len(args))
+		for i := range args {
+			values[i] = args[i](env)
+		}
+		return function.Call(values)
+	}, nil
+}
+
+// compileExpression parses an expression over the file of the request (a), numFiles other files (b, c, ...) and the column and row of each
+// element (x and y). Only arithmetic, comparisons and the functions in exprFunctions are allowed.
+func compileExpression(expr string, numFiles int) (exprNode, error) {
+	if len(expr) > maxExpressionLength {
+		return nil, fmt.Errorf("expression is longer than %d characters", maxExpressionLength)
+	}
+	tokens, err := tokenizeExpression(expr)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("expression is empty")
+	}
+	parser := exprParser{Tokens: tokens, NumFiles: numFiles}
+	node, err := parser.parseBinary(0)
+	if err != nil {
+		return nil, err
+	}
+	if parser.Next < len(tokens) {
+		return nil, parser.unexpected()
+	}
+	return node, nil
+}
+
+// compiledExpression is an expression of a request with the files it reads.
+type compiledExpression struct {
+	Root  exprNode
+	Files []*rdsRequest
+}
+
+// openExpression compiles the expr of the request and opens its files. It does nothing when no expr is given.
+// wholeLine reads the files as single lines, as lds does.
+func (request *rdsRequest) openExpression(wholeLine bool) error {
+	if request.Expr == "" {
+		return nil
+	}
+	if len(request.ExprFiles) > maxExpressionFiles {
+		return fmt.Errorf("at most %d exprfile values may be given", maxExpressionFiles)
+	}
+	root, err := compileExpression(request.Expr, len(request.ExprFiles))
+	if err != nil {
+		return fmt.Errorf("invalid expr %q: %v", request.Expr, err)
+	}
+	expression := &compiledExpression{Root: root}
+	for i, source := range request.ExprFiles {
+		file, ok := request.openMatchingFile(source, wholeLine, 0, 0)
+		if !ok {
+			return fmt.Errorf("exprfile %c (%s) cannot be read with the file of the request", 'b'+i, source)
+		}
+		expression.Files = append(expression.Files, file)
+	}
+	request.Expression = expression
+	return nil
+}
+
+// expressionOptionsKey describes the expression and files of the request.
+func (request *rdsRequest) expressionOptionsKey() string {
+	hash := fnv.New64a()
+	hash.Write([]byte(request.Expr))
+	key := fmt.Sprintf("expr%x", hash.Sum64())
+	for _, file := range request.Expression.Files {
+		key += "_" + file.rangeIndexKey()
+	}
+	return key
+}
+
+// evaluateExpression returns the expression of the request evaluated at each element of data, which holds xsize values of row starting at xstart.
+func (request *rdsRequest) evaluateExpression(data []float64, row, xstart, xsize int) []float64 {
+	env := exprEnv{Values: make([]float64, len(request.Expression.Files)+1), Y: float64(row)}
+	fileData := make([][]float64, len(request.Expression.Files))
+	for i, file := range request.Expression.Files {
+		fileData[i] = getLineData(*file, row, xstart, xsize)
+	}
+	outData := make([]float64, len(data))
+	for i := range data {
+		env.Values[0] = data[i]
+		for file := range fileData {
+			env.Values[file+1] = fileData[file][i]
+		}
+		env.X = float64(xstart + i)
+		outData[i] = request.Expression.Root(&env)
+	}
+	return outData
+}
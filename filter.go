@@ -0,0 +1,167 @@
+package main
+
+import (
+	"log"
+	"math"
+)
+
+// Number of taps per output sample used when filtertaps is not given. More taps give a sharper cutoff.
+const defaultTapsPerDecimation = 8
+
+// windowWeight returns the weight of tap n of an numTaps long window.
+func windowWeight(window string, n, numTaps int) float64 {
+	if numTaps == 1 {
+		return 1
+	}
+	phase := 2 * math.Pi * float64(n) / float64(numTaps-1)
+	switch window {
+	case "rectangular":
+		return 1
+	case "hann":
+		return 0.5 - 0.5*math.Cos(phase)
+	case "blackman":
+		return 0.42 - 0.5*math.Cos(phase) + 0.08*math.Cos(2*phase)
+	default: // hamming
+		return 0.54 - 0.46*math.Cos(phase)
+	}
+}
+
+// designLowPass returns the taps of a windowed sinc low-pass filter with the cutoff at the Nyquist rate after decimating by decimation.
+// The taps are scaled to a gain of one at DC.
+func designLowPass(numTaps, decimation int, window string) []float64 {
+	return designLowPassCutoff(numTaps, 0.5/float64(decimation), window)
+}
+
+// designLowPassCutoff returns the taps of a windowed sinc low-pass filter with its cutoff in cycles per input sample.
+// The taps are scaled to a gain of one at DC.
+func designLowPassCutoff(numTaps int, cutoff float64, window string) []float64 {
+	taps := make([]float64, numTaps)
+	center := float64(numTaps-1) / 2
+	var sum float64
+	for n := range taps {
+		t := float64(n) - center
+		sinc := 2 * cutoff
+		if t != 0 {
+			sinc = math.Sin(2*math.Pi*cutoff*t) / (math.Pi * t)
+		}
+		taps[n] = sinc * windowWeight(window, n, numTaps)
+		sum += taps[n]
+	}
+	for n := range taps {
+		taps[n] /= sum
+	}
+	return taps
+}
+
+// firDecimate low-pass filters datain and keeps every decimation'th sample. Only the kept outputs are computed, which is the
+// polyphase form of the filter, so the work is numTaps multiplies per output sample no matter how long the input is.
+// The filter is centred on each kept sample and the edges of the input are repeated so the ends of the line do not droop.
+func firDecimate(datain []float64, decimation int, taps []float64) []float64 {
+	numOut := (len(datain) + decimation - 1) / decimation
+	outData := make([]float64, numOut)
+	center := (len(taps) - 1) / 2
+	last := len(datain) - 1
+	for m := range outData {
+		var value float64
+		first := m*decimation - center
+		for k := range taps {
+			i := first + k
+			if i < 0 {
+				i = 0
+			} else if i > last {
+				i = last
+			}
+			value += taps[k] * datain[i]
+		}
+		outData[m] = value
+	}
+	return outData
+}
+
+// filterLine applies the filter of the request to a line that will be shown across Outxsize pixels. Lines that
+// fit in the output without thinning are returned unchanged.
+func filterLine(realData []float64, dataRequest rdsRequest) []float64 {
+	if dataRequest.Filter != "fir" {
+		return realData
+	}
+	decimation := len(realData) / dataRequest.Outxsize
+	if decimation < 2 {
+		return realData
+	}
+	numTaps := dataRequest.FilterTaps
+	if numTaps < 1 {
+		numTaps = defaultTapsPerDecimation*decimation + 1
+	}
+	log.Println("Filtering line of", len(realData), "with", numTaps, "tap", dataRequest.FilterWindow, "low-pass and decimating by", decimation)
+	return firDecimate(realData, decimation, designLowPass(numTaps, decimation, dataRequest.FilterWindow))
+}
+
+// Most taps a requested filter may have, and most used by the filters designed from a cutoff.
+const maxFilterTaps = 4097
+
+// lowPassTaps returns the number of taps used for a low-pass filter with cutoff in cycles per input sample, unless requested gives one.
+func lowPassTaps(cutoff float64, requested int) int {
+	if requested > 0 {
+		return requested
+	}
+	return int(math.Min(float64(defaultTapsPerDecimation*int(math.Ceil(0.5/cutoff))+1), maxFilterTaps))
+}
+
+// filteredAt returns the output of the filter centred on element i of data. The edges of data are repeated as in firDecimate.
+func filteredAt(data []float64, i int, taps []float64) float64 {
+	if taps == nil {
+		return data[int(math.Max(0, math.Min(float64(i), float64(len(data)-1))))]
+	}
+	var value float64
+	first := i - (len(taps)-1)/2
+	last := len(data) - 1
+	for k := range taps {
+		j := first + k
+		if j < 0 {
+			j = 0
+		} else if j > last {
+			j = last
+		}
+		value += taps[k] * data[j]
+	}
+	return value
+}
+
+// resampleSelection returns count samples of the selection of a single row request resampled to outRate samples per second, starting at
+// output sample first. Output samples are linearly interpolated from the input, which is low-pass filtered at the output Nyquist rate when
+// the rate is reduced. The input is read in blocks of about maxSegmentElements so memory use does not grow with the selection.
+func resampleSelection(request rdsRequest, outRate float64, first, count int) []float64 {
+	inRate := 1.0
+	if request.Filexdelta > 0 {
+		inRate = 1 / request.Filexdelta
+	}
+	ratio := inRate / outRate // Input samples per output sample
+	var taps []float64
+	if ratio > 1 {
+		taps = designLowPassCutoff(lowPassTaps(0.5/ratio, 0), 0.5/ratio, request.FilterWindow)
+	}
+	pad := len(taps)/2 + 1
+	blockOutputs := int(math.Max(1, math.Floor(maxSegmentElements/ratio)))
+	selectionEnd := request.Xstart + request.Xsize
+
+	outData := make([]float64, 0, count)
+	for blockStart := first; blockStart < first+count; blockStart += blockOutputs {
+		blockCount := int(math.Min(float64(blockOutputs), float64(first+count-blockStart)))
+		firstPosition := float64(request.Xstart) + float64(blockStart)*ratio
+		lastPosition := firstPosition + float64(blockCount-1)*ratio
+		low := int(math.Max(float64(int(firstPosition)-pad), float64(request.Xstart)))
+		high := int(math.Min(float64(int(lastPosition)+2+pad), float64(selectionEnd)))
+		data := getLineData(request, 0, low, high-low)
+		for k := 0; k < blockCount; k++ {
+			position := firstPosition + float64(k)*ratio - float64(low)
+			i := int(position)
+			fraction := position - float64(i)
+			value := filteredAt(data, i, taps)
+			if fraction > 0 {
+				value += (filteredAt(data, i+1, taps) - value) * fraction
+			}
+			outData = append(outData, value)
+		}
+	}
+	return outData
+}
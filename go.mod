@@ -7,6 +7,5 @@ require (
 	github.com/ghodss/yaml v1.0.0 // indirect
 	github.com/minio/minio-go/v6 v6.0.47
 	github.com/tkanos/gonfig v0.0.0-20181112185242-896f3d81fadf
-	gonum.org/v1/gonum v0.6.2
 	gopkg.in/yaml.v2 v2.2.8 // indirect
 )
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type histogramResult struct {
+	Bins      int       `json:"bins"`
+	LogBins   bool      `json:"logbins"`
+	Zmin      float64   `json:"zmin"`
+	Zmax      float64   `json:"zmax"`
+	Edges     []float64 `json:"edges"`
+	Counts    []int64   `json:"counts"`
+	Underflow int64     `json:"underflow"`
+	Overflow  int64     `json:"overflow"`
+	NaNCount  int64     `json:"nancount"`
+	Total     int64     `json:"total"`
+}
+
+// Most bins a histogram may have. Each scan worker keeps its own count of every bin.
+const maxHistogramBins = 1 << 16
+
+// Largest count each integer outfmt of a histogram can hold. Larger counts are refused rather than wrapped.
+var histogramCountLimits = map[string]int64{"SB": math.MaxInt8, "SI": math.MaxInt16, "SL": math.MaxInt32}
+
+// findRegionMinMax returns the smallest and largest finite values in the selection of the request. Rows covered by blocks of the
+// range index of the file are taken from the index rather than read.
+func findRegionMinMax(dataRequest rdsRequest) (float64, float64) {
+	min, max, segments := indexedRegionSegments(dataRequest)
+	mins := make([]float64, scanWorkers)
+	maxs := make([]float64, scanWorkers)
+	for i := range mins {
+		mins[i] = math.Inf(1)
+		maxs[i] = math.Inf(-1)
+	}
+	scanSegments(dataRequest, segments, func(worker int, segment lineSegment, data []float64) {
+		for _, value := range data {
+			if math.IsNaN(value) || math.IsInf(value, 0) {
+				continue
+			}
+			mins[worker] = math.Min(mins[worker], value)
+			maxs[worker] = math.Max(maxs[worker], value)
+		}
+	})
+	for i := range mins {
+		min = math.Min(min, mins[i])
+		max = math.Max(max, maxs[i])
+	}
+	return min, max
+}
+
+// histogramEdges returns the numBins+1 bin edges from zmin to zmax, spaced evenly or evenly in log10 when logBins is set.
+func histogramEdges(zmin, zmax float64, numBins int, logBins bool) []float64 {
+	edges := make([]float64, numBins+1)
+	for i := range edges {
+		fraction := float64(i) / float64(numBins)
+		if logBins {
+			edges[i] = math.Pow(10, math.Log10(zmin)+fraction*(math.Log10(zmax)-math.Log10(zmin)))
+		} else {
+			edges[i] = zmin + fraction*(zmax-zmin)
+		}
+	}
+	return edges
+}
+
+// computeHistogram counts the values of the selection of the request into numBins bins between Zmin and Zmax.
+// Values below Zmin or above Zmax are counted as underflow or overflow and NaNs are counted separately.
+func computeHistogram(dataRequest rdsRequest, numBins int, logBins bool) histogramResult {
+	return computeSegmentsHistogram(dataRequest, regionSegments(dataRequest), numBins, logBins)
+}
+
+// computeSegmentsHistogram counts the values of the given segments of the file into numBins bins between Zmin and Zmax.
+func computeSegmentsHistogram(dataRequest rdsRequest, segments []lineSegment, numBins int, logBins bool) histogramResult {
+	var result histogramResult
+	result.Bins = numBins
+	result.LogBins = logBins
+	result.Zmin = dataRequest.Zmin
+	result.Zmax = dataRequest.Zmax
+	result.Edges = histogramEdges(result.Zmin, result.Zmax, numBins, logBins)
+
+	lo := result.Zmin
+	hi := result.Zmax
+	if logBins {
+		lo = math.Log10(lo)
+		hi = math.Log10(hi)
+	}
+	binWidth := (hi - lo) / float64(numBins)
+
+	counts := make([][]int64, scanWorkers)
+	under := make([]int64, scanWorkers)
+	over := make([]int64, scanWorkers)
+	nans := make([]int64, scanWorkers)
+	for i := range counts {
+		counts[i] = make([]int64, numBins)
+	}
+	scanSegments(dataRequest, segments, func(worker int, segment lineSegment, data []float64) {
+		for _, value := range data {
+			if math.IsNaN(value) {
+				nans[worker]++
+				continue
+			}
+			if value < result.Zmin {
+				under[worker]++
+				continue
+			}
+			if value > result.Zmax {
+				over[worker]++
+				continue
+			}
+			if logBins {
+				value = math.Log10(value)
+			}
+			bin := int((value - lo) / binWidth)
+			if bin >= numBins { // The top edge is included in the last bin
+				bin = numBins - 1
+			}
+			counts[worker][bin]++
+		}
+	})
+
+	result.Counts = make([]int64, numBins)
+	for i := range counts {
+		for bin := range counts[i] {
+			result.Counts[bin] += counts[i][bin]
+		}
+		result.Underflow += under[i]
+		result.Overflow += over[i]
+		result.NaNCount += nans[i]
+	}
+	for _, segment := range segments {
+		result.Total += int64(segment.Xsize)
+	}
+	return result
+}
+
+type histogramServer struct{}
+
+func (s *histogramServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var histRequest rdsRequest
+	var ok bool
+
+	//url - /sds/hist/<LocationName>/path/to/filename?bins=&logbins=&zmin=&zmax=&x1=&y1=&x2=&y2=
+	histRequest.getQueryParams(r)
+	numBins, ok := getURLQueryParamInt(r, "bins")
+	if !ok {
+		numBins = 100
+	}
+	if numBins < 1 || numBins > maxHistogramBins {
+		log.Println("bins must be from 1 to", maxHistogramBins, "got:", numBins)
+		w.WriteHeader(400)
+		return
+	}
+	logBinsParam, _ := getURLQueryParamString(r, "logbins")
+	logBins := logBinsParam == "true"
+
+	outputFmt, ok := getURLQueryParamString(r, "outfmt")
+	if !ok {
+		outputFmt = "json"
+	}
+	if outputFmt != "json" && outputFmt != "SB" && outputFmt != "SI" && outputFmt != "SL" && outputFmt != "SF" && outputFmt != "SD" {
+		log.Println("Histogram outfmt must be json, SB, SI, SL, SF or SD. got:", outputFmt)
+		w.WriteHeader(400)
+		return
+	}
+
+	start := time.Now()
+	cacheFileName := urlToCacheFileName(r.URL.Path, r.URL.RawQuery)
+	var histJSON []byte
+	var inCache bool
+	if *useCache {
+		histJSON, inCache = getDataFromCache(cacheFileName, "outputFiles/")
+	}
+
+	if !inCache {
+		log.Println("Histogram Request not in Cache, computing result")
+		if !histRequest.openRegionFile(r.URL.Path, 3) {
+			w.WriteHeader(400)
+			return
+		}
+		if !histRequest.getRegionQueryParams(r) {
+			w.WriteHeader(400)
+			return
+		}
+
+		//If Zmin and Zmax were not explitily given then use the range of the selection
+		if !histRequest.Zset {
+			histRequest.Zmin, histRequest.Zmax = findRegionMinMax(histRequest)
+			if math.IsInf(histRequest.Zmin, 0) { // No finite values in the selection
+				histRequest.Zmin, histRequest.Zmax = 0, 0
+			}
+			if logBins && histRequest.Zmin <= 0 {
+				histRequest.Zmin = math.Min(1e-20, histRequest.Zmax)
+			}
+		}
+		if histRequest.Zmax < histRequest.Zmin {
+			log.Println("Invalid Request. zmax is less than zmin", histRequest.Zmin, histRequest.Zmax)
+			w.WriteHeader(400)
+			return
+		}
+		if histRequest.Zmax == histRequest.Zmin { // All values are the same so give the bins some width around them
+			histRequest.Zmin -= 0.5
+			histRequest.Zmax += 0.5
+		}
+		if logBins && histRequest.Zmin <= 0 {
+			log.Println("Invalid Request. Log bins need zmin greater than zero. got:", histRequest.Zmin)
+			w.WriteHeader(400)
+			return
+		}
+
+		result := computeHistogram(histRequest, numBins, logBins)
+		var marshalError error
+		histJSON, marshalError = json.Marshal(result)
+		if marshalError != nil {
+			log.Println("Error Encoding histogram", marshalError)
+			w.WriteHeader(500)
+			return
+		}
+		if *useCache {
+			go putItemInCache(cacheFileName, "outputFiles/", histJSON)
+		}
+	}
+	elapsed := time.Since(start)
+	log.Println("Histogram processed in: ", elapsed)
+
+	var result histogramResult
+	marshalError := json.Unmarshal(histJSON, &result)
+	if marshalError != nil {
+		log.Println("Error Decoding histogram from cache", marshalError)
+		w.WriteHeader(500)
+		return
+	}
+
+	w.Header().Add("Access-Control-Allow-Origin", "*")
+	w.Header().Add("Access-Control-Expose-Headers", "bins,logbins,zmin,zmax,underflow,overflow,nancount,total")
+	w.Header().Add("bins", strconv.Itoa(result.Bins))
+	w.Header().Add("logbins", strconv.FormatBool(result.LogBins))
+	w.Header().Add("zmin", fmt.Sprintf("%f", result.Zmin))
+	w.Header().Add("zmax", fmt.Sprintf("%f", result.Zmax))
+	w.Header().Add("underflow", strconv.FormatInt(result.Underflow, 10))
+	w.Header().Add("overflow", strconv.FormatInt(result.Overflow, 10))
+	w.Header().Add("nancount", strconv.FormatInt(result.NaNCount, 10))
+	w.Header().Add("total", strconv.FormatInt(result.Total, 10))
+	if outputFmt == "json" {
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(histJSON)
+		return
+	}
+
+	counts := make([]float64, len(result.Counts))
+	for i := range counts {
+		if limit, ok := histogramCountLimits[outputFmt]; ok && result.Counts[i] > limit {
+			log.Println("Histogram count", result.Counts[i], "does not fit in outfmt", outputFmt)
+			w.WriteHeader(400)
+			return
+		}
+		counts[i] = float64(result.Counts[i])
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(createOutput(counts, outputFmt, 0, 0, ""))
+}
@@ -0,0 +1,85 @@
+package main
+
+import "math"
+
+// interpolationTaps returns the input indices and weights used to estimate a value at the fractional
+// position pos within a sequence of n samples. Indices are clamped so the edges repeat the first and last samples.
+func interpolationTaps(pos float64, n int, interp string) ([]int, []float64) {
+	base := int(math.Floor(pos))
+	t := pos - float64(base)
+
+	var offsets []int
+	var weights []float64
+	switch interp {
+	case "linear", "bilinear":
+		offsets = []int{0, 1}
+		weights = []float64{1 - t, t}
+	case "cubic":
+		// Catmull-Rom spline through the two samples on either side of pos
+		t2 := t * t
+		t3 := t2 * t
+		offsets = []int{-1, 0, 1, 2}
+		weights = []float64{
+			(-t3 + 2*t2 - t) / 2,
+			(3*t3 - 5*t2 + 2) / 2,
+			(-3*t3 + 4*t2 + t) / 2,
+			(t3 - t2) / 2,
+		}
+	default: // nearest, getQueryParams has already replaced unknown values with it
+		offsets = []int{int(math.Round(t))}
+		weights = []float64{1}
+	}
+
+	indices := make([]int, len(offsets))
+	for i := range offsets {
+		indices[i] = int(math.Min(math.Max(float64(base+offsets[i]), 0), float64(n-1)))
+	}
+	return indices, weights
+}
+
+func interpolateAt(datain []float64, pos float64, interp string) float64 {
+	indices, weights := interpolationTaps(pos, len(datain), interp)
+	var value float64
+	for i := range indices {
+		value += datain[indices[i]] * weights[i]
+	}
+	return value
+}
+
+// expandLine resamples datain onto outsize points where output point x sits at input position x*elementsPerOutput.
+func expandLine(datain []float64, elementsPerOutput float64, outsize int, interp string) []float64 {
+	outData := make([]float64, outsize)
+	for x := 0; x < outsize; x++ {
+		outData[x] = interpolateAt(datain, float64(x)*elementsPerOutput, interp)
+	}
+	return outData
+}
+
+// interpolateLinesInY combines lines of x thinned data that have been read for each y tap into a single output line.
+func interpolateLinesInY(datain []float64, outxsize int, weights []float64) []float64 {
+	outData := make([]float64, outxsize)
+	for x := 0; x < outxsize; x++ {
+		for y := range weights {
+			outData[x] += datain[y*outxsize+x] * weights[y]
+		}
+	}
+	return outData
+}
+
+// interpolateRequestLine produces one output line for y expansion by thinning in x each input line
+// needed by the interpolation kernel at position pos (relative to Ystart) and combining them.
+func interpolateRequestLine(dataRequest rdsRequest, pos float64) []float64 {
+	yTaps, yWeights := interpolationTaps(pos, dataRequest.Ysize, dataRequest.Interp)
+	xThinData := make([]float64, len(yTaps)*dataRequest.Outxsize)
+
+	done := make(chan bool, 1)
+	for i := range yTaps {
+		lineRequest := dataRequest
+		lineRequest.Ystart = dataRequest.Ystart + yTaps[i]
+		go processline(xThinData, i, done, lineRequest)
+	}
+	for i := 0; i < len(yTaps); i++ {
+		<-done
+	}
+	return interpolateLinesInY(xThinData, dataRequest.Outxsize, yWeights)
+}
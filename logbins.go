@@ -0,0 +1,68 @@
+package main
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// setLogBinEdges sets the edges of Outxsize bins spaced logarithmically in the abscissa of the file across the x selection of the request.
+// The bins start at the first element of the selection with a positive abscissa, as a log axis cannot reach zero.
+// It returns false when no element of the selection has a positive abscissa.
+func (request *rdsRequest) setLogBinEdges() bool {
+	if !(request.Filexdelta > 0) {
+		log.Println("xscale=log needs an increasing x axis. xdelta:", request.Filexdelta)
+		return false
+	}
+	low := request.Filexstart + request.Filexdelta*float64(request.Xstart)
+	high := request.Filexstart + request.Filexdelta*float64(request.Xstart+request.Xsize)
+	if low <= 0 {
+		low = request.Filexstart + request.Filexdelta*(math.Floor(-request.Filexstart/request.Filexdelta)+1)
+	}
+	if low >= high {
+		log.Println("xscale=log needs a positive x value in the selection. x range:", request.Filexstart+request.Filexdelta*float64(request.Xstart), high)
+		return false
+	}
+	request.XBinEdges = make([]float64, request.Outxsize+1)
+	for k := range request.XBinEdges {
+		request.XBinEdges[k] = low * math.Pow(high/low, float64(k)/float64(request.Outxsize))
+	}
+	request.XBinEdges[request.Outxsize] = high
+	return true
+}
+
+// logBinLine reduces a line to one value per bin with the transform. Element i of the line is at abscissa x0+i*dx and each bin
+// uses the elements from its lower edge up to its upper edge. Bins narrower than the spacing of the line that hold no element use
+// the element nearest their geometric middle, so the low end of the axis repeats values rather than leaving gaps.
+func logBinLine(datain []float64, x0, dx float64, edges []float64, transform string) []float64 {
+	// index of the first element at or above the abscissa x, allowing for rounding in the edges
+	firstAtOrAbove := func(x float64) int {
+		index := int(math.Ceil((x-x0)/dx - 1e-9))
+		return int(math.Max(0, math.Min(float64(index), float64(len(datain)))))
+	}
+	outData := make([]float64, len(edges)-1)
+	for k := range outData {
+		start := firstAtOrAbove(edges[k])
+		end := firstAtOrAbove(edges[k+1])
+		if k == len(outData)-1 {
+			end = len(datain)
+		}
+		if end > start {
+			outData[k] = doTransform(datain[start:end], transform)
+			continue
+		}
+		middle := math.Sqrt(edges[k] * edges[k+1])
+		nearest := int(math.Round((middle - x0) / dx))
+		outData[k] = datain[int(math.Max(0, math.Min(float64(nearest), float64(len(datain)-1))))]
+	}
+	return outData
+}
+
+// addLogBinHeaders gives the range of log x bins in the xbinlow and xbinhigh headers. Edge k of the n bins is
+// xbinlow*(xbinhigh/xbinlow)^(k/n), so the range is all a client needs to place them.
+func addLogBinHeaders(header http.Header, edges []float64) {
+	header.Add("xscale", "log")
+	header.Add("xbinlow", strconv.FormatFloat(edges[0], 'g', -1, 64))
+	header.Add("xbinhigh", strconv.FormatFloat(edges[len(edges)-1], 'g', -1, 64))
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"image"
+	"image/png"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Colour of the elements of a binary mask that are set when maskcolor is not given, as red, green, blue and alpha.
+var defaultMaskColor = [4]byte{255, 0, 0, 255}
+
+type maskSpec struct {
+	Kind       string // above, below, band or classes
+	Thresholds []float64
+}
+
+// parseMask reads a mask option. The forms are above:<t>, below:<t>, band:<low>:<high> and classes:<t1>:<t2>:... with increasing thresholds.
+func parseMask(param string) (maskSpec, bool) {
+	fields := strings.Split(param, ":")
+	spec := maskSpec{Kind: fields[0]}
+	for _, field := range fields[1:] {
+		threshold, err := strconv.ParseFloat(field, 64)
+		if err != nil {
+			return maskSpec{}, false
+		}
+		spec.Thresholds = append(spec.Thresholds, threshold)
+	}
+	switch spec.Kind {
+	case "above", "below":
+		return spec, len(spec.Thresholds) == 1
+	case "band":
+		return spec, len(spec.Thresholds) == 2 && spec.Thresholds[0] <= spec.Thresholds[1]
+	case "classes":
+		for i := 1; i < len(spec.Thresholds); i++ {
+			if spec.Thresholds[i] <= spec.Thresholds[i-1] {
+				return maskSpec{}, false
+			}
+		}
+		return spec, len(spec.Thresholds) > 0
+	}
+	return maskSpec{}, false
+}
+
+// numClasses is the number of classes the mask sorts values into, including class 0 for values that are not set.
+func (spec maskSpec) numClasses() int {
+	if spec.Kind == "classes" {
+		return len(spec.Thresholds) + 1
+	}
+	return 2
+}
+
+// classify returns the class of a value. Binary masks give 1 where the value is above, below or within the band, and 0 elsewhere.
+// Class masks give the number of thresholds the value is at or above. NaN is always 0.
+func (spec maskSpec) classify(value float64) int {
+	if math.IsNaN(value) {
+		return 0
+	}
+	switch spec.Kind {
+	case "above":
+		if value > spec.Thresholds[0] {
+			return 1
+		}
+	case "below":
+		if value < spec.Thresholds[0] {
+			return 1
+		}
+	case "band":
+		if value >= spec.Thresholds[0] && value <= spec.Thresholds[1] {
+			return 1
+		}
+	case "classes":
+		class := 0
+		for class < len(spec.Thresholds) && value >= spec.Thresholds[class] {
+			class++
+		}
+		return class
+	}
+	return 0
+}
+
+// parseMaskColor reads a colour given as RRGGBB or RRGGBBAA hex digits.
+func parseMaskColor(param string) ([4]byte, bool) {
+	color := [4]byte{0, 0, 0, 255}
+	digits, err := hex.DecodeString(strings.TrimPrefix(param, "#"))
+	if err != nil || (len(digits) != 3 && len(digits) != 4) {
+		return color, false
+	}
+	copy(color[:], digits)
+	return color, true
+}
+
+// maskPalette returns the colour of each class of a mask. Class 0 is transparent. Binary masks use the mask colour and
+// class masks spread their classes over the colormap.
+func maskPalette(spec maskSpec, maskColor [4]byte, colorMap string) [][4]byte {
+	palette := make([][4]byte, spec.numClasses())
+	if spec.Kind != "classes" {
+		palette[1] = maskColor
+		return palette
+	}
+	numColors := 1000
+	colors := makeColorPalette(getColorConrolPoints(colorMap), numColors)
+	for class := 1; class < len(palette); class++ {
+		index := 0
+		if len(palette) > 2 {
+			index = (class - 1) * (numColors - 1) / (len(palette) - 2)
+		}
+		palette[class] = [4]byte{byte(colors[index].red), byte(colors[index].green), byte(colors[index].blue), 255}
+	}
+	return palette
+}
+
+// createMaskOutput turns thinned data into the mask of the request. SP output packs one bit per element that is set, RGBA and PNG give
+// the colour of each class with transparent elements where nothing is set, and the other formats give the class numbers.
+func createMaskOutput(dataIn []float64, dataRequest rdsRequest) []byte {
+	spec, _ := parseMask(dataRequest.Mask)
+	classes := make([]float64, len(dataIn))
+	for i := range dataIn {
+		classes[i] = float64(spec.classify(dataIn[i]))
+	}
+	if dataRequest.OutputFmt != "RGBA" && dataRequest.OutputFmt != "PNG" {
+		return createOutput(classes, dataRequest.OutputFmt, 0, 0, "")
+	}
+
+	palette := maskPalette(spec, dataRequest.MaskColor, dataRequest.ColorMap)
+	dataOut := make([]byte, 0, len(classes)*4)
+	for i := range classes {
+		dataOut = append(dataOut, palette[int(classes[i])][:]...)
+	}
+	if dataRequest.OutputFmt == "PNG" {
+		return encodePNG(dataOut, dataRequest.Outxsize, dataRequest.Outysize)
+	}
+	return dataOut
+}
+
+// encodePNG encodes RGBA pixels of an image that is width by height as a PNG.
+func encodePNG(rgba []byte, width, height int) []byte {
+	img := &image.NRGBA{Pix: rgba, Stride: width * 4, Rect: image.Rect(0, 0, width, height)}
+	var dataOut bytes.Buffer
+	err := png.Encode(&dataOut, img)
+	if err != nil {
+		log.Println("Error encoding PNG", err)
+	}
+	return dataOut.Bytes()
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"container/heap"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Most candidate peaks kept while scanning. When a selection has more local maxima above the threshold, only the highest are kept.
+const maxPeakCandidates = 1 << 20
+
+type peak struct {
+	X      int     `json:"x"`
+	Y      int     `json:"y"`
+	XValue float64 `json:"xvalue"`
+	YValue float64 `json:"yvalue"`
+	Value  float64 `json:"value"`
+}
+
+type peaksResult struct {
+	ThresholdMode string  `json:"thresholdmode"`
+	Threshold     float64 `json:"threshold"`
+	Floor         float64 `json:"floor"`
+	Level         float64 `json:"level"` // The value peaks must be above
+	Separation    int     `json:"separation"`
+	Top           int     `json:"top"`
+	Candidates    int64   `json:"candidates"`
+	Truncated     bool    `json:"truncated"`
+	Peaks         []peak  `json:"peaks"`
+}
+
+// peakHeap is a min-heap of peaks by value, so the lowest of the kept candidates can be dropped when a higher one is found.
+type peakHeap []peak
+
+func (h peakHeap) Len() int            { return len(h) }
+func (h peakHeap) Less(i, j int) bool  { return h[i].Value < h[j].Value }
+func (h peakHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *peakHeap) Push(x interface{}) { *h = append(*h, x.(peak)) }
+func (h *peakHeap) Pop() interface{} {
+	old := *h
+	last := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return last
+}
+
+// peakSegments returns the segments of the selection with one extra element on each side, where the selection allows, so that every
+// element inside a segment can be compared with both of its neighbours. The insides of the segments cover the selection apart from its first
+// and last column without overlapping.
+func peakSegments(request rdsRequest) []lineSegment {
+	segments := regionSegments(request)
+	for i, segment := range segments {
+		start := int(math.Max(float64(segment.Xstart-1), float64(request.Xstart)))
+		end := int(math.Min(float64(segment.Xstart+segment.Xsize+1), float64(request.Xstart+request.Xsize)))
+		segments[i] = lineSegment{segment.Row, start, end - start}
+	}
+	return segments
+}
+
+// plateauNextValue returns the first value of row from column x on that differs from value, and false when the selection ends first.
+func plateauNextValue(request rdsRequest, row, x int, value float64) (float64, bool) {
+	end := request.Xstart + request.Xsize
+	for x < end {
+		size := int(math.Min(float64(maxSegmentElements), float64(end-x)))
+		for _, next := range getLineData(request, row, x, size) {
+			if next != value {
+				return next, true
+			}
+		}
+		x += size
+	}
+	return 0, false
+}
+
+// findPeakCandidates returns the local maxima along the rows of the selection that are above level. An element is a local maximum when it is
+// greater than the element before it and the next different element is lower. Only the first element of a flat top is used. Flat tops
+// that run past the end of a segment are followed along the row, and those that run to the end of the selection are not counted.
+// Infinite values are never peaks, as they cannot be returned in JSON.
+// It also returns the number of local maxima found and whether some of them were dropped to stay within maxPeakCandidates.
+func findPeakCandidates(request rdsRequest, level float64) ([]peak, int64, bool) {
+	heaps := make([]peakHeap, scanWorkers)
+	counts := make([]int64, scanWorkers)
+	perWorker := maxPeakCandidates / scanWorkers
+	scanSegments(request, peakSegments(request), func(worker int, segment lineSegment, data []float64) {
+		for i := 1; i < len(data)-1; i++ {
+			if !(data[i] > level && data[i] > data[i-1]) || math.IsInf(data[i], 0) {
+				continue
+			}
+			top := i
+			for top+1 < len(data) && data[top+1] == data[i] {
+				top++
+			}
+			var next float64
+			found := top+1 < len(data)
+			if found {
+				next = data[top+1]
+			} else { // The flat top runs past the segment
+				next, found = plateauNextValue(request, segment.Row, segment.Xstart+len(data), data[i])
+			}
+			if !found || next > data[i] { // A step up, or a flat top that runs to the end of the selection
+				i = top
+				continue
+			}
+			counts[worker]++
+			candidate := peak{X: segment.Xstart + i, Y: segment.Row, Value: data[i]}
+			if heaps[worker].Len() < perWorker {
+				heap.Push(&heaps[worker], candidate)
+			} else if candidate.Value > heaps[worker][0].Value {
+				heaps[worker][0] = candidate
+				heap.Fix(&heaps[worker], 0)
+			}
+		}
+	})
+
+	var candidates []peak
+	var total int64
+	for worker := range heaps {
+		candidates = append(candidates, heaps[worker]...)
+		total += counts[worker]
+	}
+	return candidates, total, total > int64(len(candidates))
+}
+
+// selectPeaks picks peaks from the candidates from the highest down, skipping any candidate that is within separation columns of a higher peak
+// on the same row. It stops after top peaks when top is greater than zero.
+func selectPeaks(candidates []peak, separation, top int) []peak {
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].Value != candidates[j].Value {
+			return candidates[i].Value > candidates[j].Value
+		}
+		if candidates[i].Y != candidates[j].Y {
+			return candidates[i].Y < candidates[j].Y
+		}
+		return candidates[i].X < candidates[j].X
+	})
+	peaks := make([]peak, 0)
+	acceptedColumns := make(map[int][]int) // Sorted columns of the peaks kept on each row
+	for _, candidate := range candidates {
+		if top > 0 && len(peaks) >= top {
+			break
+		}
+		columns := acceptedColumns[candidate.Y]
+		i := sort.SearchInts(columns, candidate.X)
+		if (i < len(columns) && columns[i]-candidate.X < separation) || (i > 0 && candidate.X-columns[i-1] < separation) {
+			continue
+		}
+		columns = append(columns, 0)
+		copy(columns[i+1:], columns[i:])
+		columns[i] = candidate.X
+		acceptedColumns[candidate.Y] = columns
+		peaks = append(peaks, candidate)
+	}
+	return peaks
+}
+
+// selectionFloor estimates the noise floor of the selection as the median of its values.
+func selectionFloor(request rdsRequest) float64 {
+	histRequest := request
+	histRequest.Zmin, histRequest.Zmax = findRegionMinMax(request)
+	if math.IsInf(histRequest.Zmin, 0) { // No finite values in the selection
+		return 0
+	}
+	if histRequest.Zmax == histRequest.Zmin {
+		return histRequest.Zmin
+	}
+	return histogramPercentile(computeHistogram(histRequest, autoscaleBins, false), 50)
+}
+
+type peaksServer struct{}
+
+func (s *peaksServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var peaksRequest rdsRequest
+	var result peaksResult
+	var ok bool
+
+	//url - /sds/peaks/<LocationName>/path/to/filename?threshold=&thresholdmode=&separation=&top=&x1=&y1=&x2=&y2=
+	peaksRequest.getQueryParams(r)
+	result.ThresholdMode, ok = getURLQueryParamString(r, "thresholdmode")
+	if !ok {
+		result.ThresholdMode = "absolute"
+	}
+	if result.ThresholdMode != "absolute" && result.ThresholdMode != "floor" {
+		log.Println("thresholdmode must be absolute or floor. got:", result.ThresholdMode)
+		w.WriteHeader(400)
+		return
+	}
+	var thresholdSet bool
+	result.Threshold, thresholdSet = getURLQueryParamFloat(r, "threshold")
+	if !thresholdSet {
+		result.Threshold = 0
+	}
+	if math.IsInf(result.Threshold, 0) || math.IsNaN(result.Threshold) {
+		log.Println("threshold must be a finite number. got:", result.Threshold)
+		w.WriteHeader(400)
+		return
+	}
+	result.Separation, ok = getURLQueryParamInt(r, "separation")
+	if !ok {
+		result.Separation = 1
+	}
+	if result.Separation < 1 {
+		log.Println("separation must be at least 1. got:", result.Separation)
+		w.WriteHeader(400)
+		return
+	}
+	result.Top, ok = getURLQueryParamInt(r, "top")
+	if !ok {
+		result.Top = 100
+	}
+	if result.Top < 0 {
+		log.Println("top must not be negative. got:", result.Top)
+		w.WriteHeader(400)
+		return
+	}
+
+	start := time.Now()
+	cacheFileName := urlToCacheFileName(r.URL.Path, r.URL.RawQuery)
+	var peaksJSON []byte
+	var inCache bool
+	if *useCache {
+		peaksJSON, inCache = getDataFromCache(cacheFileName, "outputFiles/")
+	}
+
+	if !inCache {
+		log.Println("Peaks Request not in Cache, computing result")
+		if !peaksRequest.openRegionFile(r.URL.Path, 3) {
+			w.WriteHeader(400)
+			return
+		}
+		if !peaksRequest.getRegionQueryParams(r) {
+			w.WriteHeader(400)
+			return
+		}
+
+		switch {
+		case result.ThresholdMode == "floor":
+			result.Floor = selectionFloor(peaksRequest)
+			result.Level = result.Floor + result.Threshold
+		case thresholdSet:
+			result.Level = result.Threshold
+		default:
+			result.Level = math.Inf(-1)
+		}
+		var candidates []peak
+		candidates, result.Candidates, result.Truncated = findPeakCandidates(peaksRequest, result.Level)
+		if result.Truncated {
+			log.Println("Found", result.Candidates, "candidate peaks, keeping the highest", len(candidates))
+		}
+		result.Peaks = selectPeaks(candidates, result.Separation, result.Top)
+		for i := range result.Peaks {
+			result.Peaks[i].XValue = peaksRequest.Filexstart + peaksRequest.Filexdelta*float64(result.Peaks[i].X)
+			result.Peaks[i].YValue = peaksRequest.Fileystart + peaksRequest.Fileydelta*float64(result.Peaks[i].Y)
+		}
+		if math.IsInf(result.Level, -1) { // JSON has no infinity
+			result.Level = -math.MaxFloat64
+		}
+
+		var marshalError error
+		peaksJSON, marshalError = json.Marshal(result)
+		if marshalError != nil {
+			log.Println("Error Encoding peaks", marshalError)
+			w.WriteHeader(500)
+			return
+		}
+		if *useCache {
+			go putItemInCache(cacheFileName, "outputFiles/", peaksJSON)
+		}
+	} else {
+		marshalError := json.Unmarshal(peaksJSON, &result)
+		if marshalError != nil {
+			log.Println("Error Decoding peaks from cache", marshalError)
+			w.WriteHeader(500)
+			return
+		}
+	}
+	elapsed := time.Since(start)
+	log.Println("Found", len(result.Peaks), "peaks in: ", elapsed)
+
+	w.Header().Add("Access-Control-Allow-Origin", "*")
+	w.Header().Add("Access-Control-Expose-Headers", "numpeaks,candidates,truncated,level")
+	w.Header().Add("numpeaks", strconv.Itoa(len(result.Peaks)))
+	w.Header().Add("candidates", strconv.FormatInt(result.Candidates, 10))
+	w.Header().Add("truncated", strconv.FormatBool(result.Truncated))
+	w.Header().Add("level", fmt.Sprintf("%f", result.Level))
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(peaksJSON)
+}
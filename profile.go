@@ -0,0 +1,313 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Most samples a profile may take perpendicular to its line.
+const maxProfileWidth = 256
+
+// profileRow is the span of a row of the file that a profile samples.
+type profileRow struct {
+	xlo, xhi int
+	data     []float64
+}
+
+// sampleAt estimates the value of the file at the fractional element position (x,y) using the interp of the request, from rows
+// that have already been read.
+func sampleAt(dataRequest rdsRequest, rows map[int]*profileRow, x, y float64) float64 {
+	xTaps, xWeights := interpolationTaps(x, dataRequest.FileXSize, dataRequest.Interp)
+	yTaps, yWeights := interpolationTaps(y, dataRequest.FileYSize, dataRequest.Interp)
+	var value float64
+	for j := range yTaps {
+		row := rows[yTaps[j]]
+		for i := range xTaps {
+			value += yWeights[j] * xWeights[i] * row.data[xTaps[i]-row.xlo]
+		}
+	}
+	return value
+}
+
+// getProfileData samples the file along the straight line from (X1,Y1) to (X2,Y2) with one sample per element of arc length.
+// When Width is greater than one, samples are also taken perpendicular to the line, one element apart, and reduced with the transform.
+// The span of each row used by any sample is found first so every row is read once.
+func getProfileData(dataRequest rdsRequest) []float64 {
+	dx := float64(dataRequest.X2 - dataRequest.X1)
+	dy := float64(dataRequest.Y2 - dataRequest.Y1)
+	length := math.Hypot(dx, dy)
+	numSamples := int(math.Ceil(length)) + 1
+
+	var perpX, perpY float64
+	if length > 0 {
+		perpX = -dy / length
+		perpY = dx / length
+	}
+	// position returns where sample k across the line is taken for point i along it
+	position := func(i, k int) (float64, float64) {
+		var t float64
+		if numSamples > 1 {
+			t = float64(i) / float64(numSamples-1)
+		}
+		offset := float64(k) - float64(dataRequest.Width-1)/2
+		return float64(dataRequest.X1) + t*dx + offset*perpX, float64(dataRequest.Y1) + t*dy + offset*perpY
+	}
+
+	rows := make(map[int]*profileRow)
+	for i := 0; i < numSamples; i++ {
+		for k := 0; k < dataRequest.Width; k++ {
+			x, y := position(i, k)
+			xTaps, _ := interpolationTaps(x, dataRequest.FileXSize, dataRequest.Interp)
+			yTaps, _ := interpolationTaps(y, dataRequest.FileYSize, dataRequest.Interp)
+			// Taps are in increasing order so only the span between the first and last is needed
+			xlo, xhi := xTaps[0], xTaps[len(xTaps)-1]
+			for _, rowNum := range yTaps {
+				if row, ok := rows[rowNum]; ok {
+					row.xlo = int(math.Min(float64(row.xlo), float64(xlo)))
+					row.xhi = int(math.Max(float64(row.xhi), float64(xhi)))
+				} else {
+					rows[rowNum] = &profileRow{xlo: xlo, xhi: xhi}
+				}
+			}
+		}
+	}
+	for rowNum, row := range rows {
+		row.data = getLineData(dataRequest, rowNum, row.xlo, row.xhi-row.xlo+1)
+	}
+
+	profile := make([]float64, numSamples)
+	across := make([]float64, dataRequest.Width)
+	for i := range profile {
+		for k := range across {
+			x, y := position(i, k)
+			across[k] = sampleAt(dataRequest, rows, x, y)
+		}
+		profile[i] = doTransform(across, dataRequest.Transform)
+	}
+	return profile
+}
+
+type rdsProfileServer struct{}
+
+func (s *rdsProfileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var data []byte
+	var inCache bool
+	var ok bool
+	var rdsRequest rdsRequest
+
+	//Get URL Parameters
+	//url - /sds/rdsprofile/x1/y1/x2/y2/outxsize/outzsize
+	rdsRequest.X1, ok = getURLArgumentInt(r.URL.Path, 3)
+	if !ok || rdsRequest.X1 < 0 {
+		log.Println("X1 Missing or Bad. Required Field")
+		w.WriteHeader(400)
+		return
+	}
+	rdsRequest.Y1, ok = getURLArgumentInt(r.URL.Path, 4)
+	if !ok || rdsRequest.Y1 < 0 {
+		log.Println("Y1 Missing or Bad. Required Field")
+		w.WriteHeader(400)
+		return
+	}
+	rdsRequest.X2, ok = getURLArgumentInt(r.URL.Path, 5)
+	if !ok || rdsRequest.X2 < 0 {
+		log.Println("X2 Missing or Bad. Required Field")
+		w.WriteHeader(400)
+		return
+	}
+	rdsRequest.Y2, ok = getURLArgumentInt(r.URL.Path, 6)
+	if !ok || rdsRequest.Y2 < 0 {
+		log.Println("Y2 Missing or Bad. Required Field")
+		w.WriteHeader(400)
+		return
+	}
+	rdsRequest.Outxsize, ok = getURLArgumentInt(r.URL.Path, 7)
+	if !ok || rdsRequest.Outxsize < 1 {
+		log.Println("outxsize Missing or Bad. Required Field")
+		w.WriteHeader(400)
+		return
+	}
+	rdsRequest.Outzsize, ok = getURLArgumentInt(r.URL.Path, 8)
+	if !ok || rdsRequest.Outzsize < 1 {
+		log.Println("outzsize Missing or Bad. Required Field")
+		w.WriteHeader(400)
+		return
+	}
+	rdsRequest.getQueryParams(r)
+
+	rdsRequest.Width, ok = getURLQueryParamInt(r, "width")
+	if !ok {
+		rdsRequest.Width = 1
+	}
+	if rdsRequest.Width < 1 || rdsRequest.Width > maxProfileWidth {
+		log.Println("Profile width must be from 1 to", maxProfileWidth, "got:", rdsRequest.Width)
+		w.WriteHeader(400)
+		return
+	}
+	rdsRequest.ProfileAxis, ok = getURLQueryParamString(r, "profileaxis")
+	if !ok {
+		rdsRequest.ProfileAxis = "length"
+	}
+	if rdsRequest.ProfileAxis != "length" && rdsRequest.ProfileAxis != "x" && rdsRequest.ProfileAxis != "y" {
+		log.Println("profileaxis must be one of length, x, y. got:", rdsRequest.ProfileAxis)
+		w.WriteHeader(400)
+		return
+	}
+
+	rdsRequest.computeRequestSizes()
+
+	log.Println("RDS Profile Request params x1, y1, x2, y2, width, outxsize, outzsize:", rdsRequest.X1, rdsRequest.Y1, rdsRequest.X2, rdsRequest.Y2, rdsRequest.Width, rdsRequest.Outxsize, rdsRequest.Outzsize)
+
+	start := time.Now()
+	cacheFileName := urlToCacheFileName(r.URL.Path, r.URL.RawQuery)
+	// Check if request has been previously processed and is in cache. If not process Request.
+	if *useCache {
+		data, inCache = getDataFromCache(cacheFileName, "outputFiles/")
+	} else {
+		inCache = false
+	}
+
+	if !inCache { // If the output is not already in the cache then read the data file and do the processing.
+		log.Println("RDS Request not in Cache, computing result")
+		rdsRequest.Reader, rdsRequest.FileName, ok = openDataSource(r.URL.Path, 9)
+		rdsRequest.SourcePath = dataSourcePath(r.URL.Path, 9)
+		if !ok {
+			w.WriteHeader(400)
+			return
+		}
+
+		if strings.Contains(rdsRequest.FileName, ".tmp") || strings.Contains(rdsRequest.FileName, ".prm") {
+			rdsRequest.processBlueFileHeader()
+			if rdsRequest.SubsizeSet {
+				rdsRequest.FileXSize = rdsRequest.Subsize
+
+			} else {
+				if rdsRequest.FileType == 1000 {
+					log.Println("For type 1000 files, a subsize needs to be set")
+					w.WriteHeader(400)
+					return
+				}
+			}
+			rdsRequest.computeYSize()
+		} else {
+			log.Println("Invalid File Type")
+			w.WriteHeader(400)
+			return
+		}
+
+		// The profile end points are sample positions so they must be inside the file.
+		if rdsRequest.X1 >= rdsRequest.FileXSize || rdsRequest.X2 >= rdsRequest.FileXSize {
+			log.Println("Invalid Request. Requested X1 or X2 outside of file X size")
+			w.WriteHeader(400)
+			return
+		}
+		if rdsRequest.Y1 >= rdsRequest.FileYSize || rdsRequest.Y2 >= rdsRequest.FileYSize {
+			log.Println("Invalid Request. Requested Y1 or Y2 outside of file Y size")
+			w.WriteHeader(400)
+			return
+		}
+
+		//If Zmin and Zmax were not explitily given then compute
+		if !rdsRequest.Zset {
+			rdsRequest.findZminMax()
+		}
+
+		data = createLineOutput(getProfileData(rdsRequest), rdsRequest)
+
+		if *useCache {
+			go putItemInCache(cacheFileName, "outputFiles/", data)
+		}
+
+		// Store MetaData of request off in cache
+		var fileMData fileMetaData
+		fileMData.Outxsize = rdsRequest.Outxsize
+		fileMData.Outysize = rdsRequest.Outysize
+		fileMData.Outzsize = rdsRequest.Outzsize
+		fileMData.Filexstart = rdsRequest.Filexstart
+		fileMData.Filexdelta = rdsRequest.Filexdelta
+		fileMData.Fileystart = rdsRequest.Fileystart
+		fileMData.Fileydelta = rdsRequest.Fileydelta
+		fileMData.Xstart = rdsRequest.Xstart
+		fileMData.Ystart = rdsRequest.Ystart
+		fileMData.Xsize = rdsRequest.Xsize
+		fileMData.Ysize = rdsRequest.Ysize
+		fileMData.Zmin = rdsRequest.Zmin
+		fileMData.Zmax = rdsRequest.Zmax
+		fileMData.Autoscale = rdsRequest.Autoscale
+		fileMData.ProfileAxis = rdsRequest.ProfileAxis
+		fileMData.ProfileLength = math.Hypot(float64(rdsRequest.X2-rdsRequest.X1), float64(rdsRequest.Y2-rdsRequest.Y1))
+
+		fileMDataJSON, marshalError := json.Marshal(fileMData)
+		if marshalError != nil {
+			log.Println("Error Encoding metadata file to cache", marshalError)
+			w.WriteHeader(400)
+			return
+		}
+		putItemInCache(cacheFileName+"meta", "outputFiles/", fileMDataJSON)
+
+	}
+	elapsed := time.Since(start)
+	log.Println("Length of Output Data ", len(data), " processed in: ", elapsed)
+
+	// Get the metadata for this request to put into the return header.
+	fileMetaDataJSON, metaInCache := getDataFromCache(cacheFileName+"meta", "outputFiles/")
+	if !metaInCache {
+		log.Println("Error reading the metadata file from cache")
+		w.WriteHeader(400)
+		return
+	}
+	var fileMDataCache fileMetaData
+	marshalError := json.Unmarshal(fileMetaDataJSON, &fileMDataCache)
+	if marshalError != nil {
+		log.Println("Error Decoding metadata file from cache", marshalError)
+		w.WriteHeader(400)
+		return
+	}
+
+	// The abscissa of the profile is the arc length in elements, or the x or y coordinate of the samples in file units.
+	// x1/y1/x2/y2 give the end points of the profile in file units.
+	x1 := fileMDataCache.Filexstart + fileMDataCache.Filexdelta*float64(rdsRequest.X1)
+	x2 := fileMDataCache.Filexstart + fileMDataCache.Filexdelta*float64(rdsRequest.X2)
+	y1 := fileMDataCache.Fileystart + fileMDataCache.Fileydelta*float64(rdsRequest.Y1)
+	y2 := fileMDataCache.Fileystart + fileMDataCache.Fileydelta*float64(rdsRequest.Y2)
+	var xmin, xmax float64
+	switch fileMDataCache.ProfileAxis {
+	case "x":
+		xmin, xmax = x1, x2
+	case "y":
+		xmin, xmax = y1, y2
+	default:
+		xmin, xmax = 0, fileMDataCache.ProfileLength
+	}
+
+	w.Header().Add("Access-Control-Allow-Origin", "*")
+	w.Header().Add("Access-Control-Expose-Headers", "outxsize,outzsize,zmin,zmax,filexstart,filexdelta,fileystart,fileydelta,xmin,xmax,x1,y1,x2,y2,profileaxis,profilelength,autoscale")
+	w.Header().Add("outxsize", strconv.Itoa(fileMDataCache.Outxsize))
+	w.Header().Add("outzsize", strconv.Itoa(fileMDataCache.Outzsize))
+	w.Header().Add("zmin", fmt.Sprintf("%f", fileMDataCache.Zmin))
+	w.Header().Add("zmax", fmt.Sprintf("%f", fileMDataCache.Zmax))
+	if fileMDataCache.Autoscale != "" {
+		w.Header().Add("autoscale", fileMDataCache.Autoscale)
+	}
+	w.Header().Add("filexstart", fmt.Sprintf("%f", fileMDataCache.Filexstart))
+	w.Header().Add("filexdelta", fmt.Sprintf("%f", fileMDataCache.Filexdelta))
+	w.Header().Add("fileystart", fmt.Sprintf("%f", fileMDataCache.Fileystart))
+	w.Header().Add("fileydelta", fmt.Sprintf("%f", fileMDataCache.Fileydelta))
+	w.Header().Add("xmin", fmt.Sprintf("%f", xmin))
+	w.Header().Add("xmax", fmt.Sprintf("%f", xmax))
+	w.Header().Add("x1", fmt.Sprintf("%f", x1))
+	w.Header().Add("y1", fmt.Sprintf("%f", y1))
+	w.Header().Add("x2", fmt.Sprintf("%f", x2))
+	w.Header().Add("y2", fmt.Sprintf("%f", y2))
+	w.Header().Add("profileaxis", fileMDataCache.ProfileAxis)
+	w.Header().Add("profilelength", fmt.Sprintf("%f", fileMDataCache.ProfileLength))
+	w.WriteHeader(http.StatusOK)
+
+	w.Write(data)
+}
@@ -0,0 +1,480 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"math/bits"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The finest level of a pyramid is decimated by 2^pyramidFirstLevel in x and y. Less decimated tiles are read from the file.
+const pyramidFirstLevel = 2
+
+// How long a failed pyramid build is remembered. Until then only build=true queues it again.
+const pyramidFailureRetention = time.Hour
+
+// Values stored for each cell of a pyramid level: the first element, the min, max and sum of the elements that are not NaN and how many there were.
+const pyramidCellValues = 5
+
+// pyramidCell summarises a block of elements of the file. Cells are merged in row-major order, so First is the top left element.
+type pyramidCell struct {
+	First  float64
+	Min    float64
+	Max    float64
+	Sum    float64
+	Count  float64
+	merged bool
+}
+
+func (cell *pyramidCell) merge(other pyramidCell) {
+	if !cell.merged {
+		*cell = other
+		cell.merged = true
+		return
+	}
+	if other.Count > 0 {
+		if cell.Count == 0 || other.Min < cell.Min {
+			cell.Min = other.Min
+		}
+		if cell.Count == 0 || other.Max > cell.Max {
+			cell.Max = other.Max
+		}
+		cell.Sum += other.Sum
+		cell.Count += other.Count
+	}
+}
+
+// value reduces the cell with a transform as doTransform does. A cell of only NaN elements is NaN, and first gives the top left
+// element whether or not it is NaN.
+func (cell *pyramidCell) value(transform string) float64 {
+	if cell.Count == 0 && transform != "first" {
+		return math.NaN()
+	}
+	switch transform {
+	case "mean":
+		return cell.Sum / cell.Count
+	case "max":
+		return cell.Max
+	case "min":
+		return cell.Min
+	case "maxabs":
+		return math.Max(math.Abs(cell.Min), math.Abs(cell.Max))
+	}
+	return cell.First
+}
+
+func elementCell(value float64) pyramidCell {
+	if math.IsNaN(value) {
+		return pyramidCell{First: value, merged: true}
+	}
+	return pyramidCell{First: value, Min: value, Max: value, Sum: value, Count: 1, merged: true}
+}
+
+type pyramidLevel struct {
+	Level      int `json:"level"`
+	Decimation int `json:"decimation"`
+	Width      int `json:"width"`
+	Height     int `json:"height"`
+}
+
+// pyramidMeta describes the levels of a pyramid that has finished building.
+type pyramidMeta struct {
+	SourcePath string         `json:"sourcepath"`
+	FileXSize  int            `json:"filexsize"`
+	FileYSize  int            `json:"fileysize"`
+	ModTime    int64          `json:"modtime"`
+	Cxmode     string         `json:"cxmode"`
+	Levels     []pyramidLevel `json:"levels"`
+}
+
+type pyramidStatus struct {
+	State     string         `json:"state"`
+	RowsRead  int            `json:"rowsread"`
+	TotalRows int            `json:"totalrows"`
+	Error     string         `json:"error,omitempty"`
+	Levels    []pyramidLevel `json:"levels,omitempty"`
+	failed    time.Time
+}
+
+var pyramidQueue = make(chan rdsRequest, 16)
+var pyramidStatuses = make(map[string]*pyramidStatus) // Pyramids that are queued, building or failed. Built ones are known from their meta file.
+var pyramidMutex = &sync.Mutex{}
+var pyramidBuilderOnce sync.Once
+
+// pyramidDirectory is the cache directory of the pyramids of the file of the request as it is read. Pyramids of older versions of
+// the file are in the same directory, so they can be removed once the current one is built.
+func (request *rdsRequest) pyramidDirectory() string {
+	sourcePath := request.SourcePath
+	if sourcePath == "" {
+		sourcePath = request.FileName
+	}
+	return "pyramid/" + urlToCacheFileName(sourcePath, fmt.Sprintf("%d_%s", request.FileXSize, request.readOptionsKey())) + "/"
+}
+
+// pyramidKey identifies the pyramid of the current version of the file of the request.
+func (request *rdsRequest) pyramidKey() string {
+	return fmt.Sprintf("%s%d_", request.pyramidDirectory(), request.fileModTime())
+}
+
+func pyramidLevelFileName(key string, level int) string {
+	return fmt.Sprintf("%s%sL%d", configuration.CacheLocation, key, level)
+}
+
+// pyramidLevels lists the levels of a pyramid of a file. Each level halves the one below it until a single cell covers the file
+// or the decimation passes the largest one a tile may ask for.
+func pyramidLevels(fileXSize, fileYSize int) []pyramidLevel {
+	_, _, maxDecimation := tileLimits()
+	var levels []pyramidLevel
+	for level := pyramidFirstLevel; 1<<uint(level) <= maxDecimation; level++ {
+		decimation := 1 << uint(level)
+		width := (fileXSize + decimation - 1) / decimation
+		height := (fileYSize + decimation - 1) / decimation
+		levels = append(levels, pyramidLevel{level, decimation, width, height})
+		if width == 1 && height == 1 {
+			break
+		}
+	}
+	return levels
+}
+
+// pyramidLevelBuilder reduces rows of cells of the level below into one level of a pyramid, writing each finished row to the level
+// file and passing it up to the next level.
+type pyramidLevelBuilder struct {
+	Span   int
+	Row    []pyramidCell
+	RowsIn int
+	Writer *bufio.Writer
+	Next   *pyramidLevelBuilder
+}
+
+func (builder *pyramidLevelBuilder) add(cells []pyramidCell) error {
+	for i, cell := range cells {
+		builder.Row[i/builder.Span].merge(cell)
+	}
+	builder.RowsIn++
+	if builder.RowsIn == builder.Span {
+		return builder.flush()
+	}
+	return nil
+}
+
+func (builder *pyramidLevelBuilder) flush() error {
+	values := make([]float64, 0, len(builder.Row)*pyramidCellValues)
+	for _, cell := range builder.Row {
+		values = append(values, cell.First, cell.Min, cell.Max, cell.Sum, cell.Count)
+	}
+	if err := binary.Write(builder.Writer, binary.LittleEndian, values); err != nil {
+		return err
+	}
+	if builder.Next != nil {
+		if err := builder.Next.add(builder.Row); err != nil {
+			return err
+		}
+	}
+	builder.Row = make([]pyramidCell, len(builder.Row))
+	builder.RowsIn = 0
+	return nil
+}
+
+// finish writes the partly filled row at the bottom edge of the file, then that of each level above.
+func (builder *pyramidLevelBuilder) finish() error {
+	if builder.RowsIn > 0 {
+		if err := builder.flush(); err != nil {
+			return err
+		}
+	}
+	if err := builder.Writer.Flush(); err != nil {
+		return err
+	}
+	if builder.Next != nil {
+		return builder.Next.finish()
+	}
+	return nil
+}
+
+// buildPyramid reads the file of the request once, row by row, and writes every level of its pyramid to the cache. Levels are
+// written under temporary names and the meta file is written last, so a pyramid is only used once it is complete.
+func buildPyramid(request rdsRequest, status *pyramidStatus) (pyramidMeta, error) {
+	key := request.pyramidKey()
+	meta := pyramidMeta{
+		SourcePath: request.SourcePath,
+		FileXSize:  request.FileXSize,
+		FileYSize:  request.FileYSize,
+		ModTime:    request.fileModTime(),
+		Cxmode:     request.Cxmode,
+		Levels:     pyramidLevels(request.FileXSize, request.FileYSize),
+	}
+	if len(meta.Levels) == 0 {
+		return meta, fmt.Errorf("maxDecimation is below the first pyramid level")
+	}
+	if err := os.MkdirAll(configuration.CacheLocation+request.pyramidDirectory(), 0755); err != nil {
+		return meta, err
+	}
+
+	var first *pyramidLevelBuilder
+	var files []*os.File
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	for i := len(meta.Levels) - 1; i >= 0; i-- {
+		file, err := os.Create(pyramidLevelFileName(key, meta.Levels[i].Level) + ".tmp")
+		if err != nil {
+			return meta, err
+		}
+		files = append(files, file)
+		span := 2
+		if i == 0 {
+			span = meta.Levels[0].Decimation
+		}
+		first = &pyramidLevelBuilder{Span: span, Row: make([]pyramidCell, meta.Levels[i].Width), Writer: bufio.NewWriter(file), Next: first}
+	}
+
+	rowCells := make([]pyramidCell, request.FileXSize)
+	for row := 0; row < request.FileYSize; row++ {
+		for i, value := range getLineData(request, row, 0, request.FileXSize) {
+			rowCells[i] = elementCell(value)
+		}
+		if err := first.add(rowCells); err != nil {
+			return meta, err
+		}
+		pyramidMutex.Lock()
+		status.RowsRead = row + 1
+		pyramidMutex.Unlock()
+	}
+	if err := first.finish(); err != nil {
+		return meta, err
+	}
+	for _, level := range meta.Levels {
+		fileName := pyramidLevelFileName(key, level.Level)
+		if err := os.Rename(fileName+".tmp", fileName); err != nil {
+			return meta, err
+		}
+	}
+	metaJSON, marshalError := json.Marshal(meta)
+	if marshalError != nil {
+		return meta, marshalError
+	}
+	putItemInCache(key+"meta", "", metaJSON)
+	return meta, nil
+}
+
+// removeOldPyramids deletes the pyramids of earlier versions of the file of the request.
+func removeOldPyramids(request rdsRequest) {
+	directory := configuration.CacheLocation + request.pyramidDirectory()
+	current := strings.TrimPrefix(request.pyramidKey(), request.pyramidDirectory())
+	files, err := ioutil.ReadDir(directory)
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		if !strings.HasPrefix(file.Name(), current) {
+			log.Println("Removing out of date pyramid file", file.Name())
+			os.Remove(directory + file.Name())
+		}
+	}
+}
+
+func loadPyramidMeta(key string) (pyramidMeta, bool) {
+	var meta pyramidMeta
+	metaJSON, ok := getDataFromCache(key+"meta", "")
+	if !ok {
+		return meta, false
+	}
+	if marshalError := json.Unmarshal(metaJSON, &meta); marshalError != nil {
+		log.Println("Error Decoding pyramid meta", key, marshalError)
+		return meta, false
+	}
+	return meta, true
+}
+
+// getPyramidStatus returns the build state of the pyramid of the file of the request. A pyramid that is on disk is done even when
+// it was built before the service started.
+func getPyramidStatus(request rdsRequest) pyramidStatus {
+	key := request.pyramidKey()
+	pyramidMutex.Lock()
+	status, ok := pyramidStatuses[key]
+	var current pyramidStatus
+	if ok {
+		current = *status
+	}
+	pyramidMutex.Unlock()
+	if ok {
+		return current
+	}
+	if meta, ok := loadPyramidMeta(key); ok {
+		return pyramidStatus{State: "done", RowsRead: meta.FileYSize, TotalRows: meta.FileYSize, Levels: meta.Levels}
+	}
+	return pyramidStatus{State: "none", TotalRows: request.FileYSize}
+}
+
+// queuePyramid asks the background builder to build the pyramid of the file of the request, unless it is queued, building or built.
+// A pyramid whose build failed is only queued again when retryFailed is set, or after pyramidFailureRetention, so a build that keeps
+// failing is not retried by every tile.
+func queuePyramid(request rdsRequest, retryFailed bool) {
+	pyramidBuilderOnce.Do(func() { go runPyramidBuilder() })
+	key := request.pyramidKey()
+	pyramidMutex.Lock()
+	defer pyramidMutex.Unlock()
+	for failedKey, status := range pyramidStatuses {
+		if status.State == "error" && time.Since(status.failed) > pyramidFailureRetention {
+			delete(pyramidStatuses, failedKey)
+		}
+	}
+	if status, ok := pyramidStatuses[key]; ok && (status.State != "error" || !retryFailed) {
+		return
+	}
+	select {
+	case pyramidQueue <- request:
+		pyramidStatuses[key] = &pyramidStatus{State: "queued", TotalRows: request.FileYSize}
+	default:
+		log.Println("Pyramid queue full, not building", key)
+	}
+}
+
+// runPyramidBuilder builds queued pyramids one at a time and removes the pyramids they replace.
+func runPyramidBuilder() {
+	for request := range pyramidQueue {
+		runPyramidBuild(request)
+	}
+}
+
+func runPyramidBuild(request rdsRequest) {
+	start := time.Now()
+	key := request.pyramidKey()
+	pyramidMutex.Lock()
+	status, ok := pyramidStatuses[key]
+	if !ok {
+		status = &pyramidStatus{TotalRows: request.FileYSize}
+		pyramidStatuses[key] = status
+	}
+	status.State = "building"
+	pyramidMutex.Unlock()
+
+	_, err := buildPyramid(request, status)
+	pyramidMutex.Lock()
+	if err != nil {
+		status.State = "error"
+		status.Error = err.Error()
+		status.failed = time.Now()
+	} else { // The meta file now records the pyramid
+		delete(pyramidStatuses, key)
+	}
+	pyramidMutex.Unlock()
+	if err != nil {
+		log.Println("Error building pyramid", key, err)
+		return
+	}
+	removeOldPyramids(request)
+	log.Println("Built pyramid for", key, "in", time.Since(start))
+}
+
+// pyramidTileLevel returns the pyramid level a tile can be made from, which is the coarsest one whose cells fit the decimation in
+// x and y exactly. Tiles that stop short of a whole decimation at the edge of the file, or that are too little decimated, have none.
+func (request *rdsRequest) pyramidTileLevel() (int, bool) {
+	if request.Xsize%request.DecX != 0 || request.Ysize%request.DecY != 0 {
+		return 0, false
+	}
+	level := bits.TrailingZeros(uint(request.DecX))
+	if yLevel := bits.TrailingZeros(uint(request.DecY)); yLevel < level {
+		level = yLevel
+	}
+	return level, level >= pyramidFirstLevel
+}
+
+// pyramidTileData makes the values of a tile from the cells of a pyramid level rather than the file. It returns false when there is
+// no built pyramid for the file, or no level of it suits the tile.
+func pyramidTileData(request rdsRequest) ([]float64, int, bool) {
+	level, ok := request.pyramidTileLevel()
+	if !ok {
+		return nil, 0, false
+	}
+	meta, ok := loadPyramidMeta(request.pyramidKey())
+	if !ok {
+		return nil, 0, false
+	}
+	top := meta.Levels[len(meta.Levels)-1].Level
+	if level > top {
+		level = top
+	}
+	info := meta.Levels[level-pyramidFirstLevel]
+	file, err := os.Open(pyramidLevelFileName(request.pyramidKey(), level))
+	if err != nil {
+		log.Println("Error opening pyramid level", err)
+		return nil, 0, false
+	}
+	defer file.Close()
+
+	cellsX := request.DecX / info.Decimation // cells across each output value
+	cellsY := request.DecY / info.Decimation
+	firstCellX := request.Xstart / info.Decimation
+	numCellsX := request.Outxsize * cellsX
+	rowBytes := make([]byte, numCellsX*pyramidCellValues*8)
+	rowValues := make([]float64, numCellsX*pyramidCellValues)
+	outData := make([]float64, request.Outxsize*request.Outysize)
+	for y := 0; y < request.Outysize; y++ {
+		bins := make([]pyramidCell, request.Outxsize)
+		for cellRow := request.Ystart/info.Decimation + y*cellsY; cellRow < request.Ystart/info.Decimation+(y+1)*cellsY; cellRow++ {
+			offset := int64(cellRow*info.Width+firstCellX) * pyramidCellValues * 8
+			if _, err := file.ReadAt(rowBytes, offset); err != nil {
+				log.Println("Error reading pyramid level", err)
+				return nil, 0, false
+			}
+			binary.Read(bytes.NewReader(rowBytes), binary.LittleEndian, rowValues)
+			for i := 0; i < numCellsX; i++ {
+				values := rowValues[i*pyramidCellValues:]
+				bins[i/cellsX].merge(pyramidCell{First: values[0], Min: values[1], Max: values[2], Sum: values[3], Count: values[4], merged: true})
+			}
+		}
+		for x := range bins {
+			outData[y*request.Outxsize+x] = bins[x].value(request.Transform)
+		}
+	}
+	return outData, level, true
+}
+
+type pyramidServer struct{}
+
+func (s *pyramidServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var pyramidRequest rdsRequest
+
+	//url - /sds/pyramid/<LocationName>/path/to/filename?subsize=&cxmode=&build=true
+	if !*useCache {
+		log.Println("Pyramids are stored in the cache, which is turned off")
+		w.WriteHeader(400)
+		return
+	}
+	pyramidRequest.getQueryParams(r)
+	if !pyramidRequest.openRegionFile(r.URL.Path, 3) {
+		w.WriteHeader(400)
+		return
+	}
+	build, ok := getURLQueryParamString(r, "build")
+	if ok && build == "true" {
+		if state := getPyramidStatus(pyramidRequest).State; state == "none" || state == "error" {
+			queuePyramid(pyramidRequest, true)
+		}
+	}
+
+	statusJSON, marshalError := json.Marshal(getPyramidStatus(pyramidRequest))
+	if marshalError != nil {
+		log.Println("Error Encoding pyramid status", marshalError)
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Add("Access-Control-Allow-Origin", "*")
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(statusJSON)
+}
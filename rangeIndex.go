@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default number of rows summarised by each block of a range index.
+const defaultRangeIndexRowsPerBlock = 64
+
+type rangeIndexBlock struct {
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	Mean  float64 `json:"mean"`
+	Count int64   `json:"count"`
+}
+
+// rangeIndex holds the exact range of every finite value of a file for one cxmode, for the whole file and for each block of rows.
+type rangeIndex struct {
+	SourcePath   string            `json:"sourcepath"`
+	FileXSize    int               `json:"filexsize"`
+	ModTime      int64             `json:"modtime"`
+	Cxmode       string            `json:"cxmode"`
+	RowsPerBlock int               `json:"rowsperblock"`
+	Min          float64           `json:"min"`
+	Max          float64           `json:"max"`
+	Mean         float64           `json:"mean"`
+	Count        int64             `json:"count"`
+	Blocks       []rangeIndexBlock `json:"blocks"`
+}
+
+var rangeIndexQueue = make(chan rdsRequest, 64)
+var rangeIndexPending = make(map[string]bool)
+var rangeIndexMutex = &sync.Mutex{}
+var rangeIndexerOnce sync.Once
+
+// dataSourcePath returns the location name and path of the file in a url, starting at urlPosition.
+func dataSourcePath(url string, urlPosition int) string {
+	pathData := strings.Split(url, "/")
+	return strings.Join(pathData[urlPosition:], "/")
+}
+
+// fileModTime returns the modification time of the file behind the reader of the request. Minio files are read from
+// the local minio cache so it changes whenever a new copy is fetched.
+func (request *rdsRequest) fileModTime() int64 {
+	file, ok := request.Reader.(*os.File)
+	if !ok {
+		return 0
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return 0
+	}
+	return info.ModTime().UnixNano()
+}
+
+// readOptionsKey describes the options that change the values read from the file, so ranges of differently read data are kept apart.
+func (request *rdsRequest) readOptionsKey() string {
+	key := request.Cxmode
+	if request.Tune != 0 {
+		key += fmt.Sprintf("_tune%g", request.Tune)
+	}
+	if request.Demod != "" {
+		key += fmt.Sprintf("_%s%g", request.Demod, request.Bandwidth)
+	}
+	if request.Compare != nil {
+		key += "_" + request.compareOptionsKey()
+	}
+	if request.Expression != nil {
+		key += "_" + request.expressionOptionsKey()
+	}
+	if request.backgroundRequested() {
+		key += "_" + request.backgroundOptionsKey()
+	}
+	return key
+}
+
+// rangeIndexKey identifies the range of the file of the request by its location, path, subsize, modification time and how it is read.
+// It is also the key used for the file in zminzmaxFileMap.
+func (request *rdsRequest) rangeIndexKey() string {
+	sourcePath := request.SourcePath
+	if sourcePath == "" {
+		sourcePath = request.FileName
+	}
+	return urlToCacheFileName(sourcePath, fmt.Sprintf("%d_%d_%s", request.FileXSize, request.fileModTime(), request.readOptionsKey()))
+}
+
+// buildRangeIndex reads every element of the file of the request to find its exact range, overall and for each block of rows.
+func buildRangeIndex(request rdsRequest) rangeIndex {
+	rowsPerBlock := configuration.RangeIndexRowsPerBlock
+	if rowsPerBlock < 1 {
+		rowsPerBlock = defaultRangeIndexRowsPerBlock
+	}
+	numBlocks := (request.FileYSize + rowsPerBlock - 1) / rowsPerBlock
+
+	fileRequest := request
+	fileRequest.Xstart, fileRequest.Xsize = 0, request.FileXSize
+	fileRequest.Ystart, fileRequest.Ysize = 0, request.FileYSize
+	accumulators := make([][]statsAccumulator, scanWorkers)
+	for worker := range accumulators {
+		accumulators[worker] = make([]statsAccumulator, numBlocks)
+	}
+	scanRegion(fileRequest, func(worker int, segment lineSegment, data []float64) {
+		block := &accumulators[worker][segment.Row/rowsPerBlock]
+		for i, value := range data {
+			block.add(value, segment.Xstart+i, segment.Row)
+		}
+	})
+
+	index := rangeIndex{
+		SourcePath:   request.SourcePath,
+		FileXSize:    request.FileXSize,
+		ModTime:      request.fileModTime(),
+		Cxmode:       request.Cxmode,
+		RowsPerBlock: rowsPerBlock,
+		Blocks:       make([]rangeIndexBlock, numBlocks),
+	}
+	var file statsAccumulator
+	for block := range index.Blocks {
+		var blockAccumulator statsAccumulator
+		for worker := range accumulators {
+			blockAccumulator.merge(accumulators[worker][block])
+		}
+		if blockAccumulator.count > 0 {
+			index.Blocks[block] = rangeIndexBlock{blockAccumulator.min, blockAccumulator.max, blockAccumulator.mean, blockAccumulator.count}
+		}
+		file.merge(blockAccumulator)
+	}
+	if file.count > 0 {
+		index.Min, index.Max, index.Mean, index.Count = file.min, file.max, file.mean, file.count
+	}
+	return index
+}
+
+func loadRangeIndex(key string) (rangeIndex, bool) {
+	var index rangeIndex
+	indexJSON, ok := getDataFromCache(key, "rangeIndex/")
+	if !ok {
+		return index, false
+	}
+	marshalError := json.Unmarshal(indexJSON, &index)
+	if marshalError != nil {
+		log.Println("Error Decoding range index", key, marshalError)
+		return index, false
+	}
+	return index, true
+}
+
+func storeRangeIndex(key string, index rangeIndex) {
+	indexJSON, marshalError := json.Marshal(index)
+	if marshalError != nil {
+		log.Println("Error Encoding range index", key, marshalError)
+		return
+	}
+	putItemInCache(key, "rangeIndex/", indexJSON)
+}
+
+// indexedRegionSegments uses the blocks of the range index of the file for the rows of a selection of whole rows that cover whole blocks.
+// It returns the range of the finite values of those blocks and the segments of the selection that still have to be read. Without a
+// built index, or for a selection of part of each row, every segment of the selection is returned with an empty range.
+func indexedRegionSegments(dataRequest rdsRequest) (float64, float64, []lineSegment) {
+	min, max := math.Inf(1), math.Inf(-1)
+	segments := regionSegments(dataRequest)
+	if !*useCache || dataRequest.Xstart != 0 || dataRequest.Xsize != dataRequest.FileXSize {
+		return min, max, segments
+	}
+	index, ok := loadRangeIndex(dataRequest.rangeIndexKey())
+	if !ok {
+		queueRangeIndex(dataRequest)
+		return min, max, segments
+	}
+	if index.RowsPerBlock < 1 {
+		return min, max, segments
+	}
+
+	yend := dataRequest.Ystart + dataRequest.Ysize
+	firstBlock := (dataRequest.Ystart + index.RowsPerBlock - 1) / index.RowsPerBlock
+	indexedStart, indexedEnd := firstBlock*index.RowsPerBlock, firstBlock*index.RowsPerBlock
+	for block := firstBlock; block < len(index.Blocks); block++ {
+		blockEnd := int(math.Min(float64((block+1)*index.RowsPerBlock), float64(dataRequest.FileYSize)))
+		if blockEnd > yend {
+			break
+		}
+		if index.Blocks[block].Count > 0 {
+			min = math.Min(min, index.Blocks[block].Min)
+			max = math.Max(max, index.Blocks[block].Max)
+		}
+		indexedEnd = blockEnd
+	}
+
+	remaining := make([]lineSegment, 0, len(segments))
+	for _, segment := range segments {
+		if segment.Row < indexedStart || segment.Row >= indexedEnd {
+			remaining = append(remaining, segment)
+		}
+	}
+	return min, max, remaining
+}
+
+// queueRangeIndex asks the background indexer to build the range index of the file of the request, unless it is already waiting to be built.
+func queueRangeIndex(request rdsRequest) {
+	rangeIndexerOnce.Do(func() { go runRangeIndexer() })
+	key := request.rangeIndexKey()
+	rangeIndexMutex.Lock()
+	defer rangeIndexMutex.Unlock()
+	if rangeIndexPending[key] {
+		return
+	}
+	select {
+	case rangeIndexQueue <- request:
+		rangeIndexPending[key] = true
+	default:
+		log.Println("Range index queue full, not indexing", key)
+	}
+}
+
+// runRangeIndexer builds queued range indexes one at a time, stores them on disk and replaces any estimate of the file range that is in memory.
+func runRangeIndexer() {
+	for request := range rangeIndexQueue {
+		start := time.Now()
+		key := request.rangeIndexKey()
+		index := buildRangeIndex(request)
+		storeRangeIndex(key, index)
+		zminmaxtileMutex.Lock()
+		zminzmaxFileMap[key] = Zminzmax{index.Min, index.Max}
+		zminmaxtileMutex.Unlock()
+		rangeIndexMutex.Lock()
+		delete(rangeIndexPending, key)
+		rangeIndexMutex.Unlock()
+		log.Println("Built range index for", key, "in", time.Since(start))
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"strings"
+)
+
+// Number of line segments that are read and processed concurrently when scanning a region.
+const scanWorkers = 16
+
+// Maximum number of elements read at once from a row. Long rows, like those of 1D files, are split into several segments.
+const maxSegmentElements = 65536
+
+type lineSegment struct {
+	Row    int
+	Xstart int
+	Xsize  int
+}
+
+// rowSegments splits xsize elements of a row starting at xstart into segments of at most maxSegmentElements.
+func rowSegments(row, xstart, xsize int) []lineSegment {
+	var segments []lineSegment
+	for start := xstart; start < xstart+xsize; start += maxSegmentElements {
+		size := int(math.Min(float64(maxSegmentElements), float64(xstart+xsize-start)))
+		segments = append(segments, lineSegment{row, start, size})
+	}
+	return segments
+}
+
+// regionSegments splits the selection of the request into segments of at most maxSegmentElements along each row.
+func regionSegments(dataRequest rdsRequest) []lineSegment {
+	segments := make([]lineSegment, 0, dataRequest.Ysize)
+	for row := dataRequest.Ystart; row < dataRequest.Ystart+dataRequest.Ysize; row++ {
+		segments = append(segments, rowSegments(row, dataRequest.Xstart, dataRequest.Xsize)...)
+	}
+	return segments
+}
+
+// scanRegion reads the selection of the request segment by segment and calls process with the data after the cxmode has been applied.
+func scanRegion(dataRequest rdsRequest, process func(worker int, segment lineSegment, data []float64)) {
+	scanSegments(dataRequest, regionSegments(dataRequest), process)
+}
+
+// scanSegments reads each segment of the file and calls process with its data after the cxmode has been applied.
+// Up to scanWorkers segments are processed at the same time. worker is in the range [0,scanWorkers) and no two concurrent calls
+// share a worker number, so process can accumulate into per worker state without locking.
+func scanSegments(dataRequest rdsRequest, segments []lineSegment, process func(worker int, segment lineSegment, data []float64)) {
+	done := make(chan bool, 1)
+	for batchStart := 0; batchStart < len(segments); batchStart += scanWorkers {
+		batchEnd := int(math.Min(float64(batchStart+scanWorkers), float64(len(segments))))
+		for i := batchStart; i < batchEnd; i++ {
+			go func(worker int, segment lineSegment) {
+				process(worker, segment, getLineData(dataRequest, segment.Row, segment.Xstart, segment.Xsize))
+				done <- true
+			}(i-batchStart, segments[i])
+		}
+		for i := batchStart; i < batchEnd; i++ {
+			<-done
+		}
+	}
+}
+
+// openRegionFile opens the file of a region request, reads its header and sets the file sizes. Type 1000 files without a subsize are treated as a single row.
+func (request *rdsRequest) openRegionFile(url string, urlPosition int) bool {
+	var ok bool
+	request.Reader, request.FileName, ok = openDataSource(url, urlPosition)
+	if !ok {
+		return false
+	}
+	request.SourcePath = dataSourcePath(url, urlPosition)
+	if !(strings.Contains(request.FileName, ".tmp") || strings.Contains(request.FileName, ".prm")) {
+		log.Println("Invalid File Type")
+		return false
+	}
+	request.processBlueFileHeader()
+	if request.SubsizeSet {
+		request.FileXSize = request.Subsize
+		request.computeYSize()
+	} else if request.FileType == 1000 {
+		request.FileXSize = int(request.FileDataSize / bytesPerAtomMap[string(request.FileFormat[1])])
+		if string(request.FileFormat[0]) == "C" {
+			request.FileXSize = request.FileXSize / 2
+		}
+		request.FileYSize = 1
+	} else {
+		request.computeYSize()
+	}
+	return true
+}
+
+// getRegionQueryParams sets the selection from the optional x1, y1, x2 and y2 query params. Any that are missing default to the edges of the file.
+func (request *rdsRequest) getRegionQueryParams(r *http.Request) bool {
+	var ok bool
+	request.X1, ok = getURLQueryParamInt(r, "x1")
+	if !ok {
+		request.X1 = 0
+	}
+	request.Y1, ok = getURLQueryParamInt(r, "y1")
+	if !ok {
+		request.Y1 = 0
+	}
+	request.X2, ok = getURLQueryParamInt(r, "x2")
+	if !ok {
+		request.X2 = request.FileXSize
+	}
+	request.Y2, ok = getURLQueryParamInt(r, "y2")
+	if !ok {
+		request.Y2 = request.FileYSize
+	}
+	if request.X1 < 0 || request.Y1 < 0 || request.X2 < 0 || request.Y2 < 0 {
+		log.Println("Invalid Request. x1, y1, x2 and y2 must not be negative")
+		return false
+	}
+	if request.X1 > request.FileXSize || request.X2 > request.FileXSize {
+		log.Println("Invalid Request. Requested X1 or X2 greater than file X size")
+		return false
+	}
+	if request.Y1 > request.FileYSize || request.Y2 > request.FileYSize {
+		log.Println("Invalid Request. Requested Y1 or Y2 greater than file Y size")
+		return false
+	}
+	request.computeRequestSizes()
+	if request.Xsize < 1 || request.Ysize < 1 {
+		log.Println("Bad Xsize or ysize. xsize: ", request.Xsize, " ysize: ", request.Ysize)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Largest up or down factor of a rational resample. Target xdeltas are approximated by the nearest ratio within this limit.
+const maxResampleFactor = 1000
+
+// Most samples a resampled selection may have.
+const maxResampledSamples = 1 << 24
+
+// parseResample reads a resample option, either a ratio up/down or the xdelta wanted, and returns the factors reduced to lowest terms.
+// xdelta is the spacing of the file, which a target xdelta is relative to.
+func parseResample(param string, xdelta float64) (int, int, bool) {
+	var up, down int
+	if fields := strings.Split(param, "/"); len(fields) == 2 {
+		var errUp, errDown error
+		up, errUp = strconv.Atoi(fields[0])
+		down, errDown = strconv.Atoi(fields[1])
+		if errUp != nil || errDown != nil {
+			return 0, 0, false
+		}
+	} else {
+		target, err := strconv.ParseFloat(param, 64)
+		if err != nil || !(target > 0) || !(xdelta > 0) || math.IsInf(target, 0) {
+			return 0, 0, false
+		}
+		up, down = rationalApproximation(xdelta/target, maxResampleFactor)
+	}
+	if up < 1 || down < 1 || up > maxResampleFactor || down > maxResampleFactor {
+		return 0, 0, false
+	}
+	divisor := gcd(up, down)
+	return up / divisor, down / divisor, true
+}
+
+// rationalApproximation returns the last convergent of the continued fraction of value with neither part larger than limit.
+// Values too small or too large to be written within the limit give 0/1.
+func rationalApproximation(value float64, limit int) (int, int) {
+	// Convergents h/k of the continued fraction, starting from 1/0 and 0/1
+	h0, h1 := 0, 1
+	k0, k1 := 1, 0
+	bestH, bestK := 0, 1
+	remainder := value
+	for i := 0; i < 64; i++ {
+		term := math.Floor(remainder)
+		if term > float64(limit) {
+			break
+		}
+		h := int(term)*h1 + h0
+		k := int(term)*k1 + k0
+		if h > limit || k > limit {
+			break
+		}
+		h0, h1 = h1, h
+		k0, k1 = k1, k
+		bestH, bestK = h, k
+		fraction := remainder - term
+		if fraction < 1e-12 || math.Abs(float64(h)/float64(k)-value) <= 1e-12*value {
+			break
+		}
+		remainder = 1 / fraction
+	}
+	return bestH, bestK
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// resampleLength is the number of samples numIn samples give when resampled by up/down.
+func resampleLength(numIn, up, down int) int {
+	return int((int64(numIn)*int64(up) + int64(down) - 1) / int64(down))
+}
+
+// polyphaseResample changes the rate of data by up/down. It is the same as inserting up-1 zeros after each sample, low-pass filtering at
+// the lower of the two Nyquist rates and keeping every down'th sample, but only the taps that meet an input sample are computed,
+// which is the polyphase form of the filter. Output sample n is at input position n*down/up. The edges of the input are repeated
+// as in firDecimate.
+func polyphaseResample(data []float64, up, down int, numTaps int, window string) []float64 {
+	if up == down || len(data) == 0 {
+		return data
+	}
+	cutoff := 0.5 / float64(up)
+	if down > up {
+		cutoff = 0.5 / float64(down)
+	}
+	// Every phase needs a tap inside the window and the main lobe of the filter, or it sums to zero when the window is zero at its edges
+	numTaps = int(math.Max(float64(lowPassTaps(cutoff, numTaps)), float64(2*up+1)))
+	taps := designLowPassCutoff(numTaps, cutoff, window)
+	// Scale each phase of the filter to a gain of one at DC, so flat lines stay flat whichever phase an output sample uses
+	phaseSums := make([]float64, up)
+	for k := range taps {
+		phaseSums[k%up] += taps[k]
+	}
+	for k := range taps {
+		taps[k] /= phaseSums[k%up]
+	}
+	center := (len(taps) - 1) / 2
+	last := len(data) - 1
+
+	outData := make([]float64, resampleLength(len(data), up, down))
+	for n := range outData {
+		position := n*down + center // Position in the upsampled line of the first tap
+		var value float64
+		for k := position % up; k < len(taps); k += up {
+			i := (position - k) / up
+			if i < 0 {
+				i = 0
+			} else if i > last {
+				i = last
+			}
+			value += taps[k] * data[i]
+		}
+		outData[n] = value
+	}
+	return outData
+}
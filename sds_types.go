@@ -12,38 +12,69 @@ type Zminzmax struct {
 }
 
 type rdsRequest struct {
-	TileRequest                                            bool
-	FileFormat                                             string
-	FileName                                               string
-	FileType, FileSubsize                                  int
-	FileXSize, FileYSize                                   int
-	FileDataSize                                           float64
-	FileDataOffset                                         int
-	TileXSize, TileYSize, DecXMode, DecYMode, TileX, TileY int
-	DecX, DecY                                             int
-	Zset                                                   bool
-	Subsize                                                int
-	SubsizeSet                                             bool
-	Transform                                              string
-	ColorMap                                               string
-	Reader                                                 io.ReadSeeker
-	Cxmode                                                 string
-	CxmodeSet                                              bool
-	OutputFmt                                              string
-	Outxsize                                               int     `json:"outxsize"`
-	Outysize                                               int     `json:"outysize"`
-	Outzsize                                               int     `json:"outzsize"`
-	Zmin                                                   float64 `json:"zmin"`
-	Zmax                                                   float64 `json:"zmax"`
-	Filexstart                                             float64 `json:"filexstart"`
-	Filexdelta                                             float64 `json:"filexdelta"`
-	Fileystart                                             float64 `json:"fileystart"`
-	Fileydelta                                             float64 `json:"fileydelta"`
-	Xstart                                                 int     `json:"xstart"`
-	Xsize                                                  int     `json:"xsize"`
-	Ystart                                                 int     `json:"ystart"`
-	Ysize                                                  int     `json:"ysize"`
-	X1, X2, Y1, Y2                                         int
+	TileRequest                                 bool
+	FileFormat                                  string
+	FileName                                    string
+	SourcePath                                  string
+	FileType, FileSubsize                       int
+	FileXSize, FileYSize                        int
+	FileDataSize                                float64
+	FileDataOffset                              int
+	TileXSize, TileYSize, TileX, TileY          int
+	DecX, DecY                                  int
+	Zset                                        bool
+	Subsize                                     int
+	SubsizeSet                                  bool
+	Transform                                   string
+	Interp                                      string
+	Autoscale                                   string
+	Filter, FilterWindow                        string
+	FilterTaps                                  int
+	Tune                                        float64
+	Demod                                       string
+	Bandwidth                                   float64
+	Resample                                    string
+	ResampleUp, ResampleDown                    int
+	XScale                                      string
+	XBinEdges                                   []float64
+	Baseline, BaselineOp, BaselineRows, RowNorm string
+	Background                                  *backgroundModel
+	CompareSource, CompareOp                    string
+	CompareXOffset, CompareYOffset              int
+	Compare                                     *rdsRequest
+	Expr                                        string
+	ExprFiles                                   []string
+	Expression                                  *compiledExpression
+	ColorMap                                    string
+	CScale                                      string
+	ReverseColors                               bool
+	NumColors                                   int
+	NaNColor                                    *[4]byte
+	UnderColor                                  *[4]byte
+	OverColor                                   *[4]byte
+	Alpha                                       string
+	Mask                                        string
+	MaskColor                                   [4]byte
+	Reader                                      io.ReadSeeker
+	Cxmode                                      string
+	CxmodeSet                                   bool
+	OutputFmt                                   string
+	Outxsize                                    int     `json:"outxsize"`
+	Outysize                                    int     `json:"outysize"`
+	Outzsize                                    int     `json:"outzsize"`
+	Zmin                                        float64 `json:"zmin"`
+	Zmax                                        float64 `json:"zmax"`
+	Filexstart                                  float64 `json:"filexstart"`
+	Filexdelta                                  float64 `json:"filexdelta"`
+	Fileystart                                  float64 `json:"fileystart"`
+	Fileydelta                                  float64 `json:"fileydelta"`
+	Xstart                                      int     `json:"xstart"`
+	Xsize                                       int     `json:"xsize"`
+	Ystart                                      int     `json:"ystart"`
+	Ysize                                       int     `json:"ysize"`
+	X1, X2, Y1, Y2                              int
+	Width                                       int
+	ProfileAxis                                 string
 }
 
 func (request *rdsRequest) computeYSize() {
@@ -54,9 +85,6 @@ func (request *rdsRequest) computeYSize() {
 }
 
 func (request *rdsRequest) computeTileSizes() {
-	request.DecX = decimationLookup[request.DecXMode]
-	request.DecY = decimationLookup[request.DecYMode]
-
 	request.Xstart = request.TileX * request.TileXSize * request.DecX
 	request.Ystart = request.TileY * request.TileYSize * request.DecY
 	request.Xsize = int(request.TileXSize * request.DecX)
@@ -125,13 +153,19 @@ type Location struct {
 
 // Configuration Struct for Configuraion File
 type Configuration struct {
-	Port             int        `json:"port"`
-	CacheLocation    string     `json:"cacheLocation"`
-	Logfile          string     `json:"logfile"`
-	CacheMaxBytes    int64      `json:"cacheMaxBytes"`
-	CheckCacheEvery  int        `json:"checkCacheEvery"`
-	MaxBytesZminZmax int        `json:"maxBytesZminZmax"`
-	LocationDetails  []Location `json:"locationDetails"`
+	Port                   int                  `json:"port"`
+	CacheLocation          string               `json:"cacheLocation"`
+	Logfile                string               `json:"logfile"`
+	CacheMaxBytes          int64                `json:"cacheMaxBytes"`
+	CheckCacheEvery        int                  `json:"checkCacheEvery"`
+	MaxBytesZminZmax       int                  `json:"maxBytesZminZmax"`
+	RangeIndexRowsPerBlock int                  `json:"rangeIndexRowsPerBlock"`
+	MinTileSize            int                  `json:"minTileSize"`
+	MaxTileSize            int                  `json:"maxTileSize"`
+	MaxDecimation          int                  `json:"maxDecimation"`
+	NumColors              int                  `json:"numColors"`
+	ColorMaps              []colorMapDefinition `json:"colorMaps"`
+	LocationDetails        []Location           `json:"locationDetails"`
 }
 
 type fileMetaData struct {
@@ -148,4 +182,19 @@ type fileMetaData struct {
 	Xsize      int     `json:"xsize"`
 	Ystart     int     `json:"ystart"`
 	Ysize      int     `json:"ysize"`
+
+	Autoscale     string    `json:"autoscale,omitempty"`
+	Mask          string    `json:"mask,omitempty"`
+	ProfileAxis   string    `json:"profileaxis,omitempty"`
+	ProfileLength float64   `json:"profilelength,omitempty"`
+	ResampleUp    int       `json:"resampleup,omitempty"`
+	ResampleDown  int       `json:"resampledown,omitempty"`
+	NumSamples    int       `json:"numsamples,omitempty"`
+	XBinEdges     []float64 `json:"xbinedges,omitempty"`
+	DecX          int       `json:"decx,omitempty"`
+	DecY          int       `json:"decy,omitempty"`
+	TilesX        int       `json:"tilesx,omitempty"`
+	TilesY        int       `json:"tilesy,omitempty"`
+	PyramidLevel  int       `json:"pyramidlevel,omitempty"`
+	ZScale        string    `json:"zscale,omitempty"`
 }
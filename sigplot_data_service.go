@@ -17,8 +17,6 @@ import (
 	assetfs "github.com/elazarl/go-bindata-assetfs"
 	"github.com/minio/minio-go/v6"
 	"github.com/tkanos/gonfig"
-	"gonum.org/v1/gonum/floats"
-	"gonum.org/v1/gonum/stat"
 
 	//	"runtime/pprof"
 	//	"net/http/httptest"
@@ -36,6 +34,14 @@ var uiEnabled = true // set to false by stub_asset if the ui build isn't include
 var stubHTML = ""    // set to HTML by stub_asset if the ui build isn't included
 var configuration Configuration
 
+// nanToZero gives 0 for NaN, which the integer output formats cannot hold.
+func nanToZero(value float64) float64 {
+	if math.IsNaN(value) {
+		return 0
+	}
+	return value
+}
+
 func createOutput(dataIn []float64, fileFormatString string, zmin, zmax float64, colorMap string) []byte {
 	// for i := 0; i < len(dataIn); i++ {
 	// 	if math.IsNaN(dataIn[i]) {
@@ -44,41 +50,16 @@ func createOutput(dataIn []float64, fileFormatString string, zmin, zmax float64,
 	// }
 
 	dataOut := new(bytes.Buffer)
-	var numColors int = 1000
 	//var dataOut []byte
 	if fileFormatString == "RGBA" {
-		controlColors := getColorConrolPoints(colorMap)
-		colorPalette := makeColorPalette(controlColors, numColors)
-		if zmax != zmin {
-			colorsPerSpan := (zmax - zmin) / float64(numColors)
-			for i := 0; i < len(dataIn); i++ {
-				colorIndex := math.Round((dataIn[i]-zmin)/colorsPerSpan) - 1
-				colorIndex = math.Min(math.Max(colorIndex, 0), float64(numColors-1)) //Ensure colorIndex is within the colorPalette
-				a := 255
-				//log.Println("colorIndex", colorIndex,dataIn[i],zmin,zmax,colorsPerSpan)
-				dataOut.WriteByte(byte(colorPalette[int(colorIndex)].red))
-				dataOut.WriteByte(byte(colorPalette[int(colorIndex)].green))
-				dataOut.WriteByte(byte(colorPalette[int(colorIndex)].blue))
-				dataOut.WriteByte(byte(a))
-			}
-		} else {
-			for i := 0; i < len(dataIn); i++ {
-				a := 255
-				dataOut.WriteByte(byte(colorPalette[0].red))
-				dataOut.WriteByte(byte(colorPalette[0].green))
-				dataOut.WriteByte(byte(colorPalette[0].blue))
-				dataOut.WriteByte(byte(a))
-			}
-		}
-		//log.Println("out_data RGBA" , len(dataOut.Bytes()))
-		return dataOut.Bytes()
+		return colorizeValues(dataIn, zmin, zmax, colorMap, colorOptions{Scale: colorScale{Kind: "linear"}, NumColors: configNumColors()})
 	} else {
 		log.Println("Creating Output of Type ", fileFormatString)
 		switch string(fileFormatString[1]) {
 		case "B":
 			var numSlice = make([]int8, len(dataIn))
 			for i := 0; i < len(numSlice); i++ {
-				numSlice[i] = int8(math.Round(dataIn[i]))
+				numSlice[i] = int8(math.Round(nanToZero(dataIn[i])))
 			}
 
 			err := binary.Write(dataOut, binary.LittleEndian, &numSlice)
@@ -88,7 +69,7 @@ func createOutput(dataIn []float64, fileFormatString string, zmin, zmax float64,
 		case "I":
 			var numSlice = make([]int16, len(dataIn))
 			for i := 0; i < len(numSlice); i++ {
-				numSlice[i] = int16(math.Round(dataIn[i]))
+				numSlice[i] = int16(math.Round(nanToZero(dataIn[i])))
 			}
 
 			err := binary.Write(dataOut, binary.LittleEndian, &numSlice)
@@ -98,7 +79,7 @@ func createOutput(dataIn []float64, fileFormatString string, zmin, zmax float64,
 		case "L":
 			var numSlice = make([]int32, len(dataIn))
 			for i := 0; i < len(numSlice); i++ {
-				numSlice[i] = int32(math.Round(dataIn[i]))
+				numSlice[i] = int32(math.Round(nanToZero(dataIn[i])))
 			}
 
 			err := binary.Write(dataOut, binary.LittleEndian, &numSlice)
@@ -126,8 +107,7 @@ func createOutput(dataIn []float64, fileFormatString string, zmin, zmax float64,
 			check(err)
 
 		case "P":
-			extraBits := len(dataIn) % 8
-			for extraBit := 0; extraBit < extraBits; extraBits++ { //Pad zeros to make the number of elements divisable by 8 so it can be packed into a byte
+			for len(dataIn)%8 != 0 { //Pad zeros to make the number of elements divisable by 8 so it can be packed into a byte
 				dataIn = append(dataIn, 0)
 			}
 			numBytes := len(dataIn) / 8
@@ -217,58 +197,44 @@ func convertFileData(bytesin []byte, file_formatstring string) []float64 {
 
 }
 
+// doTransform reduces a set of values to one. NaN values are left out of the mean, max, min and maxabs, which are only NaN when every
+// value is NaN, so missing data stays missing when it is thinned rather than hiding the values around it. first keeps the first value
+// even when it is NaN.
 func doTransform(dataIn []float64, transform string) float64 {
 	switch transform {
-	case "mean":
-		num := stat.Mean(dataIn[:], nil)
-		if math.IsNaN(num) {
-			log.Println("DoTransform produced NaN")
-			num = 0
-		}
-		return num
-	case "max":
-		num := floats.Max(dataIn[:])
-		if math.IsNaN(num) {
-			log.Println("DoTransform produced NaN")
-			num = 0
-		}
-		return num
-	case "min":
-		num := floats.Min(dataIn[:])
-		if math.IsNaN(num) {
-			log.Println("DoTransform produced NaN")
-			num = 0
-		}
-		return num
-	case "maxabs":
-		absnums := make([]float64, len(dataIn))
-		for i := 0; i < len(dataIn); i++ {
-			absnums[i] = math.Abs(dataIn[i])
+	case "mean", "max", "min", "maxabs":
+		num := math.NaN()
+		var sum float64
+		var count int
+		for _, value := range dataIn {
+			if math.IsNaN(value) {
+				continue
+			}
+			if transform == "maxabs" {
+				value = math.Abs(value)
+			}
+			switch {
+			case count == 0:
+				num = value
+			case transform == "min":
+				num = math.Min(num, value)
+			case transform == "max" || transform == "maxabs":
+				num = math.Max(num, value)
+			}
+			sum += value
+			count++
 		}
-		num := floats.Max(absnums[:])
-		if math.IsNaN(num) {
-			log.Println("DoTransform produced NaN")
-			num = 0
+		if transform == "mean" && count > 0 {
+			num = sum / float64(count)
 		}
 		return num
 	case "first":
-		num := dataIn[0]
-		if math.IsNaN(num) {
-			log.Println("DoTransform produced NaN")
-			num = 0
-		}
-		return num
+		return dataIn[0]
 	default: //Default to first if bad value.
 		log.Println("Unknown transform", transform, "using first")
-		num := dataIn[0]
-		if math.IsNaN(num) {
-			log.Println("DoTransform produced NaN")
-			num = 0
-		}
-		return num
+		return dataIn[0]
 
 	}
-	return 0
 }
 
 func getFileTypeInfo(fileFormat string) (float64, bool) {
@@ -297,7 +263,7 @@ func getFileTypeInfo(fileFormat string) (float64, bool) {
 	return bytesPerAtom, complexFlag
 }
 
-func down_sample_line_inx(datain []float64, outxsize int, transform string, outData []float64, outLineNum int) {
+func down_sample_line_inx(datain []float64, outxsize int, transform string, interp string, outData []float64, outLineNum int) {
 	//var inputysize int =len(datain)/framesize
 	var xelementsperoutput float64
 	xelementsperoutput = float64(len(datain)) / float64(outxsize)
@@ -317,12 +283,16 @@ func down_sample_line_inx(datain []float64, outxsize int, transform string, outD
 			outData[outLineNum*outxsize+x] = doTransform(datain[startelement:endelement], transform)
 
 		}
-	} else { // Expand Data by repeating input values into output
+	} else if interp == "nearest" { // Expand Data by repeating input values into output
 
 		for x := 0; x < outxsize; x++ {
 			index := int(math.Floor(float64(x) * xelementsperoutput))
 			outData[outLineNum*outxsize+x] = datain[index]
 		}
+	} else { // Expand Data by interpolating between input values
+		for x := 0; x < outxsize; x++ {
+			outData[outLineNum*outxsize+x] = interpolateAt(datain, float64(x)*xelementsperoutput, interp)
+		}
 	}
 }
 
@@ -450,7 +420,9 @@ func applyCXmode(datain []float64, cxmode string, complexData bool) []float64 {
 	}
 }
 
-func processline(outData []float64, outLineNum int, done chan bool, dataRequest rdsRequest) {
+// getRawLineData reads xsize elements of row starting at xstart and returns their values, with complex data tuned and
+// still interleaved.
+func getRawLineData(dataRequest rdsRequest, row, xstart, xsize int) []float64 {
 	bytesPerAtom, complexFlag := getFileTypeInfo(dataRequest.FileFormat)
 
 	bytesPerElement := bytesPerAtom
@@ -458,10 +430,10 @@ func processline(outData []float64, outLineNum int, done chan bool, dataRequest
 		bytesPerElement = bytesPerElement * 2
 	}
 
-	firstDataByte := float64(dataRequest.Ystart*dataRequest.FileXSize+dataRequest.Xstart) * bytesPerElement
+	firstDataByte := float64(row*dataRequest.FileXSize+xstart) * bytesPerElement
 	firstByteInt := int(math.Floor(firstDataByte))
 
-	bytesLength := float64(dataRequest.Xsize)*bytesPerElement + (firstDataByte - float64(firstByteInt))
+	bytesLength := float64(xsize)*bytesPerElement + (firstDataByte - float64(firstByteInt))
 	bytesLengthInt := int(math.Ceil(bytesLength))
 	filedata, _ := getBytesFromReader(dataRequest.Reader, dataRequest.FileDataOffset+firstByteInt, bytesLengthInt)
 	dataToProcess := convertFileData(filedata, dataRequest.FileFormat)
@@ -477,10 +449,24 @@ func processline(outData []float64, outLineNum int, done chan bool, dataRequest
 		dataToProcess = dataToProcess[dataStartBit : len(dataToProcess)-extraBits]
 	}
 
+	if complexFlag && dataRequest.Tune != 0 {
+		tuneSamples(dataToProcess, row*dataRequest.FileXSize+xstart, dataRequest.Tune, dataRequest.Filexdelta)
+	}
+	return dataToProcess
+}
+
+// getLineData reads xsize elements of row starting at xstart and returns them after applying the cxmode or demodulation, the compare file,
+// the expression and the background.
+func getLineData(dataRequest rdsRequest, row, xstart, xsize int) []float64 {
+	_, complexFlag := getFileTypeInfo(dataRequest.FileFormat)
+
 	var realData []float64
-	if complexFlag {
-		realData = applyCXmode(dataToProcess, dataRequest.Cxmode, true)
+	if complexFlag && dataRequest.Demod != "" {
+		realData = dataRequest.demodLine(row, xstart, xsize)
+	} else if complexFlag {
+		realData = applyCXmode(getRawLineData(dataRequest, row, xstart, xsize), dataRequest.Cxmode, true)
 	} else {
+		dataToProcess := getRawLineData(dataRequest, row, xstart, xsize)
 		if dataRequest.CxmodeSet {
 			realData = applyCXmode(dataToProcess, dataRequest.Cxmode, false)
 		} else {
@@ -488,12 +474,38 @@ func processline(outData []float64, outLineNum int, done chan bool, dataRequest
 		}
 
 	}
+	if dataRequest.Compare != nil {
+		compareData := getLineData(*dataRequest.Compare, row+dataRequest.CompareYOffset, xstart+dataRequest.CompareXOffset, xsize)
+		compareLine(realData, compareData, dataRequest.CompareOp)
+	}
+	if dataRequest.Expression != nil {
+		realData = dataRequest.evaluateExpression(realData, row, xstart, xsize)
+	}
+	if dataRequest.Background != nil {
+		dataRequest.Background.apply(realData, row, xstart)
+	}
+	return realData
+}
 
-	down_sample_line_inx(realData, dataRequest.Outxsize, dataRequest.Transform, outData, outLineNum)
+func processline(outData []float64, outLineNum int, done chan bool, dataRequest rdsRequest) {
+	realData := getLineData(dataRequest, dataRequest.Ystart, dataRequest.Xstart, dataRequest.Xsize)
+
+	if dataRequest.XBinEdges != nil {
+		x0 := dataRequest.Filexstart + dataRequest.Filexdelta*float64(dataRequest.Xstart)
+		copy(outData[outLineNum*dataRequest.Outxsize:], logBinLine(realData, x0, dataRequest.Filexdelta, dataRequest.XBinEdges, dataRequest.Transform))
+	} else {
+		down_sample_line_inx(realData, dataRequest.Outxsize, dataRequest.Transform, dataRequest.Interp, outData, outLineNum)
+	}
 	done <- true
 }
 
 func processRequest(dataRequest rdsRequest) []byte {
+	return createRequestOutput(processRequestData(dataRequest), dataRequest)
+}
+
+// processRequestData reads the selection of a request and thins it to the output size, returning the values before they are converted
+// to the output format.
+func processRequestData(dataRequest rdsRequest) []float64 {
 	var processedData []float64
 
 	var yLinesPerOutput float64 = float64(dataRequest.Ysize) / float64(dataRequest.Outysize)
@@ -502,6 +514,11 @@ func processRequest(dataRequest rdsRequest) []byte {
 	// Loop over the output Y Lines
 	for outputLine := 0; outputLine < dataRequest.Outysize; outputLine++ {
 		//log.Println("Processing Output Line ", outputLine)
+		if yLinesPerOutput <= 1 && dataRequest.Interp != "nearest" { // Y expansion by interpolating between input lines
+			yThinData := interpolateRequestLine(dataRequest, float64(outputLine)*yLinesPerOutput)
+			processedData = append(processedData, yThinData...)
+			continue
+		}
 		// For Each Output Y line Read and process the required lines from the input file
 		var startLine int
 		var endLine int
@@ -572,80 +589,84 @@ func processRequest(dataRequest rdsRequest) []byte {
 		// }
 
 	}
+	return processedData
+}
 
+// createRequestOutput converts the processed values of a request to its mask or output format.
+func createRequestOutput(processedData []float64, dataRequest rdsRequest) []byte {
+	if dataRequest.Mask != "" {
+		return createMaskOutput(processedData, dataRequest)
+	}
+	if dataRequest.OutputFmt == "PNG" {
+		return encodePNG(dataRequest.createColorOutput(processedData), dataRequest.Outxsize, dataRequest.Outysize)
+	}
+	if dataRequest.OutputFmt == "RGBA" {
+		return dataRequest.createColorOutput(processedData)
+	}
 	outData := createOutput(processedData, dataRequest.OutputFmt, dataRequest.Zmin, dataRequest.Zmax, dataRequest.ColorMap)
 	return outData
 }
 
 func processLineRequest(dataRequest rdsRequest, cutType string) []byte {
-	bytesPerAtom, complexFlag := getFileTypeInfo(dataRequest.FileFormat)
-
-	bytesPerElement := bytesPerAtom
-	if complexFlag {
-		bytesPerElement = bytesPerElement * 2
-	}
+	return createLineOutput(filterLine(getLineRequestData(dataRequest, cutType), dataRequest), dataRequest)
+}
 
-	// Get the slice data out of the file. For x the data is continuous, for y cuts, we need to grab one element from each row.
-	filedata := make([]byte, 0, int(math.Max(float64(dataRequest.FileXSize), float64(dataRequest.FileYSize))))
-	var dataToProcess []float64
+// getLineRequestData returns the values of the line of a line request, resampled when the request has a resample ratio and
+// reduced to logarithmically spaced bins when it has bin edges.
+func getLineRequestData(dataRequest rdsRequest, cutType string) []float64 {
+	// Get the slice data out of the file. For x the data is continuous, for y cuts, we need to grab a segment from each row.
+	// When the cut covers more than one row (x cut) or column (y cut) the band is reduced to a single line using the transform.
+	var realData []float64
 	if cutType == "rdsxcut" || cutType == "lds" {
-		firstDataByte := float64(dataRequest.Ystart*dataRequest.FileXSize+dataRequest.Xstart) * bytesPerElement
-		firstByteInt := int(math.Floor(firstDataByte))
-		bytesLength := float64(dataRequest.Xsize)*bytesPerElement + (firstDataByte - float64(firstByteInt))
-		bytesLengthInt := int(math.Ceil(bytesLength))
-		filedata, _ = getBytesFromReader(dataRequest.Reader, dataRequest.FileDataOffset+firstByteInt, bytesLengthInt)
-		dataToProcess = convertFileData(filedata, dataRequest.FileFormat)
-		//If the data is SP then we might have processed a few more bits than we actually needed on both sides, so reassign data_to_process to correctly point to the numbers of interest
-		if bytesPerAtom < 1 {
-			dataStartBit := int(math.Mod(firstDataByte, 1) * 8)
-			dataEndBit := int(math.Mod(bytesLength, 1) * 8)
-			var extraBits int = 0
-			if dataEndBit > 0 {
-				extraBits = 8 - dataEndBit
-			}
-			dataToProcess = dataToProcess[dataStartBit : len(dataToProcess)-extraBits]
+		rows := make([]float64, 0, dataRequest.Xsize*dataRequest.Ysize)
+		for row := dataRequest.Ystart; row < (dataRequest.Ystart + dataRequest.Ysize); row++ {
+			rows = append(rows, getLineData(dataRequest, row, dataRequest.Xstart, dataRequest.Xsize)...)
+		}
+		if dataRequest.Ysize > 1 {
+			realData = downSampleLineInY(rows, dataRequest.Xsize, dataRequest.Transform)
+		} else {
+			realData = rows
 		}
 
 	} else if cutType == "rdsycut" {
 		log.Println("Getting data from file for y cut")
-		if bytesPerAtom < 1 {
-			log.Println("Don't support y cut for SP data")
-			var empty []byte
-			return empty
-		}
+		// getLineData handles the bit offset of the column within each row, so packed bit (SP) files work the same as other formats.
+		realData = make([]float64, dataRequest.Ysize)
 		for row := dataRequest.Ystart; row < (dataRequest.Ystart + dataRequest.Ysize); row++ {
-			dataByte := float64(row*dataRequest.FileXSize+dataRequest.Xstart) * bytesPerElement
-			dataByteInt := int(math.Floor(dataByte))
-			data, _ := getBytesFromReader(dataRequest.Reader, dataRequest.FileDataOffset+dataByteInt, int(bytesPerElement))
-			filedata = append(filedata, data...)
+			columns := getLineData(dataRequest, row, dataRequest.Xstart, dataRequest.Xsize)
+			realData[row-dataRequest.Ystart] = doTransform(columns, dataRequest.Transform)
 		}
-		dataToProcess = convertFileData(filedata, dataRequest.FileFormat)
-		log.Println("Got data from file for y cut", len(dataToProcess))
+		log.Println("Got data from file for y cut", len(realData))
 
 	}
-
-	var realData []float64
-	if complexFlag {
-		realData = applyCXmode(dataToProcess, dataRequest.Cxmode, true)
-	} else {
-		if dataRequest.CxmodeSet {
-			realData = applyCXmode(dataToProcess, dataRequest.Cxmode, false)
-		} else {
-			realData = dataToProcess
-		}
-
+	dx := dataRequest.Filexdelta
+	if dataRequest.ResampleUp > 0 {
+		realData = polyphaseResample(realData, dataRequest.ResampleUp, dataRequest.ResampleDown, dataRequest.FilterTaps, dataRequest.FilterWindow)
+		dx = dx * float64(dataRequest.ResampleDown) / float64(dataRequest.ResampleUp)
+	}
+	if dataRequest.XBinEdges != nil && cutType != "rdsycut" {
+		realData = logBinLine(realData, dataRequest.Filexstart+dataRequest.Filexdelta*float64(dataRequest.Xstart), dx, dataRequest.XBinEdges, dataRequest.Transform)
 	}
 
+	return realData
+}
+
+// createLineOutput converts a line of values into x and z pixel values for a plot of outxsize by outzsize.
+func createLineOutput(realData []float64, dataRequest rdsRequest) []byte {
 	//Output data will be x and z data of variable length up to Xsize. Allocation with size 0 but with a capacity. The x arrary will be used for both piece of data at the end.
 	xThinData := make([]int16, 0, len(realData)*2)
 	zThinData := make([]int16, 0, len(realData))
 
 	xratio := float64(len(realData)) / float64(dataRequest.Outxsize-1)
+	if xratio < 1 && dataRequest.Interp != "nearest" { // Fill in every output x pixel by interpolating between input values
+		realData = expandLine(realData, xratio, dataRequest.Outxsize, dataRequest.Interp)
+		xratio = 1
+	}
 	zratio := float64((dataRequest.Zmax - dataRequest.Zmin)) / float64(dataRequest.Outzsize-1)
 	for x := 0; x < len(realData); x++ {
 
 		xpixel := int16(math.Round(float64(x) / xratio))
-		zpixel := int16(math.Round((dataRequest.Zmax - float64(realData[x])) / zratio))
+		zpixel := int16(math.Round((dataRequest.Zmax - nanToZero(realData[x])) / zratio)) // A bin of only NaN is drawn at 0
 
 		// If the thinned array does not already have a value in it then append this value.
 		if len(xThinData) >= 1 {
@@ -765,6 +786,104 @@ func (request *rdsRequest) getQueryParams(r *http.Request) {
 	if !ok {
 		request.Transform = "first"
 	}
+	request.Interp, ok = getURLQueryParamString(r, "interp")
+	if !ok {
+		request.Interp = "nearest"
+	}
+	if request.Interp != "nearest" && request.Interp != "linear" && request.Interp != "bilinear" && request.Interp != "cubic" {
+		log.Println("Unknown interp", request.Interp, "using nearest")
+		request.Interp = "nearest"
+	}
+	request.Filter, ok = getURLQueryParamString(r, "filter")
+	if !ok {
+		request.Filter = "none"
+	}
+	if request.Filter != "none" && request.Filter != "fir" {
+		log.Println("Unknown filter", request.Filter, "using none")
+		request.Filter = "none"
+	}
+	request.FilterTaps, ok = getURLQueryParamInt(r, "filtertaps")
+	if !ok || request.FilterTaps < 1 {
+		request.FilterTaps = 0 // Chosen from the decimation
+	}
+	if request.FilterTaps > maxFilterTaps {
+		log.Println("filtertaps must be at most", maxFilterTaps, "got:", request.FilterTaps, "using", maxFilterTaps)
+		request.FilterTaps = maxFilterTaps
+	}
+	request.FilterWindow, ok = getURLQueryParamString(r, "filterwindow")
+	if !ok {
+		request.FilterWindow = "hamming"
+	}
+	if request.FilterWindow != "hamming" && request.FilterWindow != "hann" && request.FilterWindow != "blackman" && request.FilterWindow != "rectangular" {
+		log.Println("Unknown filterwindow", request.FilterWindow, "using hamming")
+		request.FilterWindow = "hamming"
+	}
+	request.Tune, ok = getURLQueryParamFloat(r, "tune")
+	if !ok {
+		request.Tune = 0
+	}
+	request.Demod, _ = getURLQueryParamString(r, "demod")
+	if request.Demod != "" && request.Demod != "am" && request.Demod != "fm" && request.Demod != "pm" {
+		log.Println("Unknown demod", request.Demod, "using none")
+		request.Demod = ""
+	}
+	request.Bandwidth, ok = getURLQueryParamFloat(r, "bandwidth")
+	if !ok || request.Bandwidth < 0 {
+		request.Bandwidth = 0 // No filter
+	}
+	request.Baseline, ok = getURLQueryParamString(r, "baseline")
+	if !ok {
+		request.Baseline = "none"
+	}
+	if request.Baseline != "none" && request.Baseline != "mean" && request.Baseline != "median" {
+		log.Println("Unknown baseline", request.Baseline, "using none")
+		request.Baseline = "none"
+	}
+	request.BaselineOp, ok = getURLQueryParamString(r, "baselineop")
+	if !ok {
+		request.BaselineOp = "subtract"
+	}
+	if request.BaselineOp != "subtract" && request.BaselineOp != "divide" {
+		log.Println("Unknown baselineop", request.BaselineOp, "using subtract")
+		request.BaselineOp = "subtract"
+	}
+	request.BaselineRows, _ = getURLQueryParamString(r, "baselinerows")
+	request.RowNorm, ok = getURLQueryParamString(r, "rownorm")
+	if !ok {
+		request.RowNorm = "none"
+	}
+	if request.RowNorm != "none" && request.RowNorm != "mean" && request.RowNorm != "zscore" {
+		log.Println("Unknown rownorm", request.RowNorm, "using none")
+		request.RowNorm = "none"
+	}
+	request.CompareSource, _ = getURLQueryParamString(r, "compare")
+	request.CompareOp, ok = getURLQueryParamString(r, "compareop")
+	if !ok {
+		request.CompareOp = "diff"
+	}
+	if request.CompareOp != "diff" && request.CompareOp != "ratio" && request.CompareOp != "dbratio" {
+		log.Println("Unknown compareop", request.CompareOp, "using diff")
+		request.CompareOp = "diff"
+	}
+	request.CompareXOffset, ok = getURLQueryParamInt(r, "comparexoffset")
+	if !ok {
+		request.CompareXOffset = 0
+	}
+	request.CompareYOffset, ok = getURLQueryParamInt(r, "compareyoffset")
+	if !ok {
+		request.CompareYOffset = 0
+	}
+	request.Resample, _ = getURLQueryParamString(r, "resample")
+	request.XScale, ok = getURLQueryParamString(r, "xscale")
+	if !ok {
+		request.XScale = "linear"
+	}
+	if request.XScale != "linear" && request.XScale != "log" {
+		log.Println("Unknown xscale", request.XScale, "using linear")
+		request.XScale = "linear"
+	}
+	request.Expr, _ = getURLQueryParamString(r, "expr")
+	request.ExprFiles = r.URL.Query()["exprfile"]
 	request.SubsizeSet = true
 	request.Subsize, ok = getURLQueryParamInt(r, "subsize")
 	if !ok {
@@ -792,11 +911,65 @@ func (request *rdsRequest) getQueryParams(r *http.Request) {
 		request.Zmax = 0
 	}
 	request.Zset = (zmaxSet && zminSet)
+	request.Autoscale, ok = getURLQueryParamString(r, "autoscale")
+	if !ok {
+		request.Autoscale = "minmax"
+	}
+	if _, ok = parseAutoscale(request.Autoscale); !ok {
+		log.Println("Unknown autoscale", request.Autoscale, "using minmax")
+		request.Autoscale = "minmax"
+	}
+	if request.Zset { // An explicit zmin and zmax take precedence over autoscale
+		request.Autoscale = ""
+	}
 	request.ColorMap, ok = getURLQueryParamString(r, "colormap")
 	if !ok {
 		log.Println("colorMap Not Specified.Defaulting to RampColormap")
 		request.ColorMap = "RampColormap"
 	}
+	request.CScale, ok = getURLQueryParamString(r, "cscale")
+	if !ok {
+		request.CScale = "linear"
+	}
+	if _, ok = parseColorScale(request.CScale); !ok {
+		log.Println("Unknown cscale", request.CScale, "using linear")
+		request.CScale = "linear"
+	}
+	reverse, _ := getURLQueryParamString(r, "reverse")
+	request.ReverseColors = reverse == "true"
+	request.NumColors, ok = getURLQueryParamInt(r, "numcolors")
+	if !ok {
+		request.NumColors = configNumColors()
+	}
+	if request.NumColors < minNumColors || request.NumColors > maxNumColors {
+		log.Println("numcolors must be from", minNumColors, "to", maxNumColors, "got:", request.NumColors, "using", configNumColors())
+		request.NumColors = configNumColors()
+	}
+	request.NaNColor = getOutputColorParam(r, "nancolor")
+	request.UnderColor = getOutputColorParam(r, "undercolor")
+	request.OverColor = getOutputColorParam(r, "overcolor")
+	request.Alpha, ok = getURLQueryParamString(r, "alpha")
+	if !ok {
+		request.Alpha = "opaque"
+	}
+	if request.Alpha != "opaque" && request.Alpha != "intensity" {
+		log.Println("Unknown alpha", request.Alpha, "using opaque")
+		request.Alpha = "opaque"
+	}
+	request.Mask, _ = getURLQueryParamString(r, "mask")
+	if _, ok = parseMask(request.Mask); request.Mask != "" && !ok {
+		log.Println("Unknown mask", request.Mask, "using none")
+		request.Mask = ""
+	}
+	request.MaskColor = defaultMaskColor
+	maskColor, maskColorSet := getURLQueryParamString(r, "maskcolor")
+	if maskColorSet {
+		request.MaskColor, ok = parseMaskColor(maskColor)
+		if !ok {
+			log.Println("Invalid maskcolor", maskColor, "using red")
+			request.MaskColor = defaultMaskColor
+		}
+	}
 	request.OutputFmt, ok = getURLQueryParamString(r, "outfmt")
 	if !ok {
 		log.Println("Outformat Not Specified. Setting Equal to Input Format")
@@ -808,8 +981,22 @@ func (request *rdsRequest) getQueryParams(r *http.Request) {
 func (request *rdsRequest) findZminMax() {
 	start := time.Now()
 	zminmaxtileMutex.Lock()
-	zminmax, ok := zminzmaxFileMap[request.FileName+request.Cxmode]
-	if ok {
+	mode, _ := parseAutoscale(request.Autoscale)
+	key := request.rangeIndexKey()
+	zminmax, ok := zminzmaxFileMap[key]
+	if !ok && *useCache { // Use the exact range from the index if it has been built, otherwise have it built in the background
+		index, found := loadRangeIndex(key)
+		if found {
+			zminmax = Zminzmax{index.Min, index.Max}
+			zminzmaxFileMap[key] = zminmax
+			ok = true
+		} else {
+			queueRangeIndex(*request)
+		}
+	}
+	if mode.Kind != "" && mode.Kind != "minmax" {
+		request.findAutoscaleZminMax(mode)
+	} else if ok {
 		request.Zmin = zminmax.Zmin
 		request.Zmax = zminmax.Zmax
 	} else {
@@ -821,6 +1008,7 @@ func (request *rdsRequest) findZminMax() {
 		zminmaxRequest.Outysize = 1
 		zminmaxRequest.Outxsize = 1
 		zminmaxRequest.OutputFmt = "SD"
+		zminmaxRequest.XBinEdges = nil
 		bytesPerAtom, complexFlag := getFileTypeInfo(request.FileFormat)
 		bytesPerElement := bytesPerAtom
 		if complexFlag {
@@ -842,9 +1030,9 @@ func (request *rdsRequest) findZminMax() {
 			for i := 0; i < request.FileYSize*2; i++ {
 				<-done
 			}
-			request.Zmin = floats.Min(min)
-			request.Zmax = floats.Max(max)
-			zminzmaxFileMap[request.FileName+request.Cxmode] = Zminzmax{request.Zmin, request.Zmax}
+			request.Zmin = doTransform(min, "min")
+			request.Zmax = doTransform(max, "max")
+			zminzmaxFileMap[key] = Zminzmax{request.Zmin, request.Zmax}
 		} else if request.FileYSize == 1 { //If the file is large but only has one line then we need to break it into section in the x direction.
 			log.Println("Computing Zmax/Zmin on section of 1D file, not previously computed")
 			numSubSections := 4
@@ -853,7 +1041,7 @@ func (request *rdsRequest) findZminMax() {
 			done := make(chan bool, 1)
 			spaceBytes := (float64(request.FileXSize) * bytesPerElement) - float64(configuration.MaxBytesZminZmax)
 			elementsPerSpace := int((spaceBytes / bytesPerElement)) / (numSubSections - 1)
-			elementsPerSection := int(configuration.MaxBytesZminZmax / numSubSections)
+			elementsPerSection := int(float64(configuration.MaxBytesZminZmax)/bytesPerElement) / numSubSections
 
 			zminmaxRequest.Xsize = elementsPerSection
 			// First section of the file
@@ -881,9 +1069,9 @@ func (request *rdsRequest) findZminMax() {
 			for i := 0; i < numSubSections*2; i++ {
 				<-done
 			}
-			request.Zmin = floats.Min(min)
-			request.Zmax = floats.Max(max)
-			zminzmaxFileMap[request.FileName+request.Cxmode] = Zminzmax{request.Zmin, request.Zmax}
+			request.Zmin = doTransform(min, "min")
+			request.Zmax = doTransform(max, "max")
+			zminzmaxFileMap[key] = Zminzmax{request.Zmin, request.Zmax}
 
 		} else { // If file is large and has multiple lines then check the first, last, and a number of middles lines
 			numMiddlesLines := int(math.Max(float64((configuration.MaxBytesZminZmax/request.FileXSize)-2), 0))
@@ -922,9 +1110,9 @@ func (request *rdsRequest) findZminMax() {
 			for i := 0; i < numRequested; i++ {
 				<-done
 			}
-			request.Zmin = floats.Min(min)
-			request.Zmax = floats.Max(max)
-			zminzmaxFileMap[request.FileName+request.Cxmode] = Zminzmax{request.Zmin, request.Zmax}
+			request.Zmin = doTransform(min, "min")
+			request.Zmax = doTransform(max, "max")
+			zminzmaxFileMap[key] = Zminzmax{request.Zmin, request.Zmax}
 
 		}
 		elapsed := time.Since(start)
@@ -982,6 +1170,11 @@ func (s *rdsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	rdsRequest.getQueryParams(r)
+	if _, ok = lookupColorMap(rdsRequest.ColorMap); !ok {
+		log.Println("Unknown colormap", rdsRequest.ColorMap)
+		w.WriteHeader(400)
+		return
+	}
 
 	rdsRequest.computeRequestSizes()
 
@@ -994,7 +1187,7 @@ func (s *rdsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	log.Println("RDS Request params xstart, ystart, xsize, ysize, outxsize, outysize:", rdsRequest.Xstart, rdsRequest.Ystart, rdsRequest.Xsize, rdsRequest.Ysize, rdsRequest.Outxsize, rdsRequest.Outysize)
 
 	start := time.Now()
-	cacheFileName := urlToCacheFileName(r.URL.Path, r.URL.RawQuery)
+	cacheFileName := urlToCacheFileName(r.URL.Path, r.URL.RawQuery+colorMapVersion(rdsRequest.ColorMap))
 	// Check if request has been previously processed and is in cache. If not process Request.
 	if *useCache {
 		data, inCache = getDataFromCache(cacheFileName, "outputFiles/")
@@ -1005,6 +1198,7 @@ func (s *rdsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if !inCache { // If the output is not already in the cache then read the data file and do the processing.
 		log.Println("RDS Request not in Cache, computing result")
 		rdsRequest.Reader, rdsRequest.FileName, ok = openDataSource(r.URL.Path, 9)
+		rdsRequest.SourcePath = dataSourcePath(r.URL.Path, 9)
 		if !ok {
 			w.WriteHeader(400)
 			return
@@ -1055,9 +1249,28 @@ func (s *rdsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		if rdsRequest.XScale == "log" && !rdsRequest.setLogBinEdges() {
+			w.WriteHeader(400)
+			return
+		}
+
+		if !rdsRequest.openCompare(false) {
+			w.WriteHeader(400)
+			return
+		}
+		if exprError := rdsRequest.openExpression(false); exprError != nil {
+			log.Println(exprError)
+			w.WriteHeader(400)
+			w.Write([]byte(exprError.Error()))
+			return
+		}
+		rdsRequest.loadBackground()
+
 		//If Zmin and Zmax were not explitily given then compute
-		if !rdsRequest.Zset && rdsRequest.OutputFmt == "RGBA" {
+		if !rdsRequest.Zset && (rdsRequest.OutputFmt == "RGBA" || rdsRequest.OutputFmt == "PNG") && rdsRequest.Mask == "" {
 			rdsRequest.findZminMax()
+		} else {
+			rdsRequest.Autoscale = "" // Numeric output and masks are not scaled so no autoscale was applied
 		}
 
 		data = processRequest(rdsRequest)
@@ -1079,6 +1292,9 @@ func (s *rdsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		fileMData.Ysize = rdsRequest.Ysize
 		fileMData.Zmin = rdsRequest.Zmin
 		fileMData.Zmax = rdsRequest.Zmax
+		fileMData.Autoscale = rdsRequest.Autoscale
+		fileMData.XBinEdges = rdsRequest.XBinEdges
+		fileMData.Mask = rdsRequest.Mask
 
 		//var marshalError error
 		fileMDataJSON, marshalError := json.Marshal(fileMData)
@@ -1114,11 +1330,23 @@ func (s *rdsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	outysizeStr := strconv.Itoa(fileMDataCache.Outysize)
 
 	w.Header().Add("Access-Control-Allow-Origin", "*")
-	w.Header().Add("Access-Control-Expose-Headers", "outxsize,outysize,zmin,zmax,filexstart,filexdelta,fileystart,fileydelta,xmin,xmax,ymin,ymax")
+	w.Header().Add("Access-Control-Expose-Headers", "outxsize,outysize,zmin,zmax,filexstart,filexdelta,fileystart,fileydelta,xmin,xmax,ymin,ymax,autoscale,xscale,xbinlow,xbinhigh,mask")
 	w.Header().Add("outxsize", outxsizeStr)
 	w.Header().Add("outysize", outysizeStr)
 	w.Header().Add("zmin", fmt.Sprintf("%f", fileMDataCache.Zmin))
 	w.Header().Add("zmax", fmt.Sprintf("%f", fileMDataCache.Zmax))
+	if fileMDataCache.Autoscale != "" {
+		w.Header().Add("autoscale", fileMDataCache.Autoscale)
+	}
+	if fileMDataCache.Mask != "" {
+		w.Header().Add("mask", fileMDataCache.Mask)
+	}
+	if rdsRequest.OutputFmt == "PNG" {
+		w.Header().Add("Content-Type", "image/png")
+	}
+	if fileMDataCache.XBinEdges != nil {
+		addLogBinHeaders(w.Header(), fileMDataCache.XBinEdges)
+	}
 	w.Header().Add("filexstart", fmt.Sprintf("%f", fileMDataCache.Filexstart))
 	w.Header().Add("filexdelta", fmt.Sprintf("%f", fileMDataCache.Filexdelta))
 	w.Header().Add("fileystart", fmt.Sprintf("%f", fileMDataCache.Fileystart))
@@ -1143,28 +1371,28 @@ func (s *rdsTileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	// Get URL Parameters
 	//url - /sds/rdstile/tileXSize/tileYSize/decxMode/decYMode/tileX/tileY/locationName
-	allowedTileSizes := [5]int{100, 200, 300, 400, 500}
+	minTileSize, maxTileSize, maxDecimation := tileLimits()
 	tileRequest.TileXSize, ok = getURLArgumentInt(r.URL.Path, 3)
-	if !ok || !intInSlice(tileRequest.TileXSize, allowedTileSizes[:]) {
-		log.Println("tileXSize must be in one of: 100,200,300,400,500", tileRequest.TileXSize)
+	if !ok || tileRequest.TileXSize < minTileSize || tileRequest.TileXSize > maxTileSize {
+		log.Println("tileXSize must be from", minTileSize, "to", maxTileSize, "got:", tileRequest.TileXSize)
 		w.WriteHeader(400)
 		return
 	}
 	tileRequest.TileYSize, ok = getURLArgumentInt(r.URL.Path, 4)
-	if !ok || !intInSlice(tileRequest.TileYSize, allowedTileSizes[:]) {
-		log.Println("tileYSize must be in one of: 100,200,300,400,500", tileRequest.TileYSize)
+	if !ok || tileRequest.TileYSize < minTileSize || tileRequest.TileYSize > maxTileSize {
+		log.Println("tileYSize must be from", minTileSize, "to", maxTileSize, "got:", tileRequest.TileYSize)
 		w.WriteHeader(400)
 		return
 	}
-	tileRequest.DecXMode, ok = getURLArgumentInt(r.URL.Path, 5)
-	if !ok || tileRequest.DecXMode < 0 || tileRequest.DecXMode > 10 {
-		log.Println("decXMode Bad or out of range 0 to 10. got:", tileRequest.DecXMode)
+	tileRequest.DecX, ok = parseDecimation(strings.Split(r.URL.Path, "/")[5], maxDecimation)
+	if !ok {
+		log.Println("decXMode must be a mode from 1 to 10 or x<decimation> up to", maxDecimation, "got:", strings.Split(r.URL.Path, "/")[5])
 		w.WriteHeader(400)
 		return
 	}
-	tileRequest.DecYMode, ok = getURLArgumentInt(r.URL.Path, 6)
-	if !ok || tileRequest.DecYMode < 0 || tileRequest.DecYMode > 10 {
-		log.Println("decYMode Bad or out of range 0 to 10. got:", tileRequest.DecYMode)
+	tileRequest.DecY, ok = parseDecimation(strings.Split(r.URL.Path, "/")[6], maxDecimation)
+	if !ok {
+		log.Println("decYMode must be a mode from 1 to 10 or x<decimation> up to", maxDecimation, "got:", strings.Split(r.URL.Path, "/")[6])
 		w.WriteHeader(400)
 		return
 	}
@@ -1182,6 +1410,19 @@ func (s *rdsTileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	tileRequest.getQueryParams(r)
+	if _, ok = lookupColorMap(tileRequest.ColorMap); !ok {
+		log.Println("Unknown colormap", tileRequest.ColorMap)
+		w.WriteHeader(400)
+		return
+	}
+	zscale, ok := getURLQueryParamString(r, "zscale")
+	if !ok {
+		zscale = "global"
+	}
+	if zscale != "global" && zscale != "tile" && zscale != "viewport" {
+		log.Println("Unknown zscale", zscale, "using global")
+		zscale = "global"
+	}
 
 	tileRequest.computeTileSizes()
 
@@ -1194,7 +1435,7 @@ func (s *rdsTileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	log.Println("Tile Mode: params xstart, ystart, xsize, ysize, outxsize, outysize:", tileRequest.Xstart, tileRequest.Ystart, tileRequest.Xsize, tileRequest.Ysize, tileRequest.Outxsize, tileRequest.Outysize)
 
 	start := time.Now()
-	cacheFileName := urlToCacheFileName(r.URL.Path, r.URL.RawQuery)
+	cacheFileName := tileRequest.tileCacheFileName(r)
 	// Check if request has been previously processed and is in cache. If not process Request.
 	if *useCache {
 		data, inCache = getDataFromCache(cacheFileName, "outputFiles/")
@@ -1205,6 +1446,7 @@ func (s *rdsTileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if !inCache { // If the output is not already in the cache then read the data file and do the processing.
 		log.Println("RDS Request not in Cache, computing result")
 		tileRequest.Reader, tileRequest.FileName, ok = openDataSource(r.URL.Path, 9)
+		tileRequest.SourcePath = dataSourcePath(r.URL.Path, 9)
 		if !ok {
 			w.WriteHeader(400)
 			return
@@ -1238,11 +1480,11 @@ func (s *rdsTileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 		if (tileRequest.Xstart + tileRequest.Xsize) > tileRequest.FileXSize {
 			tileRequest.Xsize = tileRequest.FileXSize - tileRequest.Xstart
-			tileRequest.Outxsize = tileRequest.Xsize / tileRequest.DecX
+			tileRequest.Outxsize = int(math.Ceil(float64(tileRequest.Xsize) / float64(tileRequest.DecX)))
 		}
 		if (tileRequest.Ystart + tileRequest.Ysize) > tileRequest.FileYSize {
 			tileRequest.Ysize = tileRequest.FileYSize - tileRequest.Ystart
-			tileRequest.Outysize = tileRequest.Ysize / tileRequest.DecY
+			tileRequest.Outysize = int(math.Ceil(float64(tileRequest.Ysize) / float64(tileRequest.DecY)))
 		}
 		if tileRequest.Xsize > tileRequest.FileXSize {
 			log.Println("Invalid Request. Requested X size greater than file X size")
@@ -1250,12 +1492,48 @@ func (s *rdsTileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		if !tileRequest.openCompare(false) {
+			w.WriteHeader(400)
+			return
+		}
+		if exprError := tileRequest.openExpression(false); exprError != nil {
+			log.Println(exprError)
+			w.WriteHeader(400)
+			w.Write([]byte(exprError.Error()))
+			return
+		}
+		tileRequest.loadBackground()
+
+		var viewport tileViewport
+		if zscale == "viewport" {
+			tilesX, tilesY := tileRequest.tileGrid()
+			viewportParam, _ := getURLQueryParamString(r, "viewport")
+			viewport, ok = parseViewport(viewportParam, tilesX, tilesY, tileRequest.TileXSize*tileRequest.TileYSize)
+			if !ok {
+				log.Println("zscale=viewport needs a viewport of firstTileX:firstTileY:lastTileX:lastTileY within", tilesX, "by", tilesY, "tiles and at most",
+					maxViewportTiles, "tiles and", maxViewportElements, "elements. got:", viewportParam)
+				w.WriteHeader(400)
+				return
+			}
+		}
+
 		//If Zmin and Zmax were not explitily given then compute
-		if !tileRequest.Zset {
-			tileRequest.findZminMax()
+		if !tileRequest.Zset && tileRequest.Mask == "" {
+			if zscale == "global" {
+				tileRequest.findZminMax()
+			}
+		} else {
+			tileRequest.Autoscale = ""
+			zscale = ""
 		}
 		// Now that all the parameters have been computed as needed, perform the actual request for data transformation.
-		data = processRequest(tileRequest)
+		processedData, pyramidLevel := tileRequestData(tileRequest)
+		if zscale == "tile" {
+			tileRequest.setValuesZminMax(processedData)
+		} else if zscale == "viewport" {
+			tileRequest.findViewportZminMax(viewport)
+		}
+		data = createRequestOutput(processedData, tileRequest)
 		if *useCache {
 			go putItemInCache(cacheFileName, "outputFiles/", data)
 		}
@@ -1274,6 +1552,13 @@ func (s *rdsTileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		fileMData.Ysize = tileRequest.Ysize
 		fileMData.Zmin = tileRequest.Zmin
 		fileMData.Zmax = tileRequest.Zmax
+		fileMData.Autoscale = tileRequest.Autoscale
+		fileMData.Mask = tileRequest.Mask
+		fileMData.DecX = tileRequest.DecX
+		fileMData.DecY = tileRequest.DecY
+		fileMData.TilesX, fileMData.TilesY = tileRequest.tileGrid()
+		fileMData.PyramidLevel = pyramidLevel
+		fileMData.ZScale = zscale
 
 		//var marshalError error
 		fileMDataJSON, marshalError := json.Marshal(fileMData)
@@ -1312,11 +1597,30 @@ func (s *rdsTileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	outysizeStr := strconv.Itoa(fileMDataCache.Outysize)
 
 	w.Header().Add("Access-Control-Allow-Origin", "*")
-	w.Header().Add("Access-Control-Expose-Headers", "outxsize,outysize,zmin,zmax,filexstart,filexdelta,fileystart,fileydelta,xmin,xmax,ymin,ymax")
+	w.Header().Add("Access-Control-Expose-Headers", "outxsize,outysize,zmin,zmax,filexstart,filexdelta,fileystart,fileydelta,xmin,xmax,ymin,ymax,autoscale,zscale,mask,decx,decy,tilesx,tilesy,pyramidlevel")
 	w.Header().Add("outxsize", outxsizeStr)
 	w.Header().Add("outysize", outysizeStr)
 	w.Header().Add("zmin", fmt.Sprintf("%f", fileMDataCache.Zmin))
 	w.Header().Add("zmax", fmt.Sprintf("%f", fileMDataCache.Zmax))
+	if fileMDataCache.Autoscale != "" {
+		w.Header().Add("autoscale", fileMDataCache.Autoscale)
+	}
+	if fileMDataCache.Mask != "" {
+		w.Header().Add("mask", fileMDataCache.Mask)
+	}
+	w.Header().Add("decx", strconv.Itoa(fileMDataCache.DecX))
+	w.Header().Add("decy", strconv.Itoa(fileMDataCache.DecY))
+	w.Header().Add("tilesx", strconv.Itoa(fileMDataCache.TilesX))
+	w.Header().Add("tilesy", strconv.Itoa(fileMDataCache.TilesY))
+	if fileMDataCache.ZScale != "" {
+		w.Header().Add("zscale", fileMDataCache.ZScale)
+	}
+	if fileMDataCache.PyramidLevel > 0 {
+		w.Header().Add("pyramidlevel", strconv.Itoa(fileMDataCache.PyramidLevel))
+	}
+	if tileRequest.OutputFmt == "PNG" {
+		w.Header().Add("Content-Type", "image/png")
+	}
 	w.Header().Add("filexstart", fmt.Sprintf("%f", fileMDataCache.Filexstart))
 	w.Header().Add("filexdelta", fmt.Sprintf("%f", fileMDataCache.Filexdelta))
 	w.Header().Add("fileystart", fmt.Sprintf("%f", fileMDataCache.Fileystart))
@@ -1395,6 +1699,7 @@ func (s *ldsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if !inCache { // If the output is not already in the cache then read the data file and do the processing.
 		log.Println("RDS Request not in Cache, computing result")
 		rdsRequest.Reader, rdsRequest.FileName, ok = openDataSource(r.URL.Path, 7)
+		rdsRequest.SourcePath = dataSourcePath(r.URL.Path, 7)
 		if !ok {
 			w.WriteHeader(400)
 			return
@@ -1408,6 +1713,9 @@ func (s *ldsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 			rdsRequest.FileXSize = int(float64(rdsRequest.FileDataSize) / bytesPerAtomMap[string(rdsRequest.FileFormat[1])])
+			if string(rdsRequest.FileFormat[0]) == "C" {
+				rdsRequest.FileXSize = rdsRequest.FileXSize / 2
+			}
 			rdsRequest.FileYSize = 1
 		} else {
 			log.Println("Invalid File Type")
@@ -1431,12 +1739,55 @@ func (s *ldsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		//If Zmin and Zmax were not explitily given then compute
-		if !rdsRequest.Zset {
-			rdsRequest.findZminMax()
+		if rdsRequest.Resample != "" {
+			rdsRequest.ResampleUp, rdsRequest.ResampleDown, ok = parseResample(rdsRequest.Resample, rdsRequest.Filexdelta)
+			if !ok {
+				log.Println("resample must be up/down or an xdelta, within a factor of", maxResampleFactor, "of the file. got:", rdsRequest.Resample)
+				w.WriteHeader(400)
+				return
+			}
+			if resampleLength(rdsRequest.Xsize, rdsRequest.ResampleUp, rdsRequest.ResampleDown) > maxResampledSamples {
+				log.Println("Invalid Request. Resampling would give more than", maxResampledSamples, "samples")
+				w.WriteHeader(400)
+				return
+			}
+		}
+
+		if rdsRequest.XScale == "log" && !rdsRequest.setLogBinEdges() {
+			w.WriteHeader(400)
+			return
+		}
+
+		if !rdsRequest.openCompare(true) {
+			w.WriteHeader(400)
+			return
 		}
+		if exprError := rdsRequest.openExpression(true); exprError != nil {
+			log.Println(exprError)
+			w.WriteHeader(400)
+			w.Write([]byte(exprError.Error()))
+			return
+		}
+
+		// values=true gives the values of the line in a numeric output format rather than the pixels of a plot of it
+		var numSamples int
+		if valuesParam, _ := getURLQueryParamString(r, "values"); valuesParam == "true" {
+			outputFmt := rdsRequest.OutputFmt
+			if outputFmt != "SB" && outputFmt != "SI" && outputFmt != "SL" && outputFmt != "SF" && outputFmt != "SD" {
+				log.Println("values needs outfmt SB, SI, SL, SF or SD. got:", outputFmt, "using SF")
+				outputFmt = "SF"
+			}
+			values := getLineRequestData(rdsRequest, "lds")
+			numSamples = len(values)
+			data = createOutput(values, outputFmt, 0, 0, "")
+		} else {
+			//If Zmin and Zmax were not explitily given then compute
+			if !rdsRequest.Zset {
+				rdsRequest.findZminMax()
+			}
 
-		data = processLineRequest(rdsRequest, "lds")
+			data = processLineRequest(rdsRequest, "lds")
+		}
 
 		if *useCache {
 			go putItemInCache(cacheFileName, "outputFiles/", data)
@@ -1457,6 +1808,11 @@ func (s *ldsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		fileMData.Ysize = rdsRequest.Ysize
 		fileMData.Zmin = rdsRequest.Zmin
 		fileMData.Zmax = rdsRequest.Zmax
+		fileMData.Autoscale = rdsRequest.Autoscale
+		fileMData.XBinEdges = rdsRequest.XBinEdges
+		fileMData.NumSamples = numSamples
+		fileMData.ResampleUp = rdsRequest.ResampleUp
+		fileMData.ResampleDown = rdsRequest.ResampleDown
 
 		//var marshalError error
 		fileMDataJSON, marshalError := json.Marshal(fileMData)
@@ -1491,14 +1847,29 @@ func (s *ldsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	outzsizeStr := strconv.Itoa(fileMDataCache.Outzsize)
 
 	w.Header().Add("Access-Control-Allow-Origin", "*")
-	w.Header().Add("Access-Control-Expose-Headers", "outxsize,outysize,zmin,zmax,filexstart,filexdelta,fileystart,fileydelta,xmin,xmax,ymin,ymax")
+	w.Header().Add("Access-Control-Expose-Headers", "outxsize,outysize,zmin,zmax,filexstart,filexdelta,fileystart,fileydelta,xmin,xmax,ymin,ymax,autoscale,xscale,xbinlow,xbinhigh,resample,numsamples")
 	w.Header().Add("outxsize", outxsizeStr)
 	w.Header().Add("outysize", outysizeStr)
 	w.Header().Add("outzsize", outzsizeStr)
 	w.Header().Add("zmin", fmt.Sprintf("%f", fileMDataCache.Zmin))
 	w.Header().Add("zmax", fmt.Sprintf("%f", fileMDataCache.Zmax))
+	if fileMDataCache.Autoscale != "" {
+		w.Header().Add("autoscale", fileMDataCache.Autoscale)
+	}
+	if fileMDataCache.NumSamples > 0 {
+		w.Header().Add("numsamples", strconv.Itoa(fileMDataCache.NumSamples))
+	}
+	// The line is spaced by the resampled xdelta, over the same x range as the selection
+	xdelta := fileMDataCache.Filexdelta
+	if fileMDataCache.ResampleUp > 0 {
+		w.Header().Add("resample", fmt.Sprintf("%d/%d", fileMDataCache.ResampleUp, fileMDataCache.ResampleDown))
+		xdelta = xdelta * float64(fileMDataCache.ResampleDown) / float64(fileMDataCache.ResampleUp)
+	}
+	if fileMDataCache.XBinEdges != nil {
+		addLogBinHeaders(w.Header(), fileMDataCache.XBinEdges)
+	}
 	w.Header().Add("filexstart", fmt.Sprintf("%f", fileMDataCache.Filexstart))
-	w.Header().Add("filexdelta", fmt.Sprintf("%f", fileMDataCache.Filexdelta))
+	w.Header().Add("filexdelta", fmt.Sprintf("%f", xdelta))
 	w.Header().Add("fileystart", fmt.Sprintf("%f", fileMDataCache.Fileystart))
 	w.Header().Add("fileydelta", fmt.Sprintf("%f", fileMDataCache.Fileydelta))
 	w.Header().Add("xmin", fmt.Sprintf("%f", fileMDataCache.Filexstart+fileMDataCache.Filexdelta*float64(fileMDataCache.Xstart)))
@@ -1570,20 +1941,6 @@ func (s *rdsxyCutServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if cutType == "rdsxcut" {
-		if rdsRequest.Ysize > 1 {
-			log.Println("Currently only support cut of one y line. ysize:", rdsRequest.Ysize)
-			w.WriteHeader(400)
-			return
-		}
-	} else if cutType == "rdsycut" {
-		if rdsRequest.Xsize > 1 {
-			log.Println("Currently only support cut of one x line. xsize:", rdsRequest.Xsize)
-			w.WriteHeader(400)
-			return
-		}
-	}
-
 	log.Println("RDS XY Cut Request params xstart, ystart, xsize, ysize, outxsize, outzsize:", cutType, rdsRequest.Xstart, rdsRequest.Ystart, rdsRequest.Xsize, rdsRequest.Ysize, rdsRequest.Outxsize, rdsRequest.Outzsize)
 
 	start := time.Now()
@@ -1598,6 +1955,7 @@ func (s *rdsxyCutServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if !inCache { // If the output is not already in the cache then read the data file and do the processing.
 		log.Println("RDS Request not in Cache, computing result")
 		rdsRequest.Reader, rdsRequest.FileName, ok = openDataSource(r.URL.Path, 9)
+		rdsRequest.SourcePath = dataSourcePath(r.URL.Path, 9)
 		if !ok {
 			w.WriteHeader(400)
 			return
@@ -1649,6 +2007,22 @@ func (s *rdsxyCutServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		if rdsRequest.XScale == "log" && cutType == "rdsxcut" && !rdsRequest.setLogBinEdges() {
+			w.WriteHeader(400)
+			return
+		}
+
+		if !rdsRequest.openCompare(false) {
+			w.WriteHeader(400)
+			return
+		}
+		if exprError := rdsRequest.openExpression(false); exprError != nil {
+			log.Println(exprError)
+			w.WriteHeader(400)
+			w.Write([]byte(exprError.Error()))
+			return
+		}
+
 		//If Zmin and Zmax were not explitily given then compute
 		if !rdsRequest.Zset {
 			rdsRequest.findZminMax()
@@ -1675,6 +2049,8 @@ func (s *rdsxyCutServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		fileMData.Ysize = rdsRequest.Ysize
 		fileMData.Zmin = rdsRequest.Zmin
 		fileMData.Zmax = rdsRequest.Zmax
+		fileMData.Autoscale = rdsRequest.Autoscale
+		fileMData.XBinEdges = rdsRequest.XBinEdges
 
 		//var marshalError error
 		fileMDataJSON, marshalError := json.Marshal(fileMData)
@@ -1709,12 +2085,18 @@ func (s *rdsxyCutServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	outzsizeStr := strconv.Itoa(fileMDataCache.Outzsize)
 
 	w.Header().Add("Access-Control-Allow-Origin", "*")
-	w.Header().Add("Access-Control-Expose-Headers", "outxsize,outysize,zmin,zmax,filexstart,filexdelta,fileystart,fileydelta,xmin,xmax,ymin,ymax")
+	w.Header().Add("Access-Control-Expose-Headers", "outxsize,outysize,zmin,zmax,filexstart,filexdelta,fileystart,fileydelta,xmin,xmax,ymin,ymax,autoscale,xscale,xbinlow,xbinhigh")
 	w.Header().Add("outxsize", outxsizeStr)
 	w.Header().Add("outysize", outysizeStr)
 	w.Header().Add("outzsize", outzsizeStr)
 	w.Header().Add("zmin", fmt.Sprintf("%f", fileMDataCache.Zmin))
 	w.Header().Add("zmax", fmt.Sprintf("%f", fileMDataCache.Zmax))
+	if fileMDataCache.Autoscale != "" {
+		w.Header().Add("autoscale", fileMDataCache.Autoscale)
+	}
+	if fileMDataCache.XBinEdges != nil {
+		addLogBinHeaders(w.Header(), fileMDataCache.XBinEdges)
+	}
 	w.Header().Add("filexstart", fmt.Sprintf("%f", fileMDataCache.Filexstart))
 	w.Header().Add("filexdelta", fmt.Sprintf("%f", fileMDataCache.Filexdelta))
 	w.Header().Add("fileystart", fmt.Sprintf("%f", fileMDataCache.Fileystart))
@@ -2081,6 +2463,15 @@ func (s *routerServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	fileSystemServer := &fileSystemServer{}
 	rdsxyCutServer := &rdsxyCutServer{}
 	ldsServer := &ldsServer{}
+	rdsProfileServer := &rdsProfileServer{}
+	histogramServer := &histogramServer{}
+	statsServer := &statsServer{}
+	statsJobServer := &statsJobServer{}
+	demodServer := &demodServer{}
+	peaksServer := &peaksServer{}
+	audioServer := &audioServer{}
+	pyramidServer := &pyramidServer{}
+	colorMapServer := &colorMapServer{}
 
 	if string(r.URL.Path[0]) != "/" {
 		r.URL.Path = ("/") + string(r.URL.Path)
@@ -2103,6 +2494,24 @@ func (s *routerServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		rdsxyCutServer.ServeHTTP(w, r)
 	case "lds":
 		ldsServer.ServeHTTP(w, r)
+	case "rdsprofile":
+		rdsProfileServer.ServeHTTP(w, r)
+	case "hist":
+		histogramServer.ServeHTTP(w, r)
+	case "stats":
+		statsServer.ServeHTTP(w, r)
+	case "statsjob":
+		statsJobServer.ServeHTTP(w, r)
+	case "peaks":
+		peaksServer.ServeHTTP(w, r)
+	case "demod":
+		demodServer.ServeHTTP(w, r)
+	case "audio":
+		audioServer.ServeHTTP(w, r)
+	case "pyramid":
+		pyramidServer.ServeHTTP(w, r)
+	case "colormaps":
+		colorMapServer.ServeHTTP(w, r)
 	default:
 		log.Println("Unknown Mode", mode)
 		w.WriteHeader(400)
@@ -2159,6 +2568,7 @@ func setupConfigLogCache() {
 	go checkCache(minioPath, configuration.CheckCacheEvery, configuration.CacheMaxBytes)
 
 	zminzmaxFileMap = make(map[string]Zminzmax)
+	loadColorMaps()
 }
 
 func main() {
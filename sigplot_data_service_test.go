@@ -3,16 +3,18 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
-	"net/http"
-	"net/http/httptest"
-
-	//	"net/url"
 	"encoding/json"
+	"image/png"
 	"io/ioutil"
 	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 	//	"fmt"
 )
 
@@ -241,7 +243,7 @@ func TestInvalidTileRequest(t *testing.T) {
 	RDSTileHandler(t, "mydata_SB_600_600.tmp", 100, 10, 1, 1, 0, 0, "SB", 400, expectedReturn)
 	RDSTileHandler(t, "mydata_SB_600_600.tmp", 1000, 100, 1, 1, 0, 0, "SB", 400, expectedReturn)
 	RDSTileHandler(t, "mydata_SB_600_600.tmp", 100, 1000, 1, 1, 0, 0, "SB", 400, expectedReturn)
-	RDSTileHandler(t, "mydata_SB_600_600.tmp", 350, 100, 1, 1, 0, 0, "SB", 400, expectedReturn)
+	RDSTileHandler(t, "mydata_SB_600_600.tmp", 513, 100, 1, 1, 0, 0, "SB", 400, expectedReturn)
 	RDSTileHandler(t, "mydata_SB_600_600.tmp", 100, 100, 0, 1, 0, 0, "SB", 400, expectedReturn)
 	RDSTileHandler(t, "mydata_SB_600_600.tmp", 100, 100, 1, 0, 0, 0, "SB", 400, expectedReturn)
 	RDSTileHandler(t, "mydata_SB_600_600.tmp", 100, 100, 1, 11, 0, 0, "SB", 400, expectedReturn)
@@ -781,12 +783,8 @@ func TestFirstMiddlePointsColormapNoZinZmax(t *testing.T) {
 }
 func TestFirstMiddlePointsColormapNoZinZmaxBadColorMap(t *testing.T) {
 
-	expectedReturn := make([]byte, 4) //Input Data is values of 0,1,2 in equal amounts, first value will return 0.
-	expectedReturn[0] = 0             // Should return lowest value in default colormap "Ramp Colormap"
-	expectedReturn[1] = 0
-	expectedReturn[2] = 38
-	expectedReturn[3] = 255 //Alpha is always 255
-	BaseicRDSHandlerColormap(t, "mydata_SB_60_60.tmp", 0, 20, 18, 21, 1, 1, "first", "Re", "Bad", "skip", "skip", 200, expectedReturn)
+	// An unknown colormap is an error rather than falling back to "RampColormap"
+	BaseicRDSHandlerColormap(t, "mydata_SB_60_60.tmp", 0, 20, 18, 21, 1, 1, "first", "Re", "Bad", "skip", "skip", 400, nil)
 }
 
 func TestFirstMiddlePointsColormapNoZinZmaxGreyscale(t *testing.T) {
@@ -1148,8 +1146,6 @@ func TestXCutInvalidRequests(t *testing.T) {
 	BaseicRDSxCutHandler(t, "mydata_SB_60_60.tmp", "rdsxcut", 0, 0, 60, 1, 60, 0, "Re", 400, expectedResults)
 	BaseicRDSxCutHandler(t, "mydata_SB_60_60.tmp", "rdsxcut", 0, 0, 60, 0, 60, 10, "Re", 400, expectedResults)
 	BaseicRDSxCutHandler(t, "mydata_SB_60_60.tmp", "rdsycut", 0, 0, 0, 60, 60, 10, "Re", 400, expectedResults)
-	BaseicRDSxCutHandler(t, "mydata_SB_60_60.tmp", "rdsxcut", 0, 0, 60, 2, 60, 10, "Re", 400, expectedResults)
-	BaseicRDSxCutHandler(t, "mydata_SB_60_60.tmp", "rdsycut", 0, 0, 2, 60, 60, 10, "Re", 400, expectedResults)
 
 	BaseicRDSxCutHandler(t, "mydata_SB_60_60.tmp", "rdsxcut", 0, 0, 70, 1, 60, 10, "Re", 400, expectedResults)
 	BaseicRDSxCutHandler(t, "mydata_SB_60_60.tmp", "rdsxcut", 65, 0, 70, 1, 60, 10, "Re", 400, expectedResults)
@@ -1177,3 +1173,1953 @@ func Test1DLineInvalidRequests(t *testing.T) {
 	BaseicLDSHandler(t, "stairstep.tmp", 400, 600, outxsize, outysize, "Re", 400, expectedResults)
 	BaseicLDSHandler(t, "stairstep.tmp", 1000, 1100, outxsize, outysize, "Re", 400, expectedResults)
 }
+
+func SDSURLHandler(t *testing.T, sdsurl string, expectedReturnCode int) *httptest.ResponseRecorder {
+	os.Args = []string{"cmd", "-usecache=false", "-config=./tests/sdsTestConfig.json"}
+
+	t.Log("url:", sdsurl)
+	req, err := http.NewRequest("GET", sdsurl, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setupConfigLogCache()
+
+	rr := httptest.NewRecorder()
+	rdsServer := &routerServer{}
+	rdsServer.ServeHTTP(rr, req)
+
+	if rr.Code != expectedReturnCode {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, expectedReturnCode)
+	}
+	return rr
+}
+
+func checkFloatData(t *testing.T, returnBytes []byte, expected []float64) {
+	gotData := make([]float64, len(returnBytes)/8)
+	_ = binary.Read(bytes.NewReader(returnBytes), binary.LittleEndian, &gotData)
+	if len(gotData) != len(expected) {
+		t.Errorf("Did not get correct length return. Got %v epected %v ", len(gotData), len(expected))
+		return
+	}
+	for i := range expected {
+		if math.Abs(gotData[i]-expected[i]) > 1e-9 {
+			t.Errorf("Values Did not match expected for %v value: got %v expected %v", i, gotData[i], expected[i])
+		}
+	}
+}
+
+func TestRDSXExpansionNearest(t *testing.T) {
+	// Columns 5 and 6 of line 20 are 0 and 1. Default nearest repeats each value.
+	rr := SDSURLHandler(t, "/sds/rds/5/20/7/21/4/1/TestDir/mydata_SB_60_60.tmp?outfmt=SD", 200)
+	checkFloatData(t, rr.Body.Bytes(), []float64{0, 0, 1, 1})
+}
+
+func TestRDSXExpansionUnknownInterp(t *testing.T) {
+	rr := SDSURLHandler(t, "/sds/rds/5/20/7/21/4/1/TestDir/mydata_SB_60_60.tmp?outfmt=SD&interp=bad", 200)
+	checkFloatData(t, rr.Body.Bytes(), []float64{0, 0, 1, 1})
+}
+
+func TestRDSXExpansionLinear(t *testing.T) {
+	rr := SDSURLHandler(t, "/sds/rds/5/20/7/21/4/1/TestDir/mydata_SB_60_60.tmp?outfmt=SD&interp=linear", 200)
+	checkFloatData(t, rr.Body.Bytes(), []float64{0, 0.5, 1, 1})
+}
+
+func TestRDSYExpansionBilinear(t *testing.T) {
+	// Column 50 is 0 on line 9 and 8 on line 10.
+	rr := SDSURLHandler(t, "/sds/rds/50/9/51/11/1/4/TestDir/mydata_SB_60_60.tmp?outfmt=SD&interp=bilinear", 200)
+	checkFloatData(t, rr.Body.Bytes(), []float64{0, 4, 8, 8})
+}
+
+func TestRDSXExpansionCubic(t *testing.T) {
+	// Columns 4-7 of line 20 are 0,0,1,1. Catmull-Rom passes through the samples and rings slightly around the step.
+	rr := SDSURLHandler(t, "/sds/rds/4/20/8/21/8/1/TestDir/mydata_SB_60_60.tmp?outfmt=SD&interp=cubic", 200)
+	checkFloatData(t, rr.Body.Bytes(), []float64{0, -0.0625, 0, 0.5, 1, 1.0625, 1, 1})
+}
+
+func Test1DLineXExpansionLinear(t *testing.T) {
+	// Stairstep values are 0 at x=99 and 3 at x=100. Every output pixel gets an interpolated value.
+	rr := SDSURLHandler(t, "/sds/lds/99/101/5/10/TestDir/stairstep.tmp?interp=linear", 200)
+	expected := []int16{0, 1, 2, 3, 4, 9, 8, 6, 6, 6}
+	gotData := make([]int16, len(rr.Body.Bytes())/2)
+	_ = binary.Read(bytes.NewReader(rr.Body.Bytes()), binary.LittleEndian, &gotData)
+	if len(gotData) != len(expected) {
+		t.Fatalf("Did not get correct length return. Got %v epected %v ", len(gotData), len(expected))
+	}
+	for i := range expected {
+		if gotData[i] != expected[i] {
+			t.Errorf("Values Did not match expected for %v value: got %v expected %v", i, gotData[i], expected[i])
+		}
+	}
+}
+
+func makeLineOutputExpectedData(values []float64, outxsize, outzsize int, zmin, zmax float64) []byte {
+	xslice := make([]int16, 0, len(values)*2)
+	zslice := make([]int16, 0, len(values))
+	xratio := float64(len(values)) / float64(outxsize-1)
+	zratio := (zmax - zmin) / float64(outzsize-1)
+	for x := 0; x < len(values); x++ {
+		xpixel := int16(math.Round(float64(x) / xratio))
+		zpixel := int16(math.Round((zmax - values[x]) / zratio))
+		if len(xslice) == 0 || !(xslice[len(xslice)-1] == xpixel && zslice[len(zslice)-1] == zpixel) {
+			xslice = append(xslice, xpixel)
+			zslice = append(zslice, zpixel)
+		}
+	}
+	xslice = append(xslice, zslice...)
+	outData := new(bytes.Buffer)
+	_ = binary.Write(outData, binary.LittleEndian, &xslice)
+	return outData.Bytes()
+}
+
+func checkByteData(t *testing.T, returnBytes []byte, expected []byte) {
+	if len(returnBytes) != len(expected) {
+		t.Errorf("Did not get correct length return. Got %v epected %v ", len(returnBytes), len(expected))
+		return
+	}
+	for i := range expected {
+		if returnBytes[i] != expected[i] {
+			t.Errorf("Values Did not match expected for %v byte: got %v expected %v", i, returnBytes[i], expected[i])
+		}
+	}
+}
+
+func TestXCutMultiLineMean(t *testing.T) {
+	// Lines 20 and 21 are identical so their mean is the same as a single line cut.
+	expectedResults := make1DExpectedData("xcut", 60, 20, 60, 10, 0, 10)
+	rr := SDSURLHandler(t, "/sds/rdsxcut/0/20/60/22/60/10/TestDir/mydata_SB_60_60.tmp?transform=mean", 200)
+	checkByteData(t, rr.Body.Bytes(), expectedResults)
+}
+
+func TestXCutMultiLineMeanAcrossStep(t *testing.T) {
+	// Line 9 is all 0 and line 10 steps from 0 to 9, so the mean is half of the step values.
+	values := make([]float64, 60)
+	for x := range values {
+		values[x] = float64(x/6) / 2
+	}
+	expectedResults := makeLineOutputExpectedData(values, 60, 10, 0, 10)
+	rr := SDSURLHandler(t, "/sds/rdsxcut/0/9/60/11/60/10/TestDir/mydata_SB_60_60.tmp?transform=mean", 200)
+	checkByteData(t, rr.Body.Bytes(), expectedResults)
+}
+
+func TestXCutMultiLineMax(t *testing.T) {
+	expectedResults := make1DExpectedData("xcut", 60, 10, 60, 10, 0, 10)
+	rr := SDSURLHandler(t, "/sds/rdsxcut/0/9/60/11/60/10/TestDir/mydata_SB_60_60.tmp?transform=max", 200)
+	checkByteData(t, rr.Body.Bytes(), expectedResults)
+}
+
+func TestYCutMultiColumnMean(t *testing.T) {
+	// Columns 0-5 are 0 and 6-11 are 1 in the middle lines, so their mean is 0.5.
+	values := make([]float64, 60)
+	for y := range values {
+		if y >= 50 {
+			values[y] = 10
+		} else if y >= 10 {
+			values[y] = 0.5
+		}
+	}
+	expectedResults := makeLineOutputExpectedData(values, 60, 10, 0, 10)
+	rr := SDSURLHandler(t, "/sds/rdsycut/0/0/12/60/60/10/TestDir/mydata_SB_60_60.tmp?transform=mean", 200)
+	checkByteData(t, rr.Body.Bytes(), expectedResults)
+}
+
+func TestYCutMultiColumnMax(t *testing.T) {
+	expectedResults := make1DExpectedData("ycut", 60, 6, 60, 10, 0, 10)
+	rr := SDSURLHandler(t, "/sds/rdsycut/0/0/12/60/60/10/TestDir/mydata_SB_60_60.tmp?transform=max", 200)
+	checkByteData(t, rr.Body.Bytes(), expectedResults)
+}
+
+func TestProfileHorizontal(t *testing.T) {
+	// A horizontal profile along line 20 samples every element, so it matches an x cut of that line.
+	expectedResults := make1DExpectedData("xcut", 60, 20, 60, 10, 0, 10)
+	rr := SDSURLHandler(t, "/sds/rdsprofile/0/20/59/20/60/10/TestDir/mydata_SB_60_60.tmp", 200)
+	checkByteData(t, rr.Body.Bytes(), expectedResults)
+	if rr.Header().Get("xmax") != "59.000000" {
+		t.Errorf("Profile arc length header incorrect. got %v", rr.Header().Get("xmax"))
+	}
+}
+
+func TestProfileVertical(t *testing.T) {
+	expectedResults := make1DExpectedData("ycut", 60, 20, 60, 10, 0, 10)
+	rr := SDSURLHandler(t, "/sds/rdsprofile/20/0/20/59/60/10/TestDir/mydata_SB_60_60.tmp?profileaxis=y", 200)
+	checkByteData(t, rr.Body.Bytes(), expectedResults)
+	if rr.Header().Get("xmin") != "0.000000" || rr.Header().Get("xmax") != "59.000000" {
+		t.Errorf("Profile y axis headers incorrect. got %v %v", rr.Header().Get("xmin"), rr.Header().Get("xmax"))
+	}
+}
+
+func TestProfileWidth(t *testing.T) {
+	// Lines 19, 20 and 21 are identical so a 3 element wide mean profile matches the single line.
+	expectedResults := make1DExpectedData("xcut", 60, 20, 60, 10, 0, 10)
+	rr := SDSURLHandler(t, "/sds/rdsprofile/0/20/59/20/60/10/TestDir/mydata_SB_60_60.tmp?width=3&transform=mean", 200)
+	checkByteData(t, rr.Body.Bytes(), expectedResults)
+}
+
+func TestProfileDiagonalLinear(t *testing.T) {
+	// From (5,20) to (7,22) crosses the 0 to 1 step between columns 5 and 6. The 4 samples are at x = 5, 5.67, 6.33 and 7.
+	values := []float64{0, 2.0 / 3.0, 1, 1}
+	expectedResults := makeLineOutputExpectedData(values, 4, 11, 0, 10)
+	rr := SDSURLHandler(t, "/sds/rdsprofile/5/20/7/22/4/11/TestDir/mydata_SB_60_60.tmp?interp=linear", 200)
+	checkByteData(t, rr.Body.Bytes(), expectedResults)
+}
+
+func TestProfileWideDiagonal(t *testing.T) {
+	// Every row is read once for the whole profile, so check against sampling the file directly
+	rr := SDSURLHandler(t, "/sds/rds/0/0/60/60/60/60/TestDir/mydata_SB_60_60.tmp?outfmt=SD", 200)
+	file := make([]float64, 3600)
+	binary.Read(rr.Body, binary.LittleEndian, &file)
+	// From (3,50) to (40,10), 7 samples wide
+	width := 7
+	length := math.Hypot(37, -40)
+	numSamples := int(math.Ceil(length)) + 1
+	values := make([]float64, numSamples)
+	for i := range values {
+		t := float64(i) / float64(numSamples-1)
+		var sum float64
+		for k := 0; k < width; k++ {
+			offset := float64(k - 3)
+			x := 3 + t*37 + offset*40/length
+			y := 50 - t*40 + offset*37/length
+			xTaps, xWeights := interpolationTaps(x, 60, "cubic")
+			yTaps, yWeights := interpolationTaps(y, 60, "cubic")
+			for j := range yTaps {
+				for n := range xTaps {
+					sum += yWeights[j] * xWeights[n] * file[yTaps[j]*60+xTaps[n]]
+				}
+			}
+		}
+		values[i] = sum / float64(width)
+	}
+	expectedResults := makeLineOutputExpectedData(values, numSamples, 11, 0, 10)
+	rr = SDSURLHandler(t, "/sds/rdsprofile/3/50/40/10/"+strconv.Itoa(numSamples)+"/11/TestDir/mydata_SB_60_60.tmp?width=7&interp=cubic&transform=mean&zmin=0&zmax=10", 200)
+	checkByteData(t, rr.Body.Bytes(), expectedResults)
+}
+
+func TestProfileDiagonalNearest(t *testing.T) {
+	// The samples at x = 5, 5.67, 6.33 and 7 take the nearest columns 5, 6, 6 and 7
+	expectedResults := makeLineOutputExpectedData([]float64{0, 1, 1, 1}, 4, 11, 0, 10)
+	rr := SDSURLHandler(t, "/sds/rdsprofile/5/20/7/22/4/11/TestDir/mydata_SB_60_60.tmp", 200)
+	checkByteData(t, rr.Body.Bytes(), expectedResults)
+}
+
+func TestProfileInvalidRequests(t *testing.T) {
+	SDSURLHandler(t, "/sds/rdsprofile/0/20/60/20/60/10/TestDir/mydata_SB_60_60.tmp", 400)
+	SDSURLHandler(t, "/sds/rdsprofile/0/20/59/60/60/10/TestDir/mydata_SB_60_60.tmp", 400)
+	SDSURLHandler(t, "/sds/rdsprofile/0/20/59/20/60/10/TestDir/mydata_SB_60_60.tmp?width=0", 400)
+	SDSURLHandler(t, "/sds/rdsprofile/0/20/59/20/60/10/TestDir/mydata_SB_60_60.tmp?width=257", 400)
+	SDSURLHandler(t, "/sds/rdsprofile/0/20/59/20/60/10/TestDir/mydata_SB_60_60.tmp?profileaxis=bad", 400)
+}
+
+func makeSPYcutValues(column int) []float64 {
+	// Every byte of lines 0-39 of the SP file is 00110000 and every byte of lines 40-79 is 00110001.
+	values := make([]float64, 80)
+	for y := range values {
+		switch column % 8 {
+		case 2, 3:
+			values[y] = 1
+		case 7:
+			if y >= 40 {
+				values[y] = 1
+			}
+		}
+	}
+	return values
+}
+
+func TestYCutSP(t *testing.T) {
+	for _, column := range []int{0, 2, 7, 15, 42, 79} {
+		expectedResults := makeLineOutputExpectedData(makeSPYcutValues(column), 80, 2, 0, 1)
+		rr := SDSURLHandler(t, "/sds/rdsycut/"+strconv.Itoa(column)+"/0/"+strconv.Itoa(column+1)+"/80/80/2/TestDir/mydata_SP_80_80.tmp?zmin=0&zmax=1", 200)
+		checkByteData(t, rr.Body.Bytes(), expectedResults)
+	}
+}
+
+func TestYCutSPPartialRange(t *testing.T) {
+	expectedResults := makeLineOutputExpectedData(makeSPYcutValues(23)[30:50], 20, 2, 0, 1)
+	rr := SDSURLHandler(t, "/sds/rdsycut/23/30/24/50/20/2/TestDir/mydata_SP_80_80.tmp?zmin=0&zmax=1", 200)
+	checkByteData(t, rr.Body.Bytes(), expectedResults)
+}
+
+func TestYCutSPMultiColumnMax(t *testing.T) {
+	// Columns 7-10 cross from the first byte into the second. Column 10 is 1 on every line and column 7 only on lines 40-79, so the
+	// max of the band is column 10.
+	expectedResults := makeLineOutputExpectedData(makeSPYcutValues(10), 80, 2, 0, 1)
+	rr := SDSURLHandler(t, "/sds/rdsycut/7/0/11/80/80/2/TestDir/mydata_SP_80_80.tmp?transform=max", 200)
+	checkByteData(t, rr.Body.Bytes(), expectedResults)
+}
+
+func TestHistogramWholeFile(t *testing.T) {
+	// Rows 0-9 are 0, rows 50-59 are 10 and the 40 rows between are col/6, so 0-9 in blocks of 6 columns.
+	rr := SDSURLHandler(t, "/sds/hist/TestDir/mydata_SB_60_60.tmp?bins=11", 200)
+	var result histogramResult
+	err := json.Unmarshal(rr.Body.Bytes(), &result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Zmin != 0 || result.Zmax != 10 || len(result.Edges) != 12 || result.Total != 3600 {
+		t.Errorf("Histogram range not as expected. zmin %v zmax %v edges %v total %v", result.Zmin, result.Zmax, len(result.Edges), result.Total)
+	}
+	expected := []int64{840, 240, 240, 240, 240, 240, 240, 240, 240, 240, 600}
+	if len(result.Counts) != len(expected) {
+		t.Fatalf("Histogram counts wrong length. Got %v expected %v", len(result.Counts), len(expected))
+	}
+	for i := range expected {
+		if result.Counts[i] != expected[i] {
+			t.Errorf("Histogram count for bin %v: got %v expected %v", i, result.Counts[i], expected[i])
+		}
+	}
+}
+
+func TestHistogramRegionBinary(t *testing.T) {
+	// Columns 0-11 of rows 20 and 21 are six 0s then six 1s.
+	rr := SDSURLHandler(t, "/sds/hist/TestDir/mydata_SB_60_60.tmp?x1=0&y1=20&x2=12&y2=22&zmin=0&zmax=1&bins=2&outfmt=SD", 200)
+	checkFloatData(t, rr.Body.Bytes(), []float64{12, 12})
+	if rr.Header().Get("total") != "24" || rr.Header().Get("underflow") != "0" {
+		t.Errorf("Histogram headers not as expected. total %v underflow %v", rr.Header().Get("total"), rr.Header().Get("underflow"))
+	}
+}
+
+func TestHistogramUnderOverflow(t *testing.T) {
+	rr := SDSURLHandler(t, "/sds/hist/TestDir/mydata_SB_60_60.tmp?zmin=1&zmax=9&bins=4&outfmt=SD", 200)
+	checkFloatData(t, rr.Body.Bytes(), []float64{480, 480, 480, 720})
+	if rr.Header().Get("underflow") != "840" || rr.Header().Get("overflow") != "600" {
+		t.Errorf("Histogram headers not as expected. underflow %v overflow %v", rr.Header().Get("underflow"), rr.Header().Get("overflow"))
+	}
+}
+
+func TestHistogramInvalidRequests(t *testing.T) {
+	SDSURLHandler(t, "/sds/hist/TestDir/mydata_SB_60_60.tmp?bins=0", 400)
+	SDSURLHandler(t, "/sds/hist/TestDir/mydata_SB_60_60.tmp?bins=65537", 400)
+	SDSURLHandler(t, "/sds/hist/TestDir/mydata_SB_60_60.tmp?bins=2000000000", 400)
+	SDSURLHandler(t, "/sds/hist/TestDir/mydata_SB_60_60.tmp?bins=65536", 200)
+	SDSURLHandler(t, "/sds/hist/TestDir/mydata_SB_60_60.tmp?outfmt=RGBA", 400)
+	SDSURLHandler(t, "/sds/hist/TestDir/mydata_SB_60_60.tmp?logbins=true&zmin=0&zmax=10", 400)
+	SDSURLHandler(t, "/sds/hist/TestDir/mydata_SB_60_60.tmp?x2=61", 400)
+	SDSURLHandler(t, "/sds/hist/TestDir/mydata_SB_60_60.tmp?zmin=5&zmax=1", 400)
+}
+
+func TestHistogramCountOverflow(t *testing.T) {
+	// The one bin counts all 3600 elements, too many for SB but not for SI
+	SDSURLHandler(t, "/sds/hist/TestDir/mydata_SB_60_60.tmp?bins=1&outfmt=SB", 400)
+	rr := SDSURLHandler(t, "/sds/hist/TestDir/mydata_SB_60_60.tmp?bins=1&outfmt=SI", 200)
+	var count int16
+	binary.Read(rr.Body, binary.LittleEndian, &count)
+	if count != 3600 {
+		t.Errorf("Histogram count not as expected. got %v expected 3600", count)
+	}
+}
+
+func checkStatsResult(t *testing.T, result statsResult) {
+	// 840 values of 0, 240 each of 1 to 9 and 600 of 10
+	if result.Total != 3600 || result.Count != 3600 || result.NaNCount != 0 || result.InfCount != 0 {
+		t.Errorf("Stats counts not as expected. total %v count %v nan %v inf %v", result.Total, result.Count, result.NaNCount, result.InfCount)
+	}
+	if result.Min != 0 || result.MinX != 0 || result.MinY != 0 {
+		t.Errorf("Stats min not as expected. got %v at %v,%v", result.Min, result.MinX, result.MinY)
+	}
+	if result.Max != 10 || result.MaxX != 0 || result.MaxY != 50 {
+		t.Errorf("Stats max not as expected. got %v at %v,%v", result.Max, result.MaxX, result.MaxY)
+	}
+	expectedMean := 16800.0 / 3600
+	expectedStddev := math.Sqrt((240*285+60000)/3600.0 - expectedMean*expectedMean)
+	if math.Abs(result.Mean-expectedMean) > 1e-9 || math.Abs(result.Stddev-expectedStddev) > 1e-9 {
+		t.Errorf("Stats mean or stddev not as expected. got %v %v expected %v %v", result.Mean, result.Stddev, expectedMean, expectedStddev)
+	}
+	expectedPercentiles := []statsPercentile{{1, 0}, {50, 4}, {99, 10}}
+	if len(result.Percentiles) != len(expectedPercentiles) {
+		t.Fatalf("Stats percentiles wrong length. got %v", len(result.Percentiles))
+	}
+	for i := range expectedPercentiles {
+		if result.Percentiles[i] != expectedPercentiles[i] {
+			t.Errorf("Stats percentile not as expected. got %v expected %v", result.Percentiles[i], expectedPercentiles[i])
+		}
+	}
+}
+
+func TestStatsWholeFile(t *testing.T) {
+	rr := SDSURLHandler(t, "/sds/stats/TestDir/mydata_SB_60_60.tmp", 200)
+	var result statsResult
+	err := json.Unmarshal(rr.Body.Bytes(), &result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStatsResult(t, result)
+}
+
+func TestStatsRegionPercentiles(t *testing.T) {
+	// Columns 6-17 of rows 30 and 31 are six 1s then six 2s.
+	rr := SDSURLHandler(t, "/sds/stats/TestDir/mydata_SB_60_60.tmp?x1=6&y1=30&x2=18&y2=32&percentiles=0,50,51,100", 200)
+	var result statsResult
+	err := json.Unmarshal(rr.Body.Bytes(), &result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Count != 24 || result.Min != 1 || result.MinX != 6 || result.MinY != 30 || result.Max != 2 || result.MaxX != 12 || result.MaxY != 30 {
+		t.Errorf("Region stats not as expected. got %+v", result)
+	}
+	expectedPercentiles := []statsPercentile{{0, 1}, {50, 1}, {51, 2}, {100, 2}}
+	for i := range expectedPercentiles {
+		if i >= len(result.Percentiles) || result.Percentiles[i] != expectedPercentiles[i] {
+			t.Errorf("Region percentiles not as expected. got %v expected %v", result.Percentiles, expectedPercentiles)
+			break
+		}
+	}
+}
+
+func TestStatsAsync(t *testing.T) {
+	rr := SDSURLHandler(t, "/sds/stats/TestDir/mydata_SB_60_60.tmp?async=true", 202)
+	var job statsJob
+	err := json.Unmarshal(rr.Body.Bytes(), &job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		rr = SDSURLHandler(t, "/sds/statsjob/"+job.ID, 200)
+		err = json.Unmarshal(rr.Body.Bytes(), &job)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.State != "running" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if job.State != "done" || job.Result == nil {
+		t.Fatalf("Stats job did not finish. state %v", job.State)
+	}
+	if rr.Header().Get("progress") != "1.000000" {
+		t.Errorf("Finished stats job progress not 1. got %v", rr.Header().Get("progress"))
+	}
+	checkStatsResult(t, *job.Result)
+}
+
+func TestStatsInvalidRequests(t *testing.T) {
+	SDSURLHandler(t, "/sds/stats/TestDir/mydata_SB_60_60.tmp?percentiles=101", 400)
+	SDSURLHandler(t, "/sds/stats/TestDir/mydata_SB_60_60.tmp?percentiles=a", 400)
+	SDSURLHandler(t, "/sds/stats/TestDir/mydata_SB_60_60.tmp?y1=70", 400)
+	SDSURLHandler(t, "/sds/statsjob/nosuchjob", 404)
+}
+
+func checkHeaderFloat(t *testing.T, rr *httptest.ResponseRecorder, header string, expected float64, tolerance float64) {
+	value, err := strconv.ParseFloat(rr.Header().Get(header), 64)
+	if err != nil || math.Abs(value-expected) > tolerance {
+		t.Errorf("Header %v not as expected. got %v expected %v", header, rr.Header().Get(header), expected)
+	}
+}
+
+func TestAutoscalePercentile(t *testing.T) {
+	// 840 values of 0, 240 each of 1 to 9 and 600 of 10. The 30th percentile is 1 and the 70th is 7.
+	rr := SDSURLHandler(t, "/sds/rds/0/0/60/60/60/60/TestDir/mydata_SB_60_60.tmp?autoscale=p30-p70", 200)
+	checkHeaderFloat(t, rr, "zmin", 1, 0.01)
+	checkHeaderFloat(t, rr, "zmax", 7, 0.01)
+	if rr.Header().Get("autoscale") != "p30-p70" {
+		t.Errorf("autoscale header not as expected. got %v", rr.Header().Get("autoscale"))
+	}
+}
+
+func TestAutoscaleSigma(t *testing.T) {
+	mean := 16800.0 / 3600
+	sigma := math.Sqrt(128400.0/3600 - mean*mean)
+	rr := SDSURLHandler(t, "/sds/rds/0/0/60/60/60/60/TestDir/mydata_SB_60_60.tmp?autoscale=mean%C2%B11sigma", 200)
+	checkHeaderFloat(t, rr, "zmin", mean-sigma, 1e-5)
+	checkHeaderFloat(t, rr, "zmax", mean+sigma, 1e-5)
+	// Limits are clipped to the range of the data
+	rr = SDSURLHandler(t, "/sds/rds/0/0/60/60/60/60/TestDir/mydata_SB_60_60.tmp?autoscale=3sigma", 200)
+	checkHeaderFloat(t, rr, "zmin", 0, 1e-5)
+	checkHeaderFloat(t, rr, "zmax", 10, 1e-5)
+}
+
+func TestAutoscaleFloor(t *testing.T) {
+	// The median is 4
+	rr := SDSURLHandler(t, "/sds/rdsxcut/0/30/60/31/60/100/TestDir/mydata_SB_60_60.tmp?autoscale=floor:2:5", 200)
+	checkHeaderFloat(t, rr, "zmin", 2, 0.01)
+	checkHeaderFloat(t, rr, "zmax", 9, 0.01)
+}
+
+func TestAutoscaleConstantFile(t *testing.T) {
+	// Every element is 7, so there is no range to make a histogram of
+	for _, autoscale := range []string{"p1-p99", "mean%C2%B11sigma", "minmax"} {
+		rr := SDSURLHandler(t, "/sds/rds/0/0/60/60/60/60/TestDir/constant_SB_60_60.tmp?autoscale="+autoscale, 200)
+		checkHeaderFloat(t, rr, "zmin", 7, 1e-9)
+		checkHeaderFloat(t, rr, "zmax", 7, 1e-9)
+	}
+	rr := SDSURLHandler(t, "/sds/rds/0/0/60/60/60/60/TestDir/constant_SB_60_60.tmp?autoscale=floor:2:5", 200)
+	checkHeaderFloat(t, rr, "zmin", 5, 1e-9)
+	checkHeaderFloat(t, rr, "zmax", 12, 1e-9)
+}
+
+func TestAutoscaleLarge1DSections(t *testing.T) {
+	os.Args = []string{"cmd", "-usecache=false", "-config=./tests/sdsTestConfig.json"}
+	setupConfigLogCache()
+	// 32000 bytes is more than maxBytesZminZmax of 10000, so four sections of 10000/8/4 elements are sampled
+	request := rdsRequest{FileFormat: "CF", FileXSize: 4000, FileYSize: 1}
+	expected := []lineSegment{{0, 0, 312}, {0, 1228, 312}, {0, 2456, 312}, {0, 3688, 312}}
+	segments := request.zminmaxSampleSegments()
+	if len(segments) != len(expected) {
+		t.Fatalf("Got segments %v want %v", segments, expected)
+	}
+	for i := range expected {
+		if segments[i] != expected[i] {
+			t.Errorf("Segment %d got %v want %v", i, segments[i], expected[i])
+		}
+	}
+	// Every section stays within a file only just over the limit
+	request = rdsRequest{FileFormat: "CF", FileXSize: 1250, FileYSize: 1}
+	for _, segment := range request.zminmaxSampleSegments() {
+		if segment.Xstart < 0 || segment.Xstart+segment.Xsize > request.FileXSize {
+			t.Errorf("Segment %v is outside the file of %d elements", segment, request.FileXSize)
+		}
+	}
+	rr := SDSURLHandler(t, "/sds/lds/0/100/100/100/TestDir/tone_CF_4000.tmp?cxmode=Ma&autoscale=p0-p100", 200)
+	checkHeaderFloat(t, rr, "zmin", 0.5, 1e-2)
+	checkHeaderFloat(t, rr, "zmax", 1.5, 1e-2)
+}
+
+func TestAutoscaleDefaults(t *testing.T) {
+	rr := SDSURLHandler(t, "/sds/rds/0/0/60/60/60/60/TestDir/mydata_SB_60_60.tmp?autoscale=bad", 200)
+	checkHeaderFloat(t, rr, "zmin", 0, 1e-9)
+	checkHeaderFloat(t, rr, "zmax", 10, 1e-9)
+	if rr.Header().Get("autoscale") != "minmax" {
+		t.Errorf("autoscale header not as expected. got %v", rr.Header().Get("autoscale"))
+	}
+	rr = SDSURLHandler(t, "/sds/rds/0/0/60/60/60/60/TestDir/mydata_SB_60_60.tmp?autoscale=p1-p99&zmin=2&zmax=3", 200)
+	checkHeaderFloat(t, rr, "zmin", 2, 1e-9)
+	checkHeaderFloat(t, rr, "zmax", 3, 1e-9)
+	if rr.Header().Get("autoscale") != "" {
+		t.Errorf("autoscale header should not be set with zmin and zmax. got %v", rr.Header().Get("autoscale"))
+	}
+}
+
+func TestRangeIndex(t *testing.T) {
+	os.Args = []string{"cmd", "-usecache=false", "-config=./tests/sdsTestConfig.json"}
+	setupConfigLogCache()
+	configuration.CacheLocation = t.TempDir() + "/"
+	configuration.RangeIndexRowsPerBlock = 10
+	defer func() { configuration.RangeIndexRowsPerBlock = 0 }()
+
+	var request rdsRequest
+	request.Cxmode = "Re"
+	if !request.openRegionFile("/sds/hist/TestDir/mydata_SB_60_60.tmp", 3) {
+		t.Fatal("Could not open test file")
+	}
+	if request.SourcePath != "TestDir/mydata_SB_60_60.tmp" {
+		t.Errorf("SourcePath not as expected. got %v", request.SourcePath)
+	}
+
+	// Rows 0-9 are 0, rows 50-59 are 10 and the rows between are 0 to 9 in blocks of 6 columns.
+	index := buildRangeIndex(request)
+	if index.Min != 0 || index.Max != 10 || index.Count != 3600 || math.Abs(index.Mean-16800.0/3600) > 1e-9 {
+		t.Errorf("File range not as expected. got %+v", index)
+	}
+	expectedBlocks := []rangeIndexBlock{{0, 0, 0, 600}, {0, 9, 4.5, 600}, {0, 9, 4.5, 600}, {0, 9, 4.5, 600}, {0, 9, 4.5, 600}, {10, 10, 10, 600}}
+	if len(index.Blocks) != len(expectedBlocks) {
+		t.Fatalf("Wrong number of blocks. got %v", len(index.Blocks))
+	}
+	for i := range expectedBlocks {
+		if math.Abs(index.Blocks[i].Mean-expectedBlocks[i].Mean) > 1e-9 || index.Blocks[i].Min != expectedBlocks[i].Min || index.Blocks[i].Max != expectedBlocks[i].Max || index.Blocks[i].Count != expectedBlocks[i].Count {
+			t.Errorf("Block %v not as expected. got %+v expected %+v", i, index.Blocks[i], expectedBlocks[i])
+		}
+	}
+
+	// A stored index is used in place of the estimate, and only for the same cxmode
+	key := request.rangeIndexKey()
+	index.Min, index.Max = -5, 50
+	index.Blocks[2].Max = 99
+	storeRangeIndex(key, index)
+	*useCache = true
+	defer func() { *useCache = false }()
+	request.findZminMax()
+	if request.Zmin != -5 || request.Zmax != 50 {
+		t.Errorf("Stored range index not used. got %v %v", request.Zmin, request.Zmax)
+	}
+
+	// Whole blocks of a selection of whole rows are taken from the index and the rows around them are read
+	region := request
+	region.Xstart, region.Xsize, region.Ystart, region.Ysize = 0, 60, 15, 30
+	if min, max := findRegionMinMax(region); min != 0 || max != 99 {
+		t.Errorf("Range index blocks not used for the region. got %v %v", min, max)
+	}
+	region.Xstart, region.Xsize = 1, 59
+	if min, max := findRegionMinMax(region); min != 0 || max != 9 {
+		t.Errorf("Range index blocks used for part of each row. got %v %v", min, max)
+	}
+	region.Xstart, region.Xsize, region.Ystart, region.Ysize = 0, 60, 45, 15
+	if min, max := findRegionMinMax(region); min != 0 || max != 10 {
+		t.Errorf("Range of region not as expected. got %v %v", min, max)
+	}
+	request.Cxmode = "Ma"
+	if request.rangeIndexKey() == key {
+		t.Errorf("Range index key does not depend on cxmode")
+	}
+}
+
+func TestFilterTapsLimit(t *testing.T) {
+	var request rdsRequest
+	request.getQueryParams(httptest.NewRequest("GET", "/sds/lds/0/500/50/100/TestDir/stairstep.tmp?filter=fir&filtertaps=100000000", nil))
+	if request.FilterTaps != maxFilterTaps {
+		t.Errorf("filtertaps not limited. got %v expected %v", request.FilterTaps, maxFilterTaps)
+	}
+	SDSURLHandler(t, "/sds/lds/0/500/50/100/TestDir/stairstep.tmp?filter=fir&filtertaps=100000000", 200)
+}
+
+func TestFIRDecimateRejectsAliases(t *testing.T) {
+	taps := designLowPass(81, 10, "hamming")
+	var sum float64
+	for _, tap := range taps {
+		sum += tap
+	}
+	if math.Abs(sum-1) > 1e-12 {
+		t.Errorf("Low-pass DC gain not 1. got %v", sum)
+	}
+
+	// Alternating samples are at the Nyquist rate of the input so should be removed, where picking every 10th sample gives all ones.
+	alternating := make([]float64, 400)
+	for i := range alternating {
+		alternating[i] = 1 - 2*float64(i%2)
+	}
+	filtered := firDecimate(alternating, 10, taps)
+	if len(filtered) != 40 {
+		t.Fatalf("Wrong decimated length. got %v", len(filtered))
+	}
+	for m := 4; m < len(filtered)-4; m++ {
+		if math.Abs(filtered[m]) > 0.01 {
+			t.Errorf("Alias not removed at %v. got %v", m, filtered[m])
+		}
+	}
+}
+
+func TestLDSFilter(t *testing.T) {
+	// stairstep is 0, 3, 5, 8 and 10 in blocks of 100
+	stairstep := make([]float64, 500)
+	for i := range stairstep {
+		stairstep[i] = []float64{0, 3, 5, 8, 10}[i/100]
+	}
+	expected := makeLineOutputExpectedData(firDecimate(stairstep, 10, designLowPass(41, 10, "blackman")), 50, 100, 0, 10)
+	rr := SDSURLHandler(t, "/sds/lds/0/500/50/100/TestDir/stairstep.tmp?filter=fir&filtertaps=41&filterwindow=blackman", 200)
+	checkByteData(t, rr.Body.Bytes(), expected)
+
+	// Lines that are not thinned are not filtered
+	expected = makeLineOutputExpectedData(stairstep[95:105], 10, 100, 0, 10)
+	rr = SDSURLHandler(t, "/sds/lds/95/105/10/100/TestDir/stairstep.tmp?filter=fir", 200)
+	checkByteData(t, rr.Body.Bytes(), expected)
+}
+
+func TestXCutFilter(t *testing.T) {
+	// Row 30 is col/6. The default taps are 8 per decimated sample plus one.
+	row := make([]float64, 60)
+	for i := range row {
+		row[i] = float64(i / 6)
+	}
+	expected := makeLineOutputExpectedData(firDecimate(row, 3, designLowPass(25, 3, "hamming")), 20, 100, 0, 10)
+	rr := SDSURLHandler(t, "/sds/rdsxcut/0/30/60/31/20/100/TestDir/mydata_SB_60_60.tmp?filter=fir", 200)
+	checkByteData(t, rr.Body.Bytes(), expected)
+}
+
+func TestTuneComplexRDS(t *testing.T) {
+	// Elements of the complex file are v+jv where v is col/6. xdelta is 1 so tuning by 0.25 Hz turns each sample
+	// by a further -90 degrees. Row 30 starts at sample 1800, a whole number of cycles, so the real part is v*(cos+sin)
+	// which repeats 1, 1, -1, -1 from the start of the row.
+	rr := SDSURLHandler(t, "/sds/rds/0/30/12/31/12/1/TestDir/mydata_CF_60_60.tmp?outfmt=SD&cxmode=Re&tune=0.25", 200)
+	checkFloatData(t, rr.Body.Bytes(), []float64{0, 0, 0, 0, 0, 0, -1, -1, 1, 1, -1, -1})
+
+	// The magnitude is not changed by tuning
+	rr = SDSURLHandler(t, "/sds/rds/0/30/12/31/12/1/TestDir/mydata_CF_60_60.tmp?outfmt=SD&cxmode=Ma&tune=0.25", 200)
+	checkFloatData(t, rr.Body.Bytes(), []float64{0, 0, 0, 0, 0, 0, math.Sqrt2, math.Sqrt2, math.Sqrt2, math.Sqrt2, math.Sqrt2, math.Sqrt2})
+}
+
+func TestTuneComplexXCut(t *testing.T) {
+	values := make([]float64, 12)
+	for e := range values {
+		values[e] = float64(e/6) * []float64{1, 1, -1, -1}[e%4]
+	}
+	expected := makeLineOutputExpectedData(values, 12, 100, -1, 1)
+	rr := SDSURLHandler(t, "/sds/rdsxcut/0/30/12/31/12/100/TestDir/mydata_CF_60_60.tmp?cxmode=Re&tune=0.25&zmin=-1&zmax=1", 200)
+	checkByteData(t, rr.Body.Bytes(), expected)
+}
+
+func TestTuneChangesRangeKey(t *testing.T) {
+	request := rdsRequest{FileName: "mydata_CF_60_60.tmp", SourcePath: "TestDir/mydata_CF_60_60.tmp", FileXSize: 60, Cxmode: "Re"}
+	key := request.rangeIndexKey()
+	request.Tune = 0.25
+	if request.rangeIndexKey() == key {
+		t.Errorf("Range key does not depend on tune")
+	}
+}
+
+func TestBackgroundMedianBaseline(t *testing.T) {
+	// Each column is ten 0s, forty col/6 values and ten 10s, so the median of a column is col/6 and removing it
+	// leaves the middle rows at 0.
+	rr := SDSURLHandler(t, "/sds/rds/0/30/12/31/12/1/TestDir/mydata_SB_60_60.tmp?outfmt=SD&baseline=median", 200)
+	checkFloatData(t, rr.Body.Bytes(), []float64{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+	rr = SDSURLHandler(t, "/sds/rds/0/55/12/56/12/1/TestDir/mydata_SB_60_60.tmp?outfmt=SD&baseline=median", 200)
+	checkFloatData(t, rr.Body.Bytes(), []float64{10, 10, 10, 10, 10, 10, 9, 9, 9, 9, 9, 9})
+	// A reference range of the first rows gives a baseline of 0
+	rr = SDSURLHandler(t, "/sds/rds/0/55/12/56/12/1/TestDir/mydata_SB_60_60.tmp?outfmt=SD&baseline=median&baselinerows=0:10", 200)
+	checkFloatData(t, rr.Body.Bytes(), []float64{10, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10})
+}
+
+func TestBackgroundMeanBaseline(t *testing.T) {
+	// The column mean is (40*col/6 + 100)/60
+	rr := SDSURLHandler(t, "/sds/rds/5/30/7/31/2/1/TestDir/mydata_SB_60_60.tmp?outfmt=SD&baseline=mean", 200)
+	checkFloatData(t, rr.Body.Bytes(), []float64{0 - 100.0/60, 1 - 140.0/60})
+	rr = SDSURLHandler(t, "/sds/rds/5/30/7/31/2/1/TestDir/mydata_SB_60_60.tmp?outfmt=SD&baseline=mean&baselineop=divide&baselinerows=50:60", 200)
+	checkFloatData(t, rr.Body.Bytes(), []float64{0, 0.1})
+}
+
+func TestBackgroundRowNorm(t *testing.T) {
+	// Row 30 holds 0 to 9 in blocks of 6 columns, so its mean is 4.5 and standard deviation is sqrt(8.25).
+	rr := SDSURLHandler(t, "/sds/rds/5/30/7/31/2/1/TestDir/mydata_SB_60_60.tmp?outfmt=SD&rownorm=mean", 200)
+	checkFloatData(t, rr.Body.Bytes(), []float64{-4.5, -3.5})
+	rr = SDSURLHandler(t, "/sds/rds/5/30/7/31/2/1/TestDir/mydata_SB_60_60.tmp?outfmt=SD&rownorm=zscore", 200)
+	checkFloatData(t, rr.Body.Bytes(), []float64{-4.5 / math.Sqrt(8.25), -3.5 / math.Sqrt(8.25)})
+}
+
+func TestBackgroundOtherFileBuilding(t *testing.T) {
+	// A model still being found for another file does not hold up this one
+	backgroundModelsMutex.Lock()
+	building := &backgroundEntry{done: make(chan struct{})}
+	backgroundModels["otherfile"] = building
+	backgroundModelsMutex.Unlock()
+	defer func() {
+		close(building.done)
+		backgroundModelsMutex.Lock()
+		delete(backgroundModels, "otherfile")
+		backgroundModelsMutex.Unlock()
+	}()
+
+	finished := make(chan []byte, 1)
+	go func() {
+		finished <- SDSURLHandler(t, "/sds/rds/5/30/7/31/2/1/TestDir/mydata_SB_60_60.tmp?outfmt=SD&rownorm=mean", 200).Body.Bytes()
+	}()
+	select {
+	case data := <-finished:
+		checkFloatData(t, data, []float64{-4.5, -3.5})
+	case <-time.After(10 * time.Second):
+		t.Fatal("Background request waited for the model of another file")
+	}
+}
+
+func TestBackgroundTile(t *testing.T) {
+	// Tiles use the same background as rds. The first row of the tile is 0 with the column medians removed.
+	rr := SDSURLHandler(t, "/sds/rdstile/100/100/1/1/0/0/TestDir/mydata_SB_60_60.tmp?outfmt=SD&baseline=median", 200)
+	gotData := make([]float64, len(rr.Body.Bytes())/8)
+	_ = binary.Read(bytes.NewReader(rr.Body.Bytes()), binary.LittleEndian, &gotData)
+	if len(gotData) != 3600 {
+		t.Fatalf("Tile wrong size. got %v", len(gotData))
+	}
+	for x := 0; x < 60; x++ {
+		if gotData[x] != -float64(x/6) || gotData[30*60+x] != 0 {
+			t.Errorf("Tile value at column %v not as expected. got %v and %v", x, gotData[x], gotData[30*60+x])
+		}
+	}
+}
+
+func TestCompareSameData(t *testing.T) {
+	// The SB and SD files hold the same values
+	rr := SDSURLHandler(t, "/sds/rds/0/30/12/31/12/1/TestDir/mydata_SB_60_60.tmp?outfmt=SD&compare=TestDir/mydata_SD_60_60.tmp", 200)
+	checkFloatData(t, rr.Body.Bytes(), []float64{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+	rr = SDSURLHandler(t, "/sds/rds/6/30/12/31/6/1/TestDir/mydata_SB_60_60.tmp?outfmt=SD&compare=TestDir/mydata_SD_60_60.tmp&compareop=ratio", 200)
+	checkFloatData(t, rr.Body.Bytes(), []float64{1, 1, 1, 1, 1, 1})
+	rr = SDSURLHandler(t, "/sds/rds/6/30/12/31/6/1/TestDir/mydata_SB_60_60.tmp?outfmt=SD&compare=TestDir/mydata_SD_60_60.tmp&compareop=dbratio", 200)
+	checkFloatData(t, rr.Body.Bytes(), []float64{0, 0, 0, 0, 0, 0})
+}
+
+func TestCompareOffset(t *testing.T) {
+	// Row 130 of the 600 by 600 file is col/60, so columns 60 to 71 are all 1
+	rr := SDSURLHandler(t, "/sds/rds/0/30/12/31/12/1/TestDir/mydata_SB_60_60.tmp?outfmt=SD&compare=TestDir/mydata_SB_600_600.tmp&comparexoffset=60&compareyoffset=100", 200)
+	checkFloatData(t, rr.Body.Bytes(), []float64{-1, -1, -1, -1, -1, -1, 0, 0, 0, 0, 0, 0})
+	rr = SDSURLHandler(t, "/sds/rds/0/30/12/31/12/1/TestDir/mydata_SB_60_60.tmp?zmin=-1&zmax=0&compare=TestDir/mydata_SB_600_600.tmp&comparexoffset=60&compareyoffset=100", 200)
+	if len(rr.Body.Bytes()) != 12*4 {
+		t.Errorf("RGBA compare output has %d bytes, want %d", len(rr.Body.Bytes()), 12*4)
+	}
+}
+
+func TestCompareInvalidRequests(t *testing.T) {
+	// Scalar against complex data
+	SDSURLHandler(t, "/sds/rds/0/30/12/31/12/1/TestDir/mydata_SB_60_60.tmp?outfmt=SD&compare=TestDir/mydata_CF_60_60.tmp", 400)
+	// The compare file is too small for the file
+	SDSURLHandler(t, "/sds/rds/0/30/12/31/12/1/TestDir/mydata_SB_600_600.tmp?outfmt=SD&compare=TestDir/mydata_SB_60_60.tmp", 400)
+	// The offset moves the file past the end of the compare file
+	SDSURLHandler(t, "/sds/rds/0/30/12/31/12/1/TestDir/mydata_SB_60_60.tmp?outfmt=SD&compare=TestDir/mydata_SD_60_60.tmp&compareyoffset=1", 400)
+	SDSURLHandler(t, "/sds/rds/0/30/12/31/12/1/TestDir/mydata_SB_60_60.tmp?outfmt=SD&compare=TestDir/mydata_SD_60_60.tmp&comparexoffset=-1", 400)
+	SDSURLHandler(t, "/sds/rds/0/30/12/31/12/1/TestDir/mydata_SB_60_60.tmp?outfmt=SD&compare=TestDir/missing.tmp", 400)
+	// Paths that could leave the location are refused, even when the file they name is in it
+	SDSURLHandler(t, "/sds/rds/0/30/12/31/12/1/TestDir/mydata_SB_60_60.tmp?outfmt=SD&compare=TestDir/../tests/mydata_SD_60_60.tmp", 400)
+	SDSURLHandler(t, "/sds/rdstile/100/100/1/1/0/0/TestDir/mydata_SB_60_60.tmp?compare=TestDir/mydata_CF_60_60.tmp", 400)
+}
+
+func TestCompareLDS(t *testing.T) {
+	expected := makeLineOutputExpectedData(make([]float64, 10), 10, 100, -1, 1)
+	rr := SDSURLHandler(t, "/sds/lds/95/105/10/100/TestDir/stairstep.tmp?zmin=-1&zmax=1&compare=TestDir/stairstep.tmp", 200)
+	checkByteData(t, rr.Body.Bytes(), expected)
+	// Line plots are compared with type 1000 files only
+	SDSURLHandler(t, "/sds/lds/95/105/10/100/TestDir/stairstep.tmp?compare=TestDir/mydata_SB_60_60.tmp", 400)
+}
+
+func TestExpressionPrecedence(t *testing.T) {
+	cases := map[string]float64{
+		"1+2*3":           7,
+		"-2^2":            -4,
+		"2^3^2":           512,
+		"(1+2)*3":         9,
+		"10%4":            2,
+		"1e3/10":          100,
+		"(1<2)&&(2<1)":    0,
+		"1<2||2<1":        1,
+		"!0 + (3>=3)":     2,
+		"max(1,5,3)":      5,
+		"clamp(7,0,5)":    5,
+		"if(0,1,2)":       2,
+		"log10(100)+pi*0": 2,
+	}
+	for expr, expected := range cases {
+		root, err := compileExpression(expr, 0)
+		if err != nil {
+			t.Errorf("compileExpression(%q) failed: %v", expr, err)
+			continue
+		}
+		if value := root(&exprEnv{Values: []float64{0}}); value != expected {
+			t.Errorf("%q = %v, want %v", expr, value, expected)
+		}
+	}
+}
+
+func TestExpressionRDS(t *testing.T) {
+	// Row 30 of the SB file is col/6
+	rr := SDSURLHandler(t, "/sds/rds/0/30/12/31/12/1/TestDir/mydata_SB_60_60.tmp?outfmt=SD&expr="+url.QueryEscape("2*a+1"), 200)
+	checkFloatData(t, rr.Body.Bytes(), []float64{1, 1, 1, 1, 1, 1, 3, 3, 3, 3, 3, 3})
+	rr = SDSURLHandler(t, "/sds/rds/0/30/12/31/12/1/TestDir/mydata_SB_60_60.tmp?outfmt=SD&expr="+url.QueryEscape("x+y"), 200)
+	checkFloatData(t, rr.Body.Bytes(), []float64{30, 31, 32, 33, 34, 35, 36, 37, 38, 39, 40, 41})
+	rr = SDSURLHandler(t, "/sds/rds/0/30/12/31/12/1/TestDir/mydata_SB_60_60.tmp?outfmt=SD&expr="+url.QueryEscape("(a>=1)*10"), 200)
+	checkFloatData(t, rr.Body.Bytes(), []float64{0, 0, 0, 0, 0, 0, 10, 10, 10, 10, 10, 10})
+
+	// b and c are the files given by exprfile, in order
+	rr = SDSURLHandler(t, "/sds/rds/0/30/12/31/12/1/TestDir/mydata_SB_60_60.tmp?outfmt=SD&exprfile=TestDir/mydata_SD_60_60.tmp&exprfile=TestDir/mydata_SI_60_60.tmp&expr="+url.QueryEscape("a+b-2*c+max(a,1)"), 200)
+	checkFloatData(t, rr.Body.Bytes(), []float64{1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1})
+}
+
+func TestExpressionInvalidRequests(t *testing.T) {
+	invalid := map[string]string{
+		"a+":        "unexpected end of expression",
+		"foo(a)":    "unknown function",
+		"b":         "unknown name",
+		"sqrt(a,1)": "called with 2 arguments",
+		"a $ 2":     "unexpected character",
+		"(a+1":      "expected \")\"",
+		"a 2":       "unexpected \"2\" at position 3",
+	}
+	for expr, message := range invalid {
+		rr := SDSURLHandler(t, "/sds/rds/0/30/12/31/12/1/TestDir/mydata_SB_60_60.tmp?outfmt=SD&expr="+url.QueryEscape(expr), 400)
+		if !bytes.Contains(rr.Body.Bytes(), []byte(message)) {
+			t.Errorf("Error for %q is %q, want it to contain %q", expr, rr.Body.String(), message)
+		}
+	}
+	// The files of an expression must match the file of the request
+	SDSURLHandler(t, "/sds/rds/0/30/12/31/12/1/TestDir/mydata_SB_60_60.tmp?outfmt=SD&exprfile=TestDir/mydata_CF_60_60.tmp&expr=a-b", 400)
+	SDSURLHandler(t, "/sds/rds/0/30/12/31/12/1/TestDir/mydata_SB_60_60.tmp?outfmt=SD&exprfile=TestDir/../tests/mydata_SD_60_60.tmp&expr=a-b", 400)
+}
+
+func checkPeaks(t *testing.T, body []byte, expectedX []int, expectedValues []float64) peaksResult {
+	var result peaksResult
+	if err := json.Unmarshal(body, &result); err != nil {
+		t.Fatal("Unable to decode peaks:", err)
+	}
+	if len(result.Peaks) != len(expectedX) {
+		t.Fatalf("Found %d peaks, want %d: %v", len(result.Peaks), len(expectedX), result.Peaks)
+	}
+	for i := range expectedX {
+		if result.Peaks[i].X != expectedX[i] || result.Peaks[i].Value != expectedValues[i] {
+			t.Errorf("Peak %d is %v, want x=%d value=%v", i, result.Peaks[i], expectedX[i], expectedValues[i])
+		}
+	}
+	return result
+}
+
+func TestPeaksLine(t *testing.T) {
+	// peaks_SF_1000 is 1 apart from peaks of 10 at 100, 8 at 103, 1.5 at 200 and 6 at 400, a flat top of 5 at 700 to 702
+	// and steps up to 2 at 850 and 3 at 900 to the end, which are not peaks. xstart is 100 and xdelta is 0.5.
+	rr := SDSURLHandler(t, "/sds/peaks/TestDir/peaks_SF_1000.tmp", 200)
+	result := checkPeaks(t, rr.Body.Bytes(), []int{100, 103, 400, 700, 200}, []float64{10, 8, 6, 5, 1.5})
+	if result.Peaks[0].XValue != 150 || result.Candidates != 5 || result.Truncated {
+		t.Errorf("Unexpected peaks result %+v", result)
+	}
+	checkHeaderFloat(t, rr, "numpeaks", 5, 0)
+
+	rr = SDSURLHandler(t, "/sds/peaks/TestDir/peaks_SF_1000.tmp?separation=5", 200)
+	checkPeaks(t, rr.Body.Bytes(), []int{100, 400, 700, 200}, []float64{10, 6, 5, 1.5})
+	rr = SDSURLHandler(t, "/sds/peaks/TestDir/peaks_SF_1000.tmp?threshold=5.5", 200)
+	checkPeaks(t, rr.Body.Bytes(), []int{100, 103, 400}, []float64{10, 8, 6})
+	rr = SDSURLHandler(t, "/sds/peaks/TestDir/peaks_SF_1000.tmp?top=2", 200)
+	checkPeaks(t, rr.Body.Bytes(), []int{100, 103}, []float64{10, 8})
+	rr = SDSURLHandler(t, "/sds/peaks/TestDir/peaks_SF_1000.tmp?x1=300&x2=800", 200)
+	checkPeaks(t, rr.Body.Bytes(), []int{400, 700}, []float64{6, 5})
+
+	// The noise floor is close to 1 so peaks must be above about 5
+	rr = SDSURLHandler(t, "/sds/peaks/TestDir/peaks_SF_1000.tmp?thresholdmode=floor&threshold=4", 200)
+	result = checkPeaks(t, rr.Body.Bytes(), []int{100, 103, 400}, []float64{10, 8, 6})
+	if math.Abs(result.Floor-1) > 0.01 || result.Level != result.Floor+4 {
+		t.Errorf("Floor %v and level %v, want 1 and 5", result.Floor, result.Level)
+	}
+}
+
+func TestPeaksRows(t *testing.T) {
+	// Rows of the SB file only step up, so they have no peaks
+	rr := SDSURLHandler(t, "/sds/peaks/TestDir/mydata_SB_60_60.tmp", 200)
+	checkPeaks(t, rr.Body.Bytes(), []int{}, []float64{})
+	// With cxmode Lo every step is still a step up
+	rr = SDSURLHandler(t, "/sds/peaks/TestDir/mydata_SB_60_60.tmp?cxmode=Lo&y1=20&y2=30", 200)
+	checkPeaks(t, rr.Body.Bytes(), []int{}, []float64{})
+}
+
+// rawRowRequest returns a request for the values written as a single row of an SF file with no header.
+func rawRowRequest(t *testing.T, values []float32) rdsRequest {
+	name := t.TempDir() + "/row.tmp"
+	data := new(bytes.Buffer)
+	binary.Write(data, binary.LittleEndian, values)
+	ioutil.WriteFile(name, data.Bytes(), 0644)
+	file, _ := os.Open(name)
+	t.Cleanup(func() { file.Close() })
+	return rdsRequest{Reader: file, FileName: name, FileFormat: "SF", FileXSize: len(values), FileYSize: 1, Xsize: len(values), Ysize: 1}
+}
+
+func TestPeaksAcrossSegments(t *testing.T) {
+	// A flat top from column maxSegmentElements-6 to maxSegmentElements+4 spans two segments and is one peak
+	values := make([]float32, 2*maxSegmentElements+10)
+	for x := maxSegmentElements - 6; x <= maxSegmentElements+4; x++ {
+		values[x] = 5
+	}
+	// One that runs into a step up in the next segment is not
+	for x := 2*maxSegmentElements - 2; x <= 2*maxSegmentElements+2; x++ {
+		values[x] = 3
+	}
+	values[2*maxSegmentElements+3] = 4
+	candidates, total, _ := findPeakCandidates(rawRowRequest(t, values), math.Inf(-1))
+	if total != 2 || len(candidates) != 2 {
+		t.Fatalf("Got %d candidates %v, want the flat top at %d and the step at %d", total, candidates, maxSegmentElements-6, 2*maxSegmentElements+3)
+	}
+	for _, candidate := range candidates {
+		if candidate.X != maxSegmentElements-6 && candidate.X != 2*maxSegmentElements+3 {
+			t.Errorf("Unexpected candidate %v", candidate)
+		}
+	}
+}
+
+func TestPeaksInfinite(t *testing.T) {
+	inf := float32(math.Inf(1))
+	candidates, total, _ := findPeakCandidates(rawRowRequest(t, []float32{0, inf, 0, 3, 0}), math.Inf(-1))
+	if total != 1 || len(candidates) != 1 || candidates[0].X != 3 {
+		t.Errorf("Got %d candidates %v, want only the peak at 3", total, candidates)
+	}
+}
+
+func TestPeaksInvalidRequests(t *testing.T) {
+	SDSURLHandler(t, "/sds/peaks/TestDir/peaks_SF_1000.tmp?threshold=Inf", 400)
+	SDSURLHandler(t, "/sds/peaks/TestDir/peaks_SF_1000.tmp?threshold=NaN", 400)
+	SDSURLHandler(t, "/sds/peaks/TestDir/peaks_SF_1000.tmp?thresholdmode=bogus", 400)
+	SDSURLHandler(t, "/sds/peaks/TestDir/peaks_SF_1000.tmp?separation=0", 400)
+	SDSURLHandler(t, "/sds/peaks/TestDir/peaks_SF_1000.tmp?top=-1", 400)
+	SDSURLHandler(t, "/sds/peaks/TestDir/peaks_SF_1000.tmp?x2=1001", 400)
+	SDSURLHandler(t, "/sds/peaks/TestDir/missing.tmp", 400)
+}
+
+func TestMaskBinary(t *testing.T) {
+	// Row 30 of the SB file is col/6
+	expected := make([]byte, 60)
+	for i := 30; i < 60; i++ {
+		expected[i] = 1
+	}
+	rr := SDSURLHandler(t, "/sds/rds/0/30/60/31/60/1/TestDir/mydata_SB_60_60.tmp?outfmt=SB&mask=above:4.5", 200)
+	checkByteData(t, rr.Body.Bytes(), expected)
+	if rr.Header().Get("mask") != "above:4.5" {
+		t.Errorf("mask header is %q", rr.Header().Get("mask"))
+	}
+
+	// Columns 12 to 23 are 2 then 3, and the 12 mask bits are padded to 2 bytes
+	rr = SDSURLHandler(t, "/sds/rds/12/30/24/31/12/1/TestDir/mydata_SB_60_60.tmp?outfmt=SP&mask=band:3:4", 200)
+	checkByteData(t, rr.Body.Bytes(), []byte{0x03, 0xf0})
+	rr = SDSURLHandler(t, "/sds/rds/12/30/24/31/12/1/TestDir/mydata_SB_60_60.tmp?outfmt=SP&mask=below:3", 200)
+	checkByteData(t, rr.Body.Bytes(), []byte{0xfc, 0x00})
+
+	// Elements that are not set are transparent
+	rr = SDSURLHandler(t, "/sds/rds/0/30/12/31/12/1/TestDir/mydata_SB_60_60.tmp?mask=above:0.5&maskcolor=00ff0080", 200)
+	expected = make([]byte, 0, 48)
+	for i := 0; i < 12; i++ {
+		if i < 6 {
+			expected = append(expected, 0, 0, 0, 0)
+		} else {
+			expected = append(expected, 0, 255, 0, 128)
+		}
+	}
+	checkByteData(t, rr.Body.Bytes(), expected)
+}
+
+func TestMaskClasses(t *testing.T) {
+	rr := SDSURLHandler(t, "/sds/rds/0/30/60/31/10/1/TestDir/mydata_SB_60_60.tmp?outfmt=SB&mask=classes:2:5", 200)
+	checkByteData(t, rr.Body.Bytes(), []byte{0, 0, 1, 1, 1, 2, 2, 2, 2, 2})
+
+	// An invalid mask is ignored
+	rr = SDSURLHandler(t, "/sds/rds/0/30/60/31/10/1/TestDir/mydata_SB_60_60.tmp?outfmt=SB&mask=classes:5:2", 200)
+	checkByteData(t, rr.Body.Bytes(), []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9})
+	if rr.Header().Get("mask") != "" {
+		t.Errorf("mask header is %q for an invalid mask", rr.Header().Get("mask"))
+	}
+}
+
+func TestMaskPNG(t *testing.T) {
+	rr := SDSURLHandler(t, "/sds/rds/0/30/60/32/10/2/TestDir/mydata_SB_60_60.tmp?outfmt=PNG&mask=above:4.5", 200)
+	if rr.Header().Get("Content-Type") != "image/png" {
+		t.Errorf("Content-Type is %q", rr.Header().Get("Content-Type"))
+	}
+	img, err := png.Decode(bytes.NewReader(rr.Body.Bytes()))
+	if err != nil {
+		t.Fatal("Unable to decode PNG:", err)
+	}
+	if img.Bounds().Dx() != 10 || img.Bounds().Dy() != 2 {
+		t.Fatalf("PNG is %v, want 10 by 2", img.Bounds())
+	}
+	for x := 0; x < 10; x++ {
+		r, g, b, a := img.At(x, 1).RGBA()
+		set := r == 0xffff && g == 0 && b == 0 && a == 0xffff
+		if set != (x >= 5) || (!set && a != 0) {
+			t.Errorf("Pixel %d is %v %v %v %v", x, r, g, b, a)
+		}
+	}
+
+	// PNG works for colormapped output too
+	rr = SDSURLHandler(t, "/sds/rds/0/30/60/32/10/2/TestDir/mydata_SB_60_60.tmp?outfmt=PNG", 200)
+	img, err = png.Decode(bytes.NewReader(rr.Body.Bytes()))
+	if err != nil || img.Bounds().Dx() != 10 || img.Bounds().Dy() != 2 {
+		t.Errorf("Colormapped PNG could not be decoded or has the wrong size: %v", err)
+	}
+	checkHeaderFloat(t, rr, "zmax", 10, 0)
+}
+
+func TestMaskTile(t *testing.T) {
+	rr := SDSURLHandler(t, "/sds/rdstile/100/100/1/1/0/0/TestDir/mydata_SB_60_60.tmp?outfmt=SB&mask=above:4.5", 200)
+	data := rr.Body.Bytes()
+	if len(data) != 60*60 {
+		t.Fatalf("Tile mask has %d bytes, want %d", len(data), 60*60)
+	}
+	if data[30*60+59] != 1 || data[30*60+0] != 0 || data[55*60] != 1 || data[0] != 0 {
+		t.Errorf("Tile mask is not as expected")
+	}
+	if rr.Header().Get("mask") != "above:4.5" || rr.Header().Get("autoscale") != "" {
+		t.Errorf("Tile headers are not as expected: mask %q autoscale %q", rr.Header().Get("mask"), rr.Header().Get("autoscale"))
+	}
+}
+
+// readFloat32s decodes little endian SF output.
+func readFloat32s(t *testing.T, returnBytes []byte) []float64 {
+	values := make([]float32, len(returnBytes)/4)
+	if err := binary.Read(bytes.NewReader(returnBytes), binary.LittleEndian, &values); err != nil {
+		t.Fatal("Unable to decode SF output:", err)
+	}
+	outData := make([]float64, len(values))
+	for i := range values {
+		outData[i] = float64(values[i])
+	}
+	return outData
+}
+
+// toneAM is the envelope of sample k of tone_CF_4000, a 1000 Hz tone at 8000 samples per second with a 100 Hz AM of depth 0.5.
+func toneAM(k float64) float64 {
+	return 1 + 0.5*math.Cos(2*math.Pi*100*k/8000)
+}
+
+func TestLDSComplexFile(t *testing.T) {
+	// Each element of a complex type 1000 file is a pair of values, so tone_CF_4000 has 4000 elements
+	values := make([]float64, 10)
+	for i := range values {
+		values[i] = toneAM(float64(3990 + i))
+	}
+	rr := SDSURLHandler(t, "/sds/lds/3990/4000/10/100/TestDir/tone_CF_4000.tmp?cxmode=Ma&zmin=0.5&zmax=1.5", 200)
+	checkByteData(t, rr.Body.Bytes(), makeLineOutputExpectedData(values, 10, 100, 0.5, 1.5))
+	SDSURLHandler(t, "/sds/lds/3990/4001/10/100/TestDir/tone_CF_4000.tmp?cxmode=Ma&zmin=0.5&zmax=1.5", 400)
+}
+
+func TestZminMaxLarge1DFile(t *testing.T) {
+	// tone_CF_4000 is 32000 bytes, more than maxBytesZminZmax of the test config, so four sections of 1250/4 elements are sampled
+	rr := SDSURLHandler(t, "/sds/lds/0/100/100/100/TestDir/tone_CF_4000.tmp?cxmode=Ma", 200)
+	if rr.Header().Get("zmin") != "0.500000" || rr.Header().Get("zmax") != "1.500000" {
+		t.Errorf("Sampled zmin and zmax of a large 1D file got %v %v want 0.500000 1.500000", rr.Header().Get("zmin"), rr.Header().Get("zmax"))
+	}
+}
+
+func TestDemodAMFMPM(t *testing.T) {
+	rr := SDSURLHandler(t, "/sds/demod/TestDir/tone_CF_4000.tmp?demod=am&x1=0&x2=16", 200)
+	values := readFloat32s(t, rr.Body.Bytes())
+	if len(values) != 16 {
+		t.Fatalf("Got %d samples, want 16", len(values))
+	}
+	for k, value := range values {
+		if math.Abs(value-toneAM(float64(k))) > 1e-5 {
+			t.Errorf("AM sample %d is %v, want %v", k, value, toneAM(float64(k)))
+		}
+	}
+
+	rr = SDSURLHandler(t, "/sds/demod/TestDir/tone_CF_4000.tmp?demod=fm&x1=1&x2=17&outfmt=SD", 200)
+	checkFloatData(t, rr.Body.Bytes(), []float64{1000, 1000, 1000, 1000, 1000, 1000, 1000, 1000, 1000, 1000, 1000, 1000, 1000, 1000, 1000, 1000})
+	// Tuning down by the tone frequency leaves no frequency offset
+	rr = SDSURLHandler(t, "/sds/demod/TestDir/tone_CF_4000.tmp?demod=fm&tune=1000&x1=1&x2=17&outfmt=SD", 200)
+	checkFloatData(t, rr.Body.Bytes(), make([]float64, 16))
+
+	rr = SDSURLHandler(t, "/sds/demod/TestDir/tone_CF_4000.tmp?demod=pm&x1=0&x2=4&outfmt=SD", 200)
+	checkFloatData(t, rr.Body.Bytes(), []float64{0, math.Pi / 4, math.Pi / 2, 3 * math.Pi / 4})
+}
+
+func TestDemodBandwidthAndRate(t *testing.T) {
+	// A 500 Hz bandwidth removes the 1000 Hz tone
+	rr := SDSURLHandler(t, "/sds/demod/TestDir/tone_CF_4000.tmp?demod=am&bandwidth=500&x1=1000&x2=1010", 200)
+	for k, value := range readFloat32s(t, rr.Body.Bytes()) {
+		if value > 0.02 {
+			t.Errorf("AM sample %d is %v after filtering out the tone", k, value)
+		}
+	}
+
+	// Half the rate gives every other sample, filtered to 2000 Hz which keeps the 100 Hz envelope
+	rr = SDSURLHandler(t, "/sds/demod/TestDir/tone_CF_4000.tmp?demod=am&rate=4000", 200)
+	values := readFloat32s(t, rr.Body.Bytes())
+	if len(values) != 2000 || rr.Header().Get("numsamples") != "2000" || rr.Header().Get("rate") != "4000" {
+		t.Fatalf("Got %d samples and headers %v", len(values), rr.Header())
+	}
+	for k := 500; k < 1500; k += 97 {
+		if math.Abs(values[k]-toneAM(float64(2*k))) > 0.01 {
+			t.Errorf("Resampled AM sample %d is %v, want %v", k, values[k], toneAM(float64(2*k)))
+		}
+	}
+}
+
+func TestDemodWAV(t *testing.T) {
+	rr := SDSURLHandler(t, "/sds/demod/TestDir/tone_CF_4000.tmp?demod=am&outfmt=WAV&rate=8000&zmin=0.5&zmax=1.5", 200)
+	data := rr.Body.Bytes()
+	if rr.Header().Get("Content-Type") != "audio/wav" || len(data) != 44+2*4000 {
+		t.Fatalf("WAV has content type %q and %d bytes", rr.Header().Get("Content-Type"), len(data))
+	}
+	if string(data[0:4]) != "RIFF" || string(data[8:16]) != "WAVEfmt " || string(data[36:40]) != "data" {
+		t.Errorf("WAV header is not as expected: %q", data[:44])
+	}
+	if rate := binary.LittleEndian.Uint32(data[24:28]); rate != 8000 {
+		t.Errorf("WAV rate is %d, want 8000", rate)
+	}
+	// The envelope peaks at 1.5, which is zmax, at sample 0 and is 0.5, zmin, at sample 40
+	if first := int16(binary.LittleEndian.Uint16(data[44:46])); first < 32700 {
+		t.Errorf("First WAV sample is %d, want full scale", first)
+	}
+	if trough := int16(binary.LittleEndian.Uint16(data[44+80 : 46+80])); trough > -32700 {
+		t.Errorf("WAV sample 40 is %d, want negative full scale", trough)
+	}
+}
+
+func TestDemodLDS(t *testing.T) {
+	values := make([]float64, 100)
+	for i := range values {
+		values[i] = 1000
+	}
+	expected := makeLineOutputExpectedData(values, 100, 101, 0, 2000)
+	rr := SDSURLHandler(t, "/sds/lds/1/101/100/101/TestDir/tone_CF_4000.tmp?demod=fm&zmin=0&zmax=2000", 200)
+	checkByteData(t, rr.Body.Bytes(), expected)
+	// The complex file is 4000 samples long
+	SDSURLHandler(t, "/sds/lds/0/4001/100/100/TestDir/tone_CF_4000.tmp?demod=fm", 400)
+
+	// Without zmin and zmax the range is found from demodulated sections of the file
+	rr = SDSURLHandler(t, "/sds/lds/0/100/100/100/TestDir/tone_CF_4000.tmp?demod=am", 200)
+	if rr.Header().Get("zmin") != "0.500000" || rr.Header().Get("zmax") != "1.500000" {
+		t.Errorf("Demodulated zmin and zmax got %v %v want 0.500000 1.500000", rr.Header().Get("zmin"), rr.Header().Get("zmax"))
+	}
+}
+
+func TestDemodLinePastEnd(t *testing.T) {
+	request := rdsRequest{FileFormat: "CF", FileXSize: 4000, FileYSize: 1, Filexdelta: 1.0 / 8000, Demod: "am"}
+	file, _ := os.Open("./tests/tone_CF_4000.tmp")
+	defer file.Close()
+	request.Reader = file
+	request.FileDataOffset = 512
+	if values := request.demodLine(0, 3990, 100); len(values) != 10 || math.Abs(values[9]-toneAM(3999)) > 1e-5 {
+		t.Errorf("Line running past the end of the file got %d values ending %v, want 10 ending %v", len(values), values[len(values)-1], toneAM(3999))
+	}
+	if values := request.demodLine(0, 5000, 100); len(values) != 0 {
+		t.Errorf("Line after the end of the file got %d values, want none", len(values))
+	}
+}
+
+func TestDemodInvalidRequests(t *testing.T) {
+	SDSURLHandler(t, "/sds/demod/TestDir/tone_CF_4000.tmp", 400)
+	SDSURLHandler(t, "/sds/demod/TestDir/tone_CF_4000.tmp?demod=qam", 400)
+	SDSURLHandler(t, "/sds/demod/TestDir/tone_CF_4000.tmp?demod=am&outfmt=RGBA", 400)
+	SDSURLHandler(t, "/sds/demod/TestDir/tone_CF_4000.tmp?demod=am&outfmt=WAV&rate=8000.5", 400)
+	SDSURLHandler(t, "/sds/demod/TestDir/tone_CF_4000.tmp?demod=am&rate=-1", 400)
+	SDSURLHandler(t, "/sds/demod/TestDir/stairstep.tmp?demod=am", 400)
+	SDSURLHandler(t, "/sds/demod/TestDir/mydata_CF_60_60.tmp?demod=am", 400)
+}
+
+func SDSRangeHandler(t *testing.T, sdsurl string, byteRange string, expectedReturnCode int) *httptest.ResponseRecorder {
+	os.Args = []string{"cmd", "-usecache=false", "-config=./tests/sdsTestConfig.json"}
+
+	t.Log("url:", sdsurl, "range:", byteRange)
+	req, err := http.NewRequest("GET", sdsurl, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Range", byteRange)
+
+	setupConfigLogCache()
+
+	rr := httptest.NewRecorder()
+	rdsServer := &routerServer{}
+	rdsServer.ServeHTTP(rr, req)
+
+	if rr.Code != expectedReturnCode {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, expectedReturnCode)
+	}
+	return rr
+}
+
+func TestAudioWholeFile(t *testing.T) {
+	rr := SDSURLHandler(t, "/sds/audio/TestDir/tone_CF_4000.tmp?demod=am&rate=8000", 200)
+	body := rr.Body.Bytes()
+	if len(body) != wavHeaderSize+4000*2 {
+		t.Fatalf("Audio length wrong. Got %v expected %v", len(body), wavHeaderSize+4000*2)
+	}
+	if rr.Header().Get("Accept-Ranges") != "bytes" || rr.Header().Get("Content-Type") != "audio/wav" {
+		t.Errorf("Audio headers wrong. Got Accept-Ranges %v Content-Type %v", rr.Header().Get("Accept-Ranges"), rr.Header().Get("Content-Type"))
+	}
+	if rr.Header().Get("numsamples") != "4000" || rr.Header().Get("rate") != "8000" {
+		t.Errorf("Audio headers wrong. Got numsamples %v rate %v", rr.Header().Get("numsamples"), rr.Header().Get("rate"))
+	}
+
+	// The stream is the same WAV file that demod mode gives
+	demod := SDSURLHandler(t, "/sds/demod/TestDir/tone_CF_4000.tmp?demod=am&rate=8000&outfmt=WAV", 200)
+	if !bytes.Equal(body, demod.Body.Bytes()) {
+		t.Errorf("Audio stream does not match the demod WAV output")
+	}
+}
+
+func TestAudioRanges(t *testing.T) {
+	url := "/sds/audio/TestDir/stairstep.tmp?rate=8000&x1=100&x2=300"
+	full := SDSURLHandler(t, url, 200).Body.Bytes()
+	if len(full) != wavHeaderSize+16000*2 {
+		t.Fatalf("Audio length wrong. Got %v expected %v", len(full), wavHeaderSize+16000*2)
+	}
+
+	ranges := [][2]int{{0, 9}, {44, 53}, {40, 47}, {1001, 1010}, {30000, 32043}}
+	for _, byteRange := range ranges {
+		rr := SDSRangeHandler(t, url, "bytes="+strconv.Itoa(byteRange[0])+"-"+strconv.Itoa(byteRange[1]), 206)
+		expected := full[byteRange[0] : byteRange[1]+1]
+		if !bytes.Equal(rr.Body.Bytes(), expected) {
+			t.Errorf("Range %v did not match the whole file. Got %v expected %v", byteRange, rr.Body.Bytes(), expected)
+		}
+	}
+	rr := SDSRangeHandler(t, url, "bytes=-4", 206)
+	if !bytes.Equal(rr.Body.Bytes(), full[len(full)-4:]) {
+		t.Errorf("Suffix range did not match the whole file. Got %v expected %v", rr.Body.Bytes(), full[len(full)-4:])
+	}
+	SDSRangeHandler(t, url, "bytes=40000-40010", 416)
+}
+
+func TestAudioInvalidRequests(t *testing.T) {
+	SDSURLHandler(t, "/sds/audio/TestDir/stairstep.tmp?rate=12345", 400)
+	SDSURLHandler(t, "/sds/audio/TestDir/stairstep.tmp?x1=100&x2=100", 400)
+	SDSURLHandler(t, "/sds/audio/TestDir/mydata_SB_60_60.tmp", 400)
+	SDSURLHandler(t, "/sds/audio/TestDir/stairstep.tmp?subsize=100", 400)
+}
+
+func TestResampleRatio(t *testing.T) {
+	// stairstep is 500 samples stepping through 0, 3, 5, 8 and 10 every 100 samples
+	rr := SDSURLHandler(t, "/sds/lds/0/500/100/100/TestDir/stairstep.tmp?resample=1/2&outfmt=SF&values=true", 200)
+	values := readFloat32s(t, rr.Body.Bytes())
+	if len(values) != 250 {
+		t.Fatalf("Got %d samples, want 250", len(values))
+	}
+	checkHeaderFloat(t, rr, "filexdelta", 0.02, 1e-9)
+	if rr.Header().Get("resample") != "1/2" || rr.Header().Get("numsamples") != "250" {
+		t.Errorf("Resample headers wrong. Got resample %v numsamples %v", rr.Header().Get("resample"), rr.Header().Get("numsamples"))
+	}
+	for i, step := range []float64{0, 3, 5, 8, 10} {
+		if math.Abs(values[25+50*i]-step) > 0.01 {
+			t.Errorf("Sample %d is %v, want %v", 25+50*i, values[25+50*i], step)
+		}
+	}
+
+	// A target xdelta gives the same ratio
+	rr = SDSURLHandler(t, "/sds/lds/0/500/100/100/TestDir/stairstep.tmp?resample=0.02&outfmt=SF&values=true", 200)
+	target := readFloat32s(t, rr.Body.Bytes())
+	if len(target) != len(values) {
+		t.Fatalf("Got %d samples for the target xdelta, want %d", len(target), len(values))
+	}
+	for i := range values {
+		if target[i] != values[i] {
+			t.Fatalf("Sample %d for the target xdelta is %v, want %v", i, target[i], values[i])
+		}
+	}
+}
+
+func TestResampleShortFilter(t *testing.T) {
+	// Too few taps for every phase of the filter to have a tap inside a hann window
+	rr := SDSURLHandler(t, "/sds/lds/0/500/100/100/TestDir/stairstep.tmp?resample=3/1&filtertaps=3&filterwindow=hann&outfmt=SF&values=true", 200)
+	values := readFloat32s(t, rr.Body.Bytes())
+	if len(values) != 1500 {
+		t.Fatalf("Got %d samples, want 1500", len(values))
+	}
+	for i, step := range []float64{0, 3, 5, 8, 10} {
+		for n := 300*i + 30; n < 300*i+270; n++ {
+			if !(math.Abs(values[n]-step) <= 1e-4) {
+				t.Fatalf("Sample %d is %v, want %v", n, values[n], step)
+			}
+		}
+	}
+}
+
+func TestResamplePolyphase(t *testing.T) {
+	// 3/2 gives a sample every 2/3 of an input sample, in between the samples of the file
+	rr := SDSURLHandler(t, "/sds/lds/0/4000/100/100/TestDir/tone_CF_4000.tmp?demod=am&resample=3/2&outfmt=SF&values=true", 200)
+	values := readFloat32s(t, rr.Body.Bytes())
+	if len(values) != 6000 {
+		t.Fatalf("Got %d samples, want 6000", len(values))
+	}
+	checkHeaderFloat(t, rr, "filexdelta", 1.0/12000, 1e-6)
+	for n := 100; n < 5900; n++ {
+		expected := toneAM(float64(n) * 2 / 3)
+		if math.Abs(values[n]-expected) > 1e-3 {
+			t.Fatalf("Sample %d is %v, want %v", n, values[n], expected)
+		}
+	}
+
+	// Ratios are reduced to lowest terms and the plot of the line is still made
+	rr = SDSURLHandler(t, "/sds/lds/0/4000/100/101/TestDir/tone_CF_4000.tmp?demod=am&resample=6/4&zmin=0&zmax=2", 200)
+	if rr.Header().Get("resample") != "3/2" {
+		t.Errorf("resample header is %v, want 3/2", rr.Header().Get("resample"))
+	}
+}
+
+func TestResampleInvalidRequests(t *testing.T) {
+	SDSURLHandler(t, "/sds/lds/0/500/100/100/TestDir/stairstep.tmp?resample=0/1", 400)
+	SDSURLHandler(t, "/sds/lds/0/500/100/100/TestDir/stairstep.tmp?resample=1/2000", 400)
+	SDSURLHandler(t, "/sds/lds/0/500/100/100/TestDir/stairstep.tmp?resample=-0.01", 400)
+	SDSURLHandler(t, "/sds/lds/0/500/100/100/TestDir/stairstep.tmp?resample=abc", 400)
+	SDSURLHandler(t, "/sds/lds/0/500/100/100/TestDir/stairstep.tmp?resample=0.000001", 400)
+}
+
+func checkBinEdges(t *testing.T, rr *httptest.ResponseRecorder, expected []float64) {
+	if rr.Header().Get("xscale") != "log" {
+		t.Errorf("xscale header is %v, want log", rr.Header().Get("xscale"))
+	}
+	low, lowErr := strconv.ParseFloat(rr.Header().Get("xbinlow"), 64)
+	high, highErr := strconv.ParseFloat(rr.Header().Get("xbinhigh"), 64)
+	if lowErr != nil || highErr != nil {
+		t.Fatalf("Bin range headers are %q and %q", rr.Header().Get("xbinlow"), rr.Header().Get("xbinhigh"))
+	}
+	numBins := len(expected) - 1
+	for i := range expected {
+		edge := low * math.Pow(high/low, float64(i)/float64(numBins))
+		if math.Abs(edge-expected[i]) > 1e-6*expected[i] {
+			t.Errorf("Bin edge %d is %v, want %v", i, edge, expected[i])
+		}
+	}
+}
+
+func TestLogXScaleLDS(t *testing.T) {
+	// stairstep steps through 0, 3, 5, 8 and 10 every 100 samples, with an xdelta of 0.01. The first sample is at 0 so the bins start at 0.01.
+	rr := SDSURLHandler(t, "/sds/lds/0/500/4/100/TestDir/stairstep.tmp?xscale=log&transform=max&outfmt=SF&values=true", 200)
+	checkBinEdges(t, rr, []float64{0.01, 0.01 * math.Pow(500, 0.25), 0.01 * math.Pow(500, 0.5), 0.01 * math.Pow(500, 0.75), 5})
+	values := readFloat32s(t, rr.Body.Bytes())
+	expected := []float64{0, 0, 3, 10}
+	for i := range expected {
+		if i >= len(values) || values[i] != expected[i] {
+			t.Fatalf("Got %v, want %v", values, expected)
+		}
+	}
+
+	// Without values=true, lds plots the line whatever the outfmt
+	rr = SDSURLHandler(t, "/sds/lds/0/500/4/101/TestDir/stairstep.tmp?xscale=log&transform=min&zmin=0&zmax=10&outfmt=SF", 200)
+	checkByteData(t, rr.Body.Bytes(), makeLineOutputExpectedData([]float64{0, 0, 0, 3}, 4, 101, 0, 10))
+	// The values default to SF when outfmt is not a numeric format
+	rr = SDSURLHandler(t, "/sds/lds/0/500/4/100/TestDir/stairstep.tmp?xscale=log&transform=max&values=true", 200)
+	if values := readFloat32s(t, rr.Body.Bytes()); len(values) != 4 || values[3] != 10 {
+		t.Errorf("Got %v, want SF values", values)
+	}
+
+	// The plot of the line has one point per bin
+	rr = SDSURLHandler(t, "/sds/lds/0/500/4/101/TestDir/stairstep.tmp?xscale=log&transform=min&zmin=0&zmax=10", 200)
+	checkByteData(t, rr.Body.Bytes(), makeLineOutputExpectedData([]float64{0, 0, 0, 3}, 4, 101, 0, 10))
+}
+
+func TestLogXScaleRDS(t *testing.T) {
+	// Row 10 of mydata_SD_60_60 is the column divided by 6, rounded down
+	rr := SDSURLHandler(t, "/sds/rds/1/10/60/11/5/1/TestDir/mydata_SD_60_60.tmp?xscale=log&transform=min&outfmt=SD", 200)
+	checkBinEdges(t, rr, []float64{1, math.Pow(60, 0.2), math.Pow(60, 0.4), math.Pow(60, 0.6), math.Pow(60, 0.8), 60})
+	checkFloatData(t, rr.Body.Bytes(), []float64{0, 0, 1, 2, 4})
+
+	// Bins narrower than a column repeat the nearest column. Column 6 is the first that is 1, and it is in bin 15.
+	rr = SDSURLHandler(t, "/sds/rds/1/10/10/11/20/1/TestDir/mydata_SD_60_60.tmp?xscale=log&outfmt=SD", 200)
+	expected := make([]float64, 20)
+	for i := 15; i < 20; i++ {
+		expected[i] = 1
+	}
+	checkFloatData(t, rr.Body.Bytes(), expected)
+}
+
+func TestLogXScaleCut(t *testing.T) {
+	rr := SDSURLHandler(t, "/sds/rdsxcut/1/10/60/11/5/101/TestDir/mydata_SD_60_60.tmp?xscale=log&transform=min&zmin=0&zmax=10", 200)
+	checkBinEdges(t, rr, []float64{1, math.Pow(60, 0.2), math.Pow(60, 0.4), math.Pow(60, 0.6), math.Pow(60, 0.8), 60})
+	checkByteData(t, rr.Body.Bytes(), makeLineOutputExpectedData([]float64{0, 0, 1, 2, 4}, 5, 101, 0, 10))
+}
+
+func TestLogXScaleInvalidRequests(t *testing.T) {
+	// The only sample is at 0
+	SDSURLHandler(t, "/sds/lds/0/1/4/100/TestDir/stairstep.tmp?xscale=log", 400)
+	SDSURLHandler(t, "/sds/rds/0/10/1/11/5/1/TestDir/mydata_SD_60_60.tmp?xscale=log&outfmt=SD", 400)
+	// An unknown xscale is linear
+	rr := SDSURLHandler(t, "/sds/rds/1/10/60/11/5/1/TestDir/mydata_SD_60_60.tmp?xscale=ln&outfmt=SD", 200)
+	if rr.Header().Get("xbinlow") != "" || rr.Header().Get("xbinhigh") != "" {
+		t.Errorf("Got bin edges for a linear x scale")
+	}
+}
+
+func TestTileDecimationFactor(t *testing.T) {
+	// Rows 10 to 49 of mydata_SD_60_60 are the column divided by 6, rounded down, so decimating by 6 gives the bin number
+	rr := SDSURLHandler(t, "/sds/rdstile/16/16/x6/x6/0/0/TestDir/mydata_SD_60_60.tmp?outfmt=SD", 200)
+	if rr.Header().Get("outxsize") != "10" || rr.Header().Get("outysize") != "10" {
+		t.Errorf("Tile size wrong. Got %v by %v", rr.Header().Get("outxsize"), rr.Header().Get("outysize"))
+	}
+	if rr.Header().Get("decx") != "6" || rr.Header().Get("decy") != "6" || rr.Header().Get("tilesx") != "1" || rr.Header().Get("tilesy") != "1" {
+		t.Errorf("Tile grid headers wrong. Got %v", rr.Header())
+	}
+	values := make([]float64, 100)
+	_ = binary.Read(bytes.NewReader(rr.Body.Bytes()), binary.LittleEndian, &values)
+	for x := 0; x < 10; x++ {
+		if values[x] != 0 || values[30+x] != float64(x) || values[90+x] != 10 {
+			t.Fatalf("Decimated tile wrong. Got %v", values)
+		}
+	}
+}
+
+func TestTileGrid(t *testing.T) {
+	// 600 columns make 3 tiles of 256, the last with 88 columns
+	rr := SDSURLHandler(t, "/sds/rdstile/256/512/1/1/2/1/TestDir/mydata_SB_600_600.tmp?outfmt=SB", 200)
+	if rr.Header().Get("tilesx") != "3" || rr.Header().Get("tilesy") != "2" || rr.Header().Get("outxsize") != "88" || rr.Header().Get("outysize") != "88" {
+		t.Errorf("Tile grid headers wrong. Got %v", rr.Header())
+	}
+	// A decimation of 3 leaves 200 columns, so one tile of 256 holds them all
+	rr = SDSURLHandler(t, "/sds/rdstile/256/256/x3/x3/0/0/TestDir/mydata_SB_600_600.tmp?outfmt=SB", 200)
+	if rr.Header().Get("tilesx") != "1" || rr.Header().Get("outxsize") != "200" {
+		t.Errorf("Tile grid headers wrong. Got %v", rr.Header())
+	}
+	// Decimating by 2 leaves 300 columns, so there is no third tile
+	SDSURLHandler(t, "/sds/rdstile/256/512/2/1/2/0/TestDir/mydata_SB_600_600.tmp?outfmt=SB", 400)
+}
+
+func TestTileModeMatchesFactor(t *testing.T) {
+	mode := SDSURLHandler(t, "/sds/rdstile/100/100/3/2/1/0/TestDir/mydata_SB_600_600.tmp?outfmt=SB&transform=mean", 200)
+	factor := SDSURLHandler(t, "/sds/rdstile/100/100/x4/x2/1/0/TestDir/mydata_SB_600_600.tmp?transform=mean&outfmt=SB", 200)
+	if !bytes.Equal(mode.Body.Bytes(), factor.Body.Bytes()) {
+		t.Errorf("Decimation mode 3 does not match a decimation of 4")
+	}
+
+	// Equivalent requests share a cache file name
+	var request rdsRequest
+	request.TileXSize, request.TileYSize, request.DecX, request.DecY, request.TileX, request.TileY = 100, 100, 4, 2, 1, 0
+	modeURL, _ := http.NewRequest("GET", "/sds/rdstile/100/100/3/2/1/0/TestDir/mydata_SB_600_600.tmp?outfmt=SB&transform=mean", nil)
+	factorURL, _ := http.NewRequest("GET", "/sds/rdstile/100/100/x4/x2/1/0/TestDir/mydata_SB_600_600.tmp?transform=mean&outfmt=SB", nil)
+	if request.tileCacheFileName(modeURL) != request.tileCacheFileName(factorURL) {
+		t.Errorf("Cache file names differ: %v and %v", request.tileCacheFileName(modeURL), request.tileCacheFileName(factorURL))
+	}
+}
+
+func TestTileInvalidDecimation(t *testing.T) {
+	SDSURLHandler(t, "/sds/rdstile/100/100/x0/1/0/0/TestDir/mydata_SB_600_600.tmp", 400)
+	SDSURLHandler(t, "/sds/rdstile/100/100/1/x1025/0/0/TestDir/mydata_SB_600_600.tmp", 400)
+	SDSURLHandler(t, "/sds/rdstile/100/100/xa/1/0/0/TestDir/mydata_SB_600_600.tmp", 400)
+	SDSURLHandler(t, "/sds/rdstile/100/100/x-2/1/0/0/TestDir/mydata_SB_600_600.tmp", 400)
+	SDSURLHandler(t, "/sds/rdstile/15/100/1/1/0/0/TestDir/mydata_SB_600_600.tmp", 400)
+}
+
+func TestPyramidFailedBuildRetry(t *testing.T) {
+	os.Args = []string{"cmd", "-usecache=false", "-config=./tests/sdsTestConfig.json"}
+	setupConfigLogCache()
+	configuration.CacheLocation = t.TempDir() + "/"
+	*useCache = true
+	defer func() { *useCache = false }()
+	serve := func(sdsurl string) pyramidStatus {
+		req, _ := http.NewRequest("GET", sdsurl, nil)
+		rr := httptest.NewRecorder()
+		(&routerServer{}).ServeHTTP(rr, req)
+		var status pyramidStatus
+		json.Unmarshal(rr.Body.Bytes(), &status)
+		return status
+	}
+
+	var request rdsRequest
+	request.Cxmode = "Re"
+	if !request.openRegionFile("/sds/pyramid/TestDir/mydata_SB_60_60.tmp", 3) {
+		t.Fatal("Could not open test file")
+	}
+	key := request.pyramidKey()
+	pyramidMutex.Lock()
+	pyramidStatuses[key] = &pyramidStatus{State: "error", Error: "test failure", failed: time.Now()}
+	pyramidMutex.Unlock()
+	defer func() {
+		pyramidMutex.Lock()
+		delete(pyramidStatuses, key)
+		pyramidMutex.Unlock()
+	}()
+
+	// A tile that could use the pyramid does not queue a failed build again
+	serve("/sds/rdstile/16/16/x4/x4/0/0/TestDir/mydata_SB_60_60.tmp?outfmt=SD&zmin=0&zmax=10")
+	if status := serve("/sds/pyramid/TestDir/mydata_SB_60_60.tmp"); status.State != "error" {
+		t.Errorf("Failed pyramid build queued again by a tile. got %+v", status)
+	}
+
+	// build=true retries it
+	status := serve("/sds/pyramid/TestDir/mydata_SB_60_60.tmp?build=true")
+	for wait := 0; status.State != "done" && status.State != "error" && wait < 100; wait++ {
+		time.Sleep(10 * time.Millisecond)
+		status = serve("/sds/pyramid/TestDir/mydata_SB_60_60.tmp")
+	}
+	if status.State != "done" {
+		t.Errorf("Failed pyramid build not retried with build=true. got %+v", status)
+	}
+	// Built pyramids are known from their meta file, so no status is kept for them
+	pyramidMutex.Lock()
+	if _, ok := pyramidStatuses[key]; ok {
+		t.Errorf("Status kept for a built pyramid")
+	}
+	pyramidMutex.Unlock()
+}
+
+func TestPyramidFailedBuildExpires(t *testing.T) {
+	os.Args = []string{"cmd", "-usecache=false", "-config=./tests/sdsTestConfig.json"}
+	setupConfigLogCache()
+	configuration.CacheLocation = t.TempDir() + "/"
+	*useCache = true
+	defer func() { *useCache = false }()
+
+	var request rdsRequest
+	request.Cxmode = "Re"
+	if !request.openRegionFile("/sds/pyramid/TestDir/mydata_SB_60_60.tmp", 3) {
+		t.Fatal("Could not open test file")
+	}
+	pyramidMutex.Lock()
+	pyramidStatuses["oldfailure"] = &pyramidStatus{State: "error", failed: time.Now().Add(-2 * pyramidFailureRetention)}
+	pyramidStatuses["newfailure"] = &pyramidStatus{State: "error", failed: time.Now()}
+	pyramidMutex.Unlock()
+	defer func() {
+		pyramidMutex.Lock()
+		delete(pyramidStatuses, "newfailure")
+		pyramidMutex.Unlock()
+	}()
+
+	queuePyramid(request, false)
+	pyramidMutex.Lock()
+	_, oldKept := pyramidStatuses["oldfailure"]
+	_, newKept := pyramidStatuses["newfailure"]
+	pyramidMutex.Unlock()
+	if oldKept || !newKept {
+		t.Errorf("Failed builds kept: old %v new %v, want only the new one", oldKept, newKept)
+	}
+	for wait := 0; getPyramidStatus(request).State != "done" && wait < 100; wait++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTilePyramid(t *testing.T) {
+	os.Args = []string{"cmd", "-usecache=false", "-config=./tests/sdsTestConfig.json"}
+	setupConfigLogCache()
+	configuration.CacheLocation = t.TempDir() + "/"
+	serve := func(sdsurl string, expectedReturnCode int) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", sdsurl, nil)
+		rr := httptest.NewRecorder()
+		(&routerServer{}).ServeHTTP(rr, req)
+		if rr.Code != expectedReturnCode {
+			t.Errorf("%v returned wrong status code: got %v want %v", sdsurl, rr.Code, expectedReturnCode)
+		}
+		return rr
+	}
+	serve("/sds/pyramid/TestDir/mydata_SB_600_600.tmp", 400) // The cache is off
+
+	tiles := []string{
+		"/sds/rdstile/100/100/x4/x8/1/0/TestDir/mydata_SB_600_600.tmp?outfmt=SD&zmin=0&zmax=10&transform=",
+		"/sds/rdstile/100/50/x8/x8/0/1/TestDir/mydata_SB_600_600.tmp?outfmt=SD&zmin=0&zmax=10&transform=",
+	}
+	transforms := []string{"first", "min", "max", "mean", "maxabs"}
+	rawTiles := make(map[string][]byte)
+	for _, tile := range tiles {
+		for _, transform := range transforms {
+			rawTiles[tile+transform] = serve(tile+transform, 200).Body.Bytes()
+		}
+	}
+
+	*useCache = true
+	defer func() { *useCache = false }()
+	var status pyramidStatus
+	json.Unmarshal(serve("/sds/pyramid/TestDir/mydata_SB_600_600.tmp", 200).Body.Bytes(), &status)
+	if status.State != "none" || status.TotalRows != 600 {
+		t.Errorf("Status of missing pyramid not as expected. got %+v", status)
+	}
+
+	var request rdsRequest
+	request.Cxmode = "Re"
+	if !request.openRegionFile("/sds/pyramid/TestDir/mydata_SB_600_600.tmp", 3) {
+		t.Fatal("Could not open test file")
+	}
+	runPyramidBuild(request)
+	json.Unmarshal(serve("/sds/pyramid/TestDir/mydata_SB_600_600.tmp", 200).Body.Bytes(), &status)
+	if status.State != "done" || status.RowsRead != 600 || len(status.Levels) != 9 || status.Levels[0].Decimation != 4 || status.Levels[0].Width != 150 || status.Levels[8].Width != 1 {
+		t.Errorf("Status of built pyramid not as expected. got %+v", status)
+	}
+
+	for _, tile := range tiles {
+		for _, transform := range transforms {
+			rr := serve(tile+transform, 200)
+			if rr.Header().Get("pyramidlevel") == "" {
+				t.Errorf("Tile %v not made from the pyramid", tile+transform)
+			}
+			expected := make([]float64, len(rawTiles[tile+transform])/8)
+			_ = binary.Read(bytes.NewReader(rawTiles[tile+transform]), binary.LittleEndian, &expected)
+			checkFloatData(t, rr.Body.Bytes(), expected)
+		}
+	}
+	if level := serve(tiles[0]+"mean", 200).Header().Get("pyramidlevel"); level != "2" {
+		t.Errorf("Tile decimated by 4 and 8 should use level 2. got %v", level)
+	}
+	// Tiles that end part way through a decimation at the edge of the file are read from the file
+	if level := serve("/sds/rdstile/100/100/x16/x16/0/0/TestDir/mydata_SB_600_600.tmp?outfmt=SD&zmin=0&zmax=10", 200).Header().Get("pyramidlevel"); level != "" {
+		t.Errorf("Partial tile should not use the pyramid. got level %v", level)
+	}
+
+	// A pyramid is per cxmode, and a new version of the file has its own pyramid
+	cxmodeRequest := request
+	cxmodeRequest.Cxmode = "Lo"
+	if cxmodeRequest.pyramidKey() == request.pyramidKey() {
+		t.Errorf("Pyramid key does not depend on cxmode")
+	}
+	oldLevel := pyramidLevelFileName(request.pyramidKey(), 2)
+	later := time.Now().Add(time.Hour)
+	os.Chtimes("./tests/mydata_SB_600_600.tmp", later, later)
+	defer os.Chtimes("./tests/mydata_SB_600_600.tmp", time.Now(), time.Now())
+	json.Unmarshal(serve("/sds/pyramid/TestDir/mydata_SB_600_600.tmp", 200).Body.Bytes(), &status)
+	if status.State != "none" {
+		t.Errorf("Pyramid of changed file should not be built. got %+v", status)
+	}
+	request.openRegionFile("/sds/pyramid/TestDir/mydata_SB_600_600.tmp", 3)
+	runPyramidBuild(request)
+	if _, err := os.Stat(oldLevel); !os.IsNotExist(err) {
+		t.Errorf("Pyramid of the old file was not removed")
+	}
+}
+
+func TestTileZScale(t *testing.T) {
+	// Tile 1,1 holds the columns 100 to 199 of rows 100 to 199, which are 1 for 20 columns, 2 for 60 and 3 for 20.
+	rr := SDSURLHandler(t, "/sds/rdstile/100/100/1/1/1/1/TestDir/mydata_SB_600_600.tmp?outfmt=SD", 200)
+	checkHeaderFloat(t, rr, "zmin", 0, 1e-6)
+	checkHeaderFloat(t, rr, "zmax", 10, 1e-6)
+	if rr.Header().Get("zscale") != "global" {
+		t.Errorf("zscale header not as expected. got %v", rr.Header().Get("zscale"))
+	}
+
+	rr = SDSURLHandler(t, "/sds/rdstile/100/100/1/1/1/1/TestDir/mydata_SB_600_600.tmp?outfmt=RGBA&zscale=tile", 200)
+	checkHeaderFloat(t, rr, "zmin", 1, 1e-6)
+	checkHeaderFloat(t, rr, "zmax", 3, 1e-6)
+	if rr.Header().Get("zscale") != "tile" {
+		t.Errorf("zscale header not as expected. got %v", rr.Header().Get("zscale"))
+	}
+	rr = SDSURLHandler(t, "/sds/rdstile/100/100/1/1/1/1/TestDir/mydata_SB_600_600.tmp?outfmt=RGBA&zscale=tile&autoscale=p1-p50", 200)
+	checkHeaderFloat(t, rr, "zmin", 1, 1e-6)
+	checkHeaderFloat(t, rr, "zmax", 2, 1e-6)
+
+	// Every tile of a viewport is scaled to the whole viewport, columns 0 to 199 of rows 100 to 199
+	for _, tile := range []string{"0/1", "1/1"} {
+		rr = SDSURLHandler(t, "/sds/rdstile/100/100/1/1/"+tile+"/TestDir/mydata_SB_600_600.tmp?outfmt=RGBA&zscale=viewport&viewport=0:1:1:1", 200)
+		checkHeaderFloat(t, rr, "zmin", 0, 1e-6)
+		checkHeaderFloat(t, rr, "zmax", 3, 1e-6)
+		if rr.Header().Get("zscale") != "viewport" {
+			t.Errorf("zscale header not as expected. got %v", rr.Header().Get("zscale"))
+		}
+	}
+	// The viewport is thinned like its tiles, so a viewport of one tile is scaled the same as the tile
+	rr = SDSURLHandler(t, "/sds/rdstile/16/16/x8/x8/1/1/TestDir/mydata_SB_600_600.tmp?outfmt=RGBA&transform=mean&zscale=viewport&viewport=1:1:1:1", 200)
+	tile := SDSURLHandler(t, "/sds/rdstile/16/16/x8/x8/1/1/TestDir/mydata_SB_600_600.tmp?outfmt=RGBA&transform=mean&zscale=tile", 200)
+	if rr.Header().Get("zmin") != tile.Header().Get("zmin") || rr.Header().Get("zmax") != tile.Header().Get("zmax") {
+		t.Errorf("Viewport of one tile does not match tile scaling. got %v %v and %v %v", rr.Header().Get("zmin"), rr.Header().Get("zmax"), tile.Header().Get("zmin"), tile.Header().Get("zmax"))
+	}
+
+	// An explicit zmin and zmax are used as they are
+	rr = SDSURLHandler(t, "/sds/rdstile/100/100/1/1/1/1/TestDir/mydata_SB_600_600.tmp?outfmt=RGBA&zscale=tile&zmin=-1&zmax=20", 200)
+	checkHeaderFloat(t, rr, "zmin", -1, 1e-6)
+	checkHeaderFloat(t, rr, "zmax", 20, 1e-6)
+	if rr.Header().Get("zscale") != "" {
+		t.Errorf("zscale header should not be set for an explicit zmin and zmax. got %v", rr.Header().Get("zscale"))
+	}
+}
+
+func TestTileZScaleViewportPercentile(t *testing.T) {
+	// Columns 0 to 199 of rows 100 to 199 are 6000 values each of 0, 1 and 2 and 2000 of 3. Percentiles come from a histogram.
+	rr := SDSURLHandler(t, "/sds/rdstile/100/100/1/1/0/1/TestDir/mydata_SB_600_600.tmp?outfmt=RGBA&zscale=viewport&viewport=0:1:1:1&autoscale=p1-p50", 200)
+	checkHeaderFloat(t, rr, "zmin", 0, 0.01)
+	checkHeaderFloat(t, rr, "zmax", 1, 0.01)
+
+	// Tiles of a viewport asked for at the same time all get its range
+	results := make(chan *httptest.ResponseRecorder, 4)
+	for _, tile := range []string{"0/1", "1/1", "0/2", "1/2"} {
+		go func(tile string) {
+			req, _ := http.NewRequest("GET", "/sds/rdstile/100/100/1/1/"+tile+"/TestDir/mydata_SB_600_600.tmp?outfmt=RGBA&zscale=viewport&viewport=0:1:1:2", nil)
+			rr := httptest.NewRecorder()
+			(&routerServer{}).ServeHTTP(rr, req)
+			results <- rr
+		}(tile)
+	}
+	for i := 0; i < 4; i++ {
+		rr := <-results
+		checkHeaderFloat(t, rr, "zmin", 0, 1e-6)
+		checkHeaderFloat(t, rr, "zmax", 3, 1e-6)
+	}
+}
+
+func TestViewportLimits(t *testing.T) {
+	// 16 tiles of 512 by 512 are the most elements a viewport may have
+	if _, ok := parseViewport("0:0:3:3", 8, 8, 512*512); !ok {
+		t.Errorf("Viewport of %d elements refused", 16*512*512)
+	}
+	if _, ok := parseViewport("0:0:4:3", 8, 8, 512*512); ok {
+		t.Errorf("Viewport of %d elements allowed", 20*512*512)
+	}
+	if _, ok := parseViewport("0:0:16:15", 20, 20, 16*16); ok {
+		t.Errorf("Viewport of %d tiles allowed", 17*16)
+	}
+}
+
+func TestViewportScalesForgotten(t *testing.T) {
+	os.Args = []string{"cmd", "-usecache=false", "-config=./tests/sdsTestConfig.json"}
+	setupConfigLogCache()
+	// Each autoscale is its own viewport range
+	for i := 0; i < maxViewportScales+10; i++ {
+		req, _ := http.NewRequest("GET", "/sds/rdstile/16/16/1/1/0/0/TestDir/mydata_SB_60_60.tmp?zscale=viewport&viewport=0:0:0:0&autoscale=floor:0:"+strconv.Itoa(i), nil)
+		rr := httptest.NewRecorder()
+		(&routerServer{}).ServeHTTP(rr, req)
+		if rr.Code != 200 {
+			t.Fatalf("Viewport tile returned wrong status code: got %v want 200", rr.Code)
+		}
+	}
+	viewportScalesMutex.Lock()
+	defer viewportScalesMutex.Unlock()
+	if len(viewportScales) > maxViewportScales || len(viewportScaleOrder) > maxViewportScales {
+		t.Errorf("Got %d viewport ranges and %d keys, want at most %d", len(viewportScales), len(viewportScaleOrder), maxViewportScales)
+	}
+}
+
+func TestTileZScaleInvalidRequests(t *testing.T) {
+	SDSURLHandler(t, "/sds/rdstile/100/100/1/1/1/1/TestDir/mydata_SB_600_600.tmp?zscale=viewport", 400)
+	SDSURLHandler(t, "/sds/rdstile/100/100/1/1/1/1/TestDir/mydata_SB_600_600.tmp?zscale=viewport&viewport=0:0:6:0", 400)
+	SDSURLHandler(t, "/sds/rdstile/100/100/1/1/1/1/TestDir/mydata_SB_600_600.tmp?zscale=viewport&viewport=1:0:0:0", 400)
+	SDSURLHandler(t, "/sds/rdstile/100/100/1/1/1/1/TestDir/mydata_SB_600_600.tmp?zscale=viewport&viewport=0:0:1", 400)
+	SDSURLHandler(t, "/sds/rdstile/16/16/1/1/1/1/TestDir/mydata_SB_600_600.tmp?zscale=viewport&viewport=0:0:16:16", 400)
+	rr := SDSURLHandler(t, "/sds/rdstile/100/100/1/1/1/1/TestDir/mydata_SB_600_600.tmp?zscale=local", 200)
+	if rr.Header().Get("zscale") != "global" {
+		t.Errorf("Unknown zscale should fall back to global. got %v", rr.Header().Get("zscale"))
+	}
+}
+
+func TestColorMaps(t *testing.T) {
+	os.Args = []string{"cmd", "-usecache=false", "-config=./tests/sdsTestConfig.json"}
+	setupConfigLogCache()
+	configuration.CacheLocation = t.TempDir() + "/"
+	loadColorMaps()
+	serve := func(method, sdsurl, body string, expectedReturnCode int) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, sdsurl, strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		(&routerServer{}).ServeHTTP(rr, req)
+		if rr.Code != expectedReturnCode {
+			t.Errorf("%v %v returned wrong status code: got %v want %v", method, sdsurl, rr.Code, expectedReturnCode)
+		}
+		return rr
+	}
+	// Color of the lowest value of the file with a colormap
+	lowestColor := func(colorMap string) []byte {
+		return serve("GET", "/sds/rds/0/0/1/1/1/1/TestDir/mydata_SB_60_60.tmp?outfmt=RGBA&zmin=0&zmax=10&colormap="+colorMap, "", 200).Body.Bytes()
+	}
+
+	var colorMaps []colorMapInfo
+	json.Unmarshal(serve("GET", "/sds/colormaps", "", 200).Body.Bytes(), &colorMaps)
+	sources := make(map[string]string)
+	for _, colorMap := range colorMaps {
+		sources[colorMap.Name] = colorMap.Source
+	}
+	for _, name := range []string{"RampColormap", "Greyscale", "viridis", "magma", "inferno", "plasma", "cividis", "turbo"} {
+		if sources[name] != "builtin" {
+			t.Errorf("Colormap %v not listed as built in. got %v", name, sources[name])
+		}
+	}
+	if sources["testRedBlue"] != "config" {
+		t.Errorf("Colormap from config file not listed. got %v", sources["testRedBlue"])
+	}
+
+	var viridis colorMapDefinition
+	json.Unmarshal(serve("GET", "/sds/colormaps/viridis", "", 200).Body.Bytes(), &viridis)
+	if len(viridis.Table) != 256 || viridis.Table[0][0] != 68 || viridis.Table[0][1] != 1 || viridis.Table[0][2] != 84 || viridis.Table[255][0] != 253 || viridis.Table[255][2] != 37 {
+		t.Errorf("viridis table not as expected. got %v colors starting %v", len(viridis.Table), viridis.Table[0])
+	}
+	serve("GET", "/sds/colormaps/Bad", "", 404)
+
+	checkByteData(t, lowestColor("testRedBlue"), []byte{255, 0, 0, 255})
+	checkByteData(t, lowestColor("magma"), []byte{0, 0, 4, 255})
+
+	// A 256 color table that is uploaded can be used straight away, and is loaded again from the cache
+	table := make([][]int, 256)
+	for i := range table {
+		table[i] = []int{i, 128, 255 - i}
+	}
+	tableJSON, _ := json.Marshal(map[string][][]int{"table": table})
+	serve("POST", "/sds/colormaps/uploaded_1", string(tableJSON), 200)
+	checkByteData(t, lowestColor("uploaded_1"), []byte{0, 128, 255, 255})
+	loadColorMaps()
+	checkByteData(t, lowestColor("uploaded_1"), []byte{0, 128, 255, 255})
+	serve("PUT", "/sds/colormaps/uploaded_1", `{"controlPoints": [[0, 10, 20, 30], [50, 0, 0, 0], [100, 255, 255, 255]]}`, 200)
+	checkByteData(t, lowestColor("uploaded_1"), []byte{10, 20, 30, 255})
+
+	serve("DELETE", "/sds/colormaps/uploaded_1", "", 200)
+	serve("GET", "/sds/rds/0/0/1/1/1/1/TestDir/mydata_SB_60_60.tmp?outfmt=RGBA&colormap=uploaded_1", "", 400)
+	serve("GET", "/sds/rdstile/100/100/1/1/0/0/TestDir/mydata_SB_600_600.tmp?colormap=uploaded_1", "", 400)
+	loadColorMaps()
+	serve("GET", "/sds/colormaps/uploaded_1", "", 404)
+}
+
+func TestColorMapReplaceCached(t *testing.T) {
+	os.Args = []string{"cmd", "-usecache=false", "-config=./tests/sdsTestConfig.json"}
+	setupConfigLogCache()
+	configuration.CacheLocation = t.TempDir() + "/"
+	*useCache = true
+	defer func() { *useCache = false }()
+	loadColorMaps()
+	serve := func(method, sdsurl, body string, expectedReturnCode int) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, sdsurl, strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		(&routerServer{}).ServeHTTP(rr, req)
+		if rr.Code != expectedReturnCode {
+			t.Errorf("%v %v returned wrong status code: got %v want %v", method, sdsurl, rr.Code, expectedReturnCode)
+		}
+		return rr
+	}
+	// Every value is drawn in the one color of the colormap, so output taken from the cache with the old colors shows
+	firstColor := func() (rds, tile []byte) {
+		rds = serve("GET", "/sds/rds/0/0/1/1/1/1/TestDir/mydata_SB_60_60.tmp?outfmt=RGBA&zmin=0&zmax=10&colormap=flat", "", 200).Body.Bytes()
+		tile = serve("GET", "/sds/rdstile/100/100/1/1/0/0/TestDir/mydata_SB_600_600.tmp?outfmt=RGBA&colormap=flat", "", 200).Body.Bytes()[:4]
+		return rds, tile
+	}
+
+	serve("POST", "/sds/colormaps/flat", `{"controlPoints": [[0, 10, 20, 30], [100, 10, 20, 30]]}`, 200)
+	rds, tile := firstColor()
+	checkByteData(t, rds, []byte{10, 20, 30, 255})
+	checkByteData(t, tile, []byte{10, 20, 30, 255})
+	serve("PUT", "/sds/colormaps/flat", `{"controlPoints": [[0, 40, 50, 60], [100, 40, 50, 60]]}`, 200)
+	rds, tile = firstColor()
+	checkByteData(t, rds, []byte{40, 50, 60, 255})
+	checkByteData(t, tile, []byte{40, 50, 60, 255})
+}
+
+func TestColorMapInvalidUploads(t *testing.T) {
+	serve := func(method, sdsurl, body string, expectedReturnCode int) {
+		os.Args = []string{"cmd", "-usecache=false", "-config=./tests/sdsTestConfig.json"}
+		setupConfigLogCache()
+		configuration.CacheLocation = t.TempDir() + "/"
+		req, _ := http.NewRequest(method, sdsurl, strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		(&routerServer{}).ServeHTTP(rr, req)
+		if rr.Code != expectedReturnCode {
+			t.Errorf("%v %v returned wrong status code: got %v want %v", method, sdsurl, rr.Code, expectedReturnCode)
+		}
+	}
+	points := `{"controlPoints": [[0, 0, 0, 0], [100, 255, 255, 255]]}`
+	serve("POST", "/sds/colormaps/viridis", points, 400)
+	serve("POST", "/sds/colormaps/testRedBlue", points, 400)
+	serve("POST", "/sds/colormaps/bad.name", points, 400)
+	serve("POST", "/sds/colormaps/", points, 400)
+	serve("POST", "/sds/colormaps/short", `{"table": [[0, 0, 0], [255, 255, 255]]}`, 400)
+	serve("POST", "/sds/colormaps/order", `{"controlPoints": [[0, 0, 0, 0], [60, 1, 1, 1], [40, 2, 2, 2], [100, 255, 255, 255]]}`, 400)
+	serve("POST", "/sds/colormaps/ends", `{"controlPoints": [[10, 0, 0, 0], [100, 255, 255, 255]]}`, 400)
+	serve("POST", "/sds/colormaps/bright", `{"controlPoints": [[0, 0, 0, 0], [100, 256, 255, 255]]}`, 400)
+	serve("POST", "/sds/colormaps/json", `{"controlPoints": `, 400)
+	serve("DELETE", "/sds/colormaps/viridis", "", 404)
+	serve("PATCH", "/sds/colormaps/viridis", "", 405)
+}
+
+func TestColorScale(t *testing.T) {
+	// The element at column 30 of row 20 is 5, half way from zmin to zmax. testRedBlue is from the test config file.
+	pixel := func(options string) []byte {
+		return SDSURLHandler(t, "/sds/rds/30/20/31/21/1/1/TestDir/mydata_SB_60_60.tmp?outfmt=RGBA&zmin=0&zmax=10&colormap=testRedBlue"+options, 200).Body.Bytes()
+	}
+	color := func(numColors, index int) []byte {
+		palette := makeColorPalette(getColorConrolPoints("testRedBlue"), numColors)
+		return []byte{byte(palette[index].red), byte(palette[index].green), byte(palette[index].blue), 255}
+	}
+	checkByteData(t, pixel(""), color(1000, 499))
+	checkByteData(t, pixel("&cscale=linear"), color(1000, 499))
+	checkByteData(t, pixel("&cscale=sqrt"), color(1000, 706))    // sqrt(0.5)
+	checkByteData(t, pixel("&cscale=gamma:2"), color(1000, 249)) // 0.5^2
+	checkByteData(t, pixel("&cscale=log"), color(1000, 899))     // log10(1+999*0.5)/3
+	// With a positive zmin the scale is log10(5/1)/log10(10/1)
+	logPixel := SDSURLHandler(t, "/sds/rds/30/20/31/21/1/1/TestDir/mydata_SB_60_60.tmp?outfmt=RGBA&zmin=1&zmax=10&colormap=testRedBlue&cscale=log", 200)
+	checkByteData(t, logPixel.Body.Bytes(), color(1000, 698))
+	checkByteData(t, pixel("&reverse=true"), color(1000, 500))
+	checkByteData(t, pixel("&numcolors=10"), color(10, 4))
+	checkByteData(t, pixel("&numcolors=10&reverse=true&cscale=gamma:2"), color(10, 7))
+
+	// Unknown options fall back to their defaults
+	checkByteData(t, pixel("&cscale=gamma:0"), color(1000, 499))
+	checkByteData(t, pixel("&cscale=cube"), color(1000, 499))
+	checkByteData(t, pixel("&numcolors=1"), color(1000, 499))
+
+	// Values outside zmin and zmax take the end colors on every scale
+	for _, param := range []string{"linear", "log", "sqrt", "gamma:3"} {
+		scale, _ := parseColorScale(param)
+		expected := append(append(color(1000, 0), color(1000, 999)...), color(1000, 0)...)
+		checkByteData(t, colorizeValues([]float64{-5, 20, math.NaN()}, 0, 10, "testRedBlue", colorOptions{Scale: scale, NumColors: 1000}), expected)
+	}
+}
+
+func TestNaNUnderOverColors(t *testing.T) {
+	// a/(a>0) makes the zero elements NaN. Row 20 is 0 at column 0 and 5 at column 30.
+	pixel := func(x int, options string) []byte {
+		return SDSURLHandler(t, "/sds/rds/"+strconv.Itoa(x)+"/20/"+strconv.Itoa(x+1)+"/21/1/1/TestDir/mydata_SB_60_60.tmp?outfmt=RGBA&colormap=testRedBlue&expr="+
+			url.QueryEscape("a/(a>0)")+options, 200).Body.Bytes()
+	}
+	color := func(index int, alpha byte) []byte {
+		palette := makeColorPalette(getColorConrolPoints("testRedBlue"), 1000)
+		return []byte{byte(palette[index].red), byte(palette[index].green), byte(palette[index].blue), alpha}
+	}
+	checkByteData(t, pixel(0, "&zmin=0&zmax=10"), color(0, 255))
+	checkByteData(t, pixel(0, "&zmin=0&zmax=10&nancolor=transparent"), []byte{0, 0, 0, 0})
+	checkByteData(t, pixel(0, "&zmin=0&zmax=10&nancolor=00ff0080"), []byte{0, 255, 0, 128})
+	checkByteData(t, pixel(0, "&zmin=0&zmax=10&nancolor=nothex"), color(0, 255))
+
+	checkByteData(t, pixel(30, "&zmin=6&zmax=10"), color(0, 255))
+	checkByteData(t, pixel(30, "&zmin=6&zmax=10&undercolor=transparent"), []byte{0, 0, 0, 0})
+	checkByteData(t, pixel(30, "&zmin=0&zmax=4"), color(999, 255))
+	checkByteData(t, pixel(30, "&zmin=0&zmax=4&overcolor=ffffff"), []byte{255, 255, 255, 255})
+	checkByteData(t, pixel(30, "&zmin=0&zmax=10&undercolor=transparent&overcolor=ffffff"), color(499, 255))
+
+	// Intensity alpha is the position on the color scale, values below zmin are transparent and above zmax opaque
+	checkByteData(t, pixel(30, "&zmin=0&zmax=10&alpha=intensity"), color(499, 128))
+	checkByteData(t, pixel(30, "&zmin=0&zmax=10&alpha=intensity&cscale=gamma:2"), color(249, 64))
+	checkByteData(t, pixel(30, "&zmin=6&zmax=10&alpha=intensity"), color(0, 0))
+	checkByteData(t, pixel(30, "&zmin=0&zmax=4&alpha=intensity"), color(999, 255))
+	checkByteData(t, pixel(30, "&zmin=0&zmax=10&alpha=glow"), color(499, 255))
+
+	// Thinning ignores NaN, a bin with only NaN stays NaN in float formats and is 0 in integer formats
+	for _, transform := range []string{"mean", "max", "min", "maxabs"} {
+		rr := SDSURLHandler(t, "/sds/rds/0/20/12/21/2/1/TestDir/mydata_SB_60_60.tmp?outfmt=SD&expr="+url.QueryEscape("a/(a>0)")+"&transform="+transform, 200)
+		values := make([]float64, 2)
+		binary.Read(rr.Body, binary.LittleEndian, &values)
+		if !math.IsNaN(values[0]) || values[1] != 1 {
+			t.Errorf("Transform %s of NaN bins got %v want [NaN 1]", transform, values)
+		}
+	}
+	rr := SDSURLHandler(t, "/sds/rds/0/20/12/21/2/1/TestDir/mydata_SB_60_60.tmp?outfmt=SB&expr="+url.QueryEscape("a/(a>0)"), 200)
+	checkByteData(t, rr.Body.Bytes(), []byte{0, 1})
+
+	// Line output draws a bin of only NaN at 0, the bottom pixel from zmin=0
+	rr = SDSURLHandler(t, "/sds/rdsxcut/0/20/12/21/2/11/TestDir/mydata_SB_60_60.tmp?zmin=0&zmax=10&expr="+url.QueryEscape("a/(a>0)"), 200)
+	pixels := make([]int16, 4)
+	binary.Read(rr.Body, binary.LittleEndian, &pixels)
+	if pixels[0] != 0 || pixels[1] != 1 || pixels[2] != 10 || pixels[3] != 9 {
+		t.Errorf("Line output of NaN bins got %v want [0 1 10 9]", pixels)
+	}
+}
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Number of bins used to narrow down the value of a percentile on each pass over the data.
+const percentileBins = 4096
+
+// Once the number of values that could hold a percentile is at most this many, they are collected and sorted to give the exact value.
+const maxPercentileValues = 1 << 20
+
+// How long the result of an asynchronous stats job is kept after it finishes.
+const statsJobLifetime = time.Hour
+
+type statsPercentile struct {
+	Percentile float64 `json:"percentile"`
+	Value      float64 `json:"value"`
+}
+
+type statsResult struct {
+	Total       int64             `json:"total"`
+	Count       int64             `json:"count"`
+	NaNCount    int64             `json:"nancount"`
+	InfCount    int64             `json:"infcount"`
+	Min         float64           `json:"min"`
+	MinX        int               `json:"minx"`
+	MinY        int               `json:"miny"`
+	Max         float64           `json:"max"`
+	MaxX        int               `json:"maxx"`
+	MaxY        int               `json:"maxy"`
+	Mean        float64           `json:"mean"`
+	Stddev      float64           `json:"stddev"`
+	Percentiles []statsPercentile `json:"percentiles"`
+}
+
+type statsJob struct {
+	ID      string       `json:"jobid"`
+	State   string       `json:"state"`
+	Pass    int          `json:"pass"`
+	Scanned int64        `json:"scanned"`
+	Total   int64        `json:"total"`
+	Result  *statsResult `json:"result,omitempty"`
+}
+
+var statsJobs = make(map[string]*statsJob)
+var statsJobsMutex = &sync.Mutex{}
+var statsJobCounter int64
+
+// scanPass starts a new pass over the data of the job and scans the selection, counting the elements as they are processed.
+func (job *statsJob) scanPass(dataRequest rdsRequest, process func(worker int, segment lineSegment, data []float64)) {
+	statsJobsMutex.Lock()
+	job.Pass++
+	statsJobsMutex.Unlock()
+	atomic.StoreInt64(&job.Scanned, 0)
+	scanRegion(dataRequest, func(worker int, segment lineSegment, data []float64) {
+		process(worker, segment, data)
+		atomic.AddInt64(&job.Scanned, int64(len(data)))
+	})
+}
+
+// status returns a copy of the job that is safe to encode while the job is still running.
+func (job *statsJob) status() statsJob {
+	statsJobsMutex.Lock()
+	defer statsJobsMutex.Unlock()
+	return statsJob{
+		ID:      job.ID,
+		State:   job.State,
+		Pass:    job.Pass,
+		Scanned: atomic.LoadInt64(&job.Scanned),
+		Total:   job.Total,
+		Result:  job.Result,
+	}
+}
+
+type statsAccumulator struct {
+	count, nans, infs      int64
+	mean, m2               float64
+	min, max               float64
+	minX, minY, maxX, maxY int
+}
+
+// before reports whether element (x1,y1) comes before (x2,y2) in file order. It keeps the reported location of the min and max
+// at the first occurrence no matter which worker saw it.
+func before(x1, y1, x2, y2 int) bool {
+	return y1 < y2 || (y1 == y2 && x1 < x2)
+}
+
+func (acc *statsAccumulator) add(value float64, x, y int) {
+	if math.IsNaN(value) {
+		acc.nans++
+		return
+	}
+	if math.IsInf(value, 0) {
+		acc.infs++
+		return
+	}
+	if acc.count == 0 || value < acc.min || (value == acc.min && before(x, y, acc.minX, acc.minY)) {
+		acc.min, acc.minX, acc.minY = value, x, y
+	}
+	if acc.count == 0 || value > acc.max || (value == acc.max && before(x, y, acc.maxX, acc.maxY)) {
+		acc.max, acc.maxX, acc.maxY = value, x, y
+	}
+	// Welford's update keeps the variance accurate over long runs of data
+	acc.count++
+	delta := value - acc.mean
+	acc.mean += delta / float64(acc.count)
+	acc.m2 += delta * (value - acc.mean)
+}
+
+// merge combines the accumulator of another worker into acc.
+func (acc *statsAccumulator) merge(other statsAccumulator) {
+	acc.nans += other.nans
+	acc.infs += other.infs
+	if other.count == 0 {
+		return
+	}
+	if acc.count == 0 {
+		nans, infs := acc.nans, acc.infs
+		*acc = other
+		acc.nans, acc.infs = nans, infs
+		return
+	}
+	if other.min < acc.min || (other.min == acc.min && before(other.minX, other.minY, acc.minX, acc.minY)) {
+		acc.min, acc.minX, acc.minY = other.min, other.minX, other.minY
+	}
+	if other.max > acc.max || (other.max == acc.max && before(other.maxX, other.maxY, acc.maxX, acc.maxY)) {
+		acc.max, acc.maxX, acc.maxY = other.max, other.maxX, other.maxY
+	}
+	count := acc.count + other.count
+	delta := other.mean - acc.mean
+	acc.mean += delta * float64(other.count) / float64(count)
+	acc.m2 += other.m2 + delta*delta*float64(acc.count)*float64(other.count)/float64(count)
+	acc.count = count
+}
+
+type percentileSearch struct {
+	rank        int64 // Rank of the percentile among the finite values, counting from 0
+	below       int64 // Number of finite values less than lo
+	inRange     int64 // Number of finite values in the interval
+	lo, hi      float64
+	hiInclusive bool
+	resolved    bool
+	value       float64
+}
+
+func (search *percentileSearch) contains(value float64) bool {
+	return value >= search.lo && (value < search.hi || (search.hiInclusive && value == search.hi))
+}
+
+// findPercentiles returns the exact value of each percentile among the finite values of the selection using nearest rank.
+// Each unresolved percentile is narrowed with a histogram of its interval on every pass until few enough values remain
+// in it to collect and sort, so memory stays bounded no matter how large the selection is.
+func findPercentiles(dataRequest rdsRequest, percentiles []float64, moments statsAccumulator, job *statsJob) []statsPercentile {
+	searches := make([]percentileSearch, len(percentiles))
+	for i, percentile := range percentiles {
+		rank := int64(math.Ceil(percentile/100*float64(moments.count))) - 1
+		rank = int64(math.Max(0, math.Min(float64(rank), float64(moments.count-1))))
+		searches[i] = percentileSearch{rank: rank, inRange: moments.count, lo: moments.min, hi: moments.max, hiInclusive: true}
+		if moments.count == 0 {
+			searches[i].resolved = true
+		} else if rank == 0 || moments.min == moments.max {
+			searches[i].resolved, searches[i].value = true, moments.min
+		} else if rank == moments.count-1 {
+			searches[i].resolved, searches[i].value = true, moments.max
+		}
+	}
+
+	for {
+		var active []int
+		for i := range searches {
+			if !searches[i].resolved {
+				active = append(active, i)
+			}
+		}
+		if len(active) == 0 {
+			break
+		}
+
+		edges := make([][]float64, len(searches))
+		counts := make([][][]int64, len(searches))
+		values := make([][][]float64, len(searches))
+		for _, i := range active {
+			if searches[i].inRange > maxPercentileValues {
+				edges[i] = histogramEdges(searches[i].lo, searches[i].hi, percentileBins, false)
+				counts[i] = make([][]int64, scanWorkers)
+				for worker := range counts[i] {
+					counts[i][worker] = make([]int64, percentileBins)
+				}
+			} else {
+				values[i] = make([][]float64, scanWorkers)
+			}
+		}
+
+		job.scanPass(dataRequest, func(worker int, segment lineSegment, data []float64) {
+			for _, value := range data {
+				for _, i := range active {
+					if !searches[i].contains(value) {
+						continue
+					}
+					if edges[i] != nil {
+						// The first bin whose upper edge is above the value. Values at the top edge go in the last bin.
+						bin := sort.Search(percentileBins-1, func(b int) bool { return edges[i][b+1] > value })
+						counts[i][worker][bin]++
+					} else {
+						values[i][worker] = append(values[i][worker], value)
+					}
+				}
+			}
+		})
+
+		for _, i := range active {
+			search := &searches[i]
+			if edges[i] == nil {
+				var inRange []float64
+				for worker := range values[i] {
+					inRange = append(inRange, values[i][worker]...)
+				}
+				sort.Float64s(inRange)
+				search.value = inRange[search.rank-search.below]
+				search.resolved = true
+				continue
+			}
+			lo, hi := search.lo, search.hi
+			for bin := 0; bin < percentileBins; bin++ {
+				var count int64
+				for worker := range counts[i] {
+					count += counts[i][worker][bin]
+				}
+				if search.rank < search.below+count {
+					search.lo = edges[i][bin]
+					search.hiInclusive = search.hiInclusive && bin == percentileBins-1
+					if !search.hiInclusive {
+						search.hi = edges[i][bin+1]
+					}
+					search.inRange = count
+					break
+				}
+				search.below += count
+			}
+			// An interval that can no longer be split holds a single value
+			if search.lo == search.hi || (search.lo == lo && search.hi == hi) {
+				search.value = search.lo
+				search.resolved = true
+			}
+		}
+	}
+
+	result := make([]statsPercentile, len(percentiles))
+	for i := range percentiles {
+		result[i] = statsPercentile{percentiles[i], searches[i].value}
+	}
+	return result
+}
+
+// computeStats scans the selection of the request for its count, min, max, mean and standard deviation, then for each percentile.
+func computeStats(dataRequest rdsRequest, percentiles []float64, job *statsJob) statsResult {
+	accumulators := make([]statsAccumulator, scanWorkers)
+	job.scanPass(dataRequest, func(worker int, segment lineSegment, data []float64) {
+		for i, value := range data {
+			accumulators[worker].add(value, segment.Xstart+i, segment.Row)
+		}
+	})
+	var moments statsAccumulator
+	for i := range accumulators {
+		moments.merge(accumulators[i])
+	}
+
+	var result statsResult
+	result.Total = int64(dataRequest.Xsize) * int64(dataRequest.Ysize)
+	result.Count = moments.count
+	result.NaNCount = moments.nans
+	result.InfCount = moments.infs
+	if moments.count > 0 {
+		result.Min, result.MinX, result.MinY = moments.min, moments.minX, moments.minY
+		result.Max, result.MaxX, result.MaxY = moments.max, moments.maxX, moments.maxY
+		result.Mean = moments.mean
+		result.Stddev = math.Sqrt(moments.m2 / float64(moments.count))
+	}
+	result.Percentiles = findPercentiles(dataRequest, percentiles, moments, job)
+	return result
+}
+
+// parsePercentiles reads a comma separated list of percentiles between 0 and 100.
+func parsePercentiles(param string) ([]float64, bool) {
+	var percentiles []float64
+	for _, field := range strings.Split(param, ",") {
+		percentile, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil || percentile < 0 || percentile > 100 {
+			log.Println("Percentiles must be numbers between 0 and 100. got:", field)
+			return nil, false
+		}
+		percentiles = append(percentiles, percentile)
+	}
+	return percentiles, true
+}
+
+type statsServer struct{}
+
+func (s *statsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var statsRequest rdsRequest
+	var ok bool
+
+	//url - /sds/stats/<LocationName>/path/to/filename?percentiles=&async=&x1=&y1=&x2=&y2=
+	statsRequest.getQueryParams(r)
+	percentileParam, ok := getURLQueryParamString(r, "percentiles")
+	if !ok {
+		percentileParam = "1,50,99"
+	}
+	percentiles, ok := parsePercentiles(percentileParam)
+	if !ok {
+		w.WriteHeader(400)
+		return
+	}
+	asyncParam, _ := getURLQueryParamString(r, "async")
+	async := asyncParam == "true"
+
+	cacheFileName := urlToCacheFileName(r.URL.Path, r.URL.RawQuery)
+	var statsJSON []byte
+	var inCache bool
+	if *useCache {
+		statsJSON, inCache = getDataFromCache(cacheFileName, "outputFiles/")
+	}
+
+	w.Header().Add("Access-Control-Allow-Origin", "*")
+	w.Header().Add("Content-Type", "application/json")
+	if inCache {
+		w.WriteHeader(http.StatusOK)
+		w.Write(statsJSON)
+		return
+	}
+
+	log.Println("Stats Request not in Cache, computing result")
+	if !statsRequest.openRegionFile(r.URL.Path, 3) {
+		w.WriteHeader(400)
+		return
+	}
+	if !statsRequest.getRegionQueryParams(r) {
+		w.WriteHeader(400)
+		return
+	}
+
+	job := &statsJob{
+		ID:    strconv.FormatInt(atomic.AddInt64(&statsJobCounter, 1), 10) + "-" + strconv.FormatInt(time.Now().UnixNano(), 36),
+		State: "running",
+		Total: int64(statsRequest.Xsize) * int64(statsRequest.Ysize),
+	}
+	cacheResult := *useCache
+	run := func() []byte {
+		start := time.Now()
+		result := computeStats(statsRequest, percentiles, job)
+		resultJSON, marshalError := json.Marshal(result)
+		statsJobsMutex.Lock()
+		if marshalError != nil {
+			log.Println("Error Encoding stats", marshalError)
+			job.State = "error"
+		} else {
+			job.State = "done"
+			job.Result = &result
+		}
+		statsJobsMutex.Unlock()
+		log.Println("Stats processed in: ", time.Since(start))
+		if marshalError == nil && cacheResult {
+			go putItemInCache(cacheFileName, "outputFiles/", resultJSON)
+		}
+		return resultJSON
+	}
+
+	if async {
+		statsJobsMutex.Lock()
+		statsJobs[job.ID] = job
+		statsJobsMutex.Unlock()
+		go func() {
+			run()
+			time.AfterFunc(statsJobLifetime, func() {
+				statsJobsMutex.Lock()
+				delete(statsJobs, job.ID)
+				statsJobsMutex.Unlock()
+			})
+		}()
+		jobJSON, _ := json.Marshal(job.status())
+		w.WriteHeader(http.StatusAccepted)
+		w.Write(jobJSON)
+		return
+	}
+
+	statsJSON = run()
+	if job.State != "done" {
+		w.WriteHeader(500)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(statsJSON)
+}
+
+type statsJobServer struct{}
+
+func (s *statsJobServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	//url - /sds/statsjob/<jobid>
+	pathData := strings.Split(r.URL.Path, "/")
+	if len(pathData) < 4 {
+		log.Println("Stats job id missing")
+		w.WriteHeader(400)
+		return
+	}
+	statsJobsMutex.Lock()
+	job, ok := statsJobs[pathData[3]]
+	statsJobsMutex.Unlock()
+	if !ok {
+		log.Println("Unknown stats job", pathData[3])
+		w.WriteHeader(404)
+		return
+	}
+
+	status := job.status()
+	jobJSON, marshalError := json.Marshal(status)
+	if marshalError != nil {
+		log.Println("Error Encoding stats job", marshalError)
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Add("Access-Control-Allow-Origin", "*")
+	w.Header().Add("Access-Control-Expose-Headers", "progress")
+	w.Header().Add("progress", fmt.Sprintf("%f", float64(status.Scanned)/math.Max(1, float64(status.Total))))
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jobJSON)
+}
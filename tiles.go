@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Limits on rdstile tile sizes and decimation used when they are not set in the config file.
+const (
+	defaultMinTileSize   = 16
+	defaultMaxTileSize   = 512
+	defaultMaxDecimation = 1024
+)
+
+// tileLimits returns the smallest and largest tile size and the largest decimation rdstile allows.
+func tileLimits() (int, int, int) {
+	minTileSize := configuration.MinTileSize
+	if minTileSize < 1 {
+		minTileSize = defaultMinTileSize
+	}
+	maxTileSize := configuration.MaxTileSize
+	if maxTileSize < 1 {
+		maxTileSize = defaultMaxTileSize
+	}
+	maxDecimation := configuration.MaxDecimation
+	if maxDecimation < 1 {
+		maxDecimation = defaultMaxDecimation
+	}
+	return minTileSize, maxTileSize, maxDecimation
+}
+
+// parseDecimation reads the decimation of a tile from a url argument. The numbers 1 to 10 are the power of two modes of
+// decimationLookup, and x<n> is a decimation of n, such as x3.
+func parseDecimation(param string, maxDecimation int) (int, bool) {
+	if strings.HasPrefix(param, "x") {
+		decimation, err := strconv.Atoi(param[1:])
+		if err != nil || decimation < 1 || decimation > maxDecimation {
+			return 0, false
+		}
+		return decimation, true
+	}
+	mode, err := strconv.Atoi(param)
+	if err != nil {
+		return 0, false
+	}
+	decimation, ok := decimationLookup[mode]
+	return decimation, ok && decimation <= maxDecimation
+}
+
+// tileGrid returns the number of tiles across and down the file at the tile size and decimation of the request.
+func (request *rdsRequest) tileGrid() (int, int) {
+	tilesX := int(math.Ceil(float64(request.FileXSize) / float64(request.TileXSize*request.DecX)))
+	tilesY := int(math.Ceil(float64(request.FileYSize) / float64(request.TileYSize*request.DecY)))
+	return tilesX, tilesY
+}
+
+// tileCacheFileName returns the cache file name of a tile request. It is made from the decimation factors rather than how they were
+// written and from the query params in sorted order, so requests for the same tile share the cached tile.
+func (request *rdsRequest) tileCacheFileName(r *http.Request) string {
+	pathData := strings.Split(r.URL.Path, "/")
+	canonicalPath := fmt.Sprintf("/sds/rdstile/%d/%d/x%d/x%d/%d/%d/%s", request.TileXSize, request.TileYSize, request.DecX, request.DecY,
+		request.TileX, request.TileY, strings.Join(pathData[9:], "/"))
+	return urlToCacheFileName(canonicalPath, r.URL.Query().Encode()+colorMapVersion(request.ColorMap))
+}
+
+// tileRequestData returns the values of a tile request and the pyramid level they were made from. Zoomed out tiles come from the
+// pyramid of the file when it has been built, otherwise they are read from the file and the pyramid is queued to be built.
+func tileRequestData(request rdsRequest) ([]float64, int) {
+	if *useCache && request.Compare == nil && request.Expression == nil && !request.backgroundRequested() {
+		if data, level, ok := pyramidTileData(request); ok {
+			log.Println("Making tile from pyramid level", level)
+			return data, level
+		}
+		if _, decimated := request.pyramidTileLevel(); decimated {
+			queuePyramid(request, false)
+		}
+	}
+	return processRequestData(request), 0
+}
@@ -0,0 +1,18 @@
+package main
+
+import "math"
+
+// tuneSamples shifts interleaved complex samples down in frequency by tune Hz, in place, by multiplying them with a numerically
+// controlled oscillator. firstSample is the index of the first sample in the file and xdelta the time between samples, so the
+// oscillator phase runs on continuously from row to row and between requests.
+func tuneSamples(datain []float64, firstSample int, tune float64, xdelta float64) {
+	cyclesPerSample := tune * xdelta
+	for i := 0; i < len(datain)-1; i += 2 {
+		// Only the fractional cycle matters, so the argument to Sincos is kept small
+		cycles := math.Mod(cyclesPerSample*float64(firstSample+i/2), 1)
+		sin, cos := math.Sincos(-2 * math.Pi * cycles)
+		re, im := datain[i], datain[i+1]
+		datain[i] = re*cos - im*sin
+		datain[i+1] = re*sin + im*cos
+	}
+}
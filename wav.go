@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+)
+
+// Size of the header of the WAV files made from data.
+const wavHeaderSize = 44
+
+// wavHeader returns the header of a mono 16 bit PCM WAV file of numSamples samples at rate samples per second.
+func wavHeader(numSamples, rate int) []byte {
+	dataSize := uint32(numSamples * 2)
+	header := new(bytes.Buffer)
+	header.WriteString("RIFF")
+	binary.Write(header, binary.LittleEndian, uint32(36)+dataSize)
+	header.WriteString("WAVEfmt ")
+	binary.Write(header, binary.LittleEndian, uint32(16))     // Size of the fmt chunk
+	binary.Write(header, binary.LittleEndian, uint16(1))      // PCM
+	binary.Write(header, binary.LittleEndian, uint16(1))      // Channels
+	binary.Write(header, binary.LittleEndian, uint32(rate))   // Samples per second
+	binary.Write(header, binary.LittleEndian, uint32(rate*2)) // Bytes per second
+	binary.Write(header, binary.LittleEndian, uint16(2))      // Bytes per sample
+	binary.Write(header, binary.LittleEndian, uint16(16))     // Bits per sample
+	header.WriteString("data")
+	binary.Write(header, binary.LittleEndian, dataSize)
+	return header.Bytes()
+}
+
+// wavSamples converts samples to 16 bit PCM, mapping zmin to zmax onto the full scale. Values outside the range are clipped and NaN is silent.
+func wavSamples(samples []float64, zmin, zmax float64) []byte {
+	middle := (zmin + zmax) / 2
+	halfRange := (zmax - zmin) / 2
+	if halfRange <= 0 {
+		halfRange = 1
+	}
+	pcm := make([]int16, len(samples))
+	for i, value := range samples {
+		if math.IsNaN(value) {
+			continue
+		}
+		scaled := math.Max(-1, math.Min(1, (value-middle)/halfRange))
+		pcm[i] = int16(math.Round(scaled * math.MaxInt16))
+	}
+	dataOut := new(bytes.Buffer)
+	binary.Write(dataOut, binary.LittleEndian, pcm)
+	return dataOut.Bytes()
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Most tiles a zscale=viewport request may cover.
+const maxViewportTiles = 256
+
+// Most output elements a zscale=viewport request may cover, over all of its tiles.
+const maxViewportElements = 1 << 22
+
+// tileViewport is an inclusive range of tiles of the tile grid.
+type tileViewport struct {
+	FirstX, FirstY, LastX, LastY int
+}
+
+// viewportScale is the zmin and zmax found for a viewport. They are set before done is closed, and ok is false when the viewport
+// has no finite values.
+type viewportScale struct {
+	done       chan struct{}
+	zmin, zmax float64
+	ok         bool
+}
+
+// Most viewport ranges remembered. The oldest found are forgotten first.
+const maxViewportScales = 1024
+
+var viewportScales = make(map[string]*viewportScale)
+var viewportScaleOrder []string // Keys of the found viewport ranges, oldest first
+var viewportScalesMutex = &sync.Mutex{}
+
+// parseViewport reads a viewport from a url argument of the form firstTileX:firstTileY:lastTileX:lastTileY, with the last tiles included.
+// The viewport must be within the grid of tilesX by tilesY tiles, and its tiles of tileElements elements must not be too many.
+func parseViewport(param string, tilesX, tilesY, tileElements int) (tileViewport, bool) {
+	var viewport tileViewport
+	fields := strings.Split(param, ":")
+	if len(fields) != 4 {
+		return viewport, false
+	}
+	values := make([]int, 4)
+	for i := range fields {
+		value, err := strconv.Atoi(fields[i])
+		if err != nil {
+			return viewport, false
+		}
+		values[i] = value
+	}
+	viewport = tileViewport{values[0], values[1], values[2], values[3]}
+	if viewport.FirstX < 0 || viewport.FirstY < 0 || viewport.LastX < viewport.FirstX || viewport.LastY < viewport.FirstY ||
+		viewport.LastX >= tilesX || viewport.LastY >= tilesY {
+		return viewport, false
+	}
+	numTiles := (viewport.LastX - viewport.FirstX + 1) * (viewport.LastY - viewport.FirstY + 1)
+	return viewport, numTiles <= maxViewportTiles && numTiles*tileElements <= maxViewportElements
+}
+
+// autoscaleZminMax picks zmin and zmax from the moments of a set of values with an autoscale mode. percentile gives the
+// percentiles of the values, and is only called by the modes that use them.
+func autoscaleZminMax(moments statsAccumulator, mode autoscaleMode, percentile func(float64) float64) (float64, float64) {
+	switch mode.Kind {
+	case "percentile":
+		return percentile(mode.Low), percentile(mode.High)
+	case "sigma":
+		sigma := math.Sqrt(moments.m2 / float64(moments.count))
+		return math.Max(moments.mean-mode.Low*sigma, moments.min), math.Min(moments.mean+mode.High*sigma, moments.max)
+	case "floor":
+		floor := percentile(50)
+		return floor - mode.Low, floor + mode.High
+	}
+	return moments.min, moments.max
+}
+
+// valuesZminMax finds the zmin and zmax of a set of values with an autoscale mode, as findAutoscaleZminMax does for a file but using
+// every finite value exactly. Percentiles use nearest rank. It returns false when there are no finite values.
+func valuesZminMax(values []float64, mode autoscaleMode) (float64, float64, bool) {
+	var moments statsAccumulator
+	finite := make([]float64, 0, len(values))
+	for i, value := range values {
+		moments.add(value, i, 0)
+		if !math.IsNaN(value) && !math.IsInf(value, 0) {
+			finite = append(finite, value)
+		}
+	}
+	if moments.count == 0 {
+		return 0, 0, false
+	}
+	sorted := false
+	zmin, zmax := autoscaleZminMax(moments, mode, func(p float64) float64 {
+		if !sorted {
+			sort.Float64s(finite)
+			sorted = true
+		}
+		rank := int(math.Ceil(p/100*float64(len(finite)))) - 1
+		return finite[int(math.Max(0, math.Min(float64(rank), float64(len(finite)-1))))]
+	})
+	return zmin, zmax, true
+}
+
+// setValuesZminMax sets zmin and zmax of the request from the values it will show, using its autoscale. The values are left as they
+// were when none are finite.
+func (request *rdsRequest) setValuesZminMax(values []float64) {
+	mode, _ := parseAutoscale(request.Autoscale)
+	if zmin, zmax, ok := valuesZminMax(values, mode); ok {
+		request.Zmin, request.Zmax = zmin, zmax
+	}
+}
+
+// viewportTileRequest returns the request for a tile of the viewport, at the tile size and decimation of the tile request and cut
+// short at the edges of the file as the tile itself would be.
+func (request *rdsRequest) viewportTileRequest(tileX, tileY int) rdsRequest {
+	tileRequest := *request
+	tileRequest.TileX, tileRequest.TileY = tileX, tileY
+	tileRequest.computeTileSizes()
+	if tileRequest.Xstart+tileRequest.Xsize > tileRequest.FileXSize {
+		tileRequest.Xsize = tileRequest.FileXSize - tileRequest.Xstart
+		tileRequest.Outxsize = int(math.Ceil(float64(tileRequest.Xsize) / float64(tileRequest.DecX)))
+	}
+	if tileRequest.Ystart+tileRequest.Ysize > tileRequest.FileYSize {
+		tileRequest.Ysize = tileRequest.FileYSize - tileRequest.Ystart
+		tileRequest.Outysize = int(math.Ceil(float64(tileRequest.Ysize) / float64(tileRequest.DecY)))
+	}
+	return tileRequest
+}
+
+// scanViewport calls process with the values of each tile of the viewport in turn, so only one tile is held at a time.
+func (request *rdsRequest) scanViewport(viewport tileViewport, process func(values []float64)) {
+	for tileY := viewport.FirstY; tileY <= viewport.LastY; tileY++ {
+		for tileX := viewport.FirstX; tileX <= viewport.LastX; tileX++ {
+			values, _ := tileRequestData(request.viewportTileRequest(tileX, tileY))
+			process(values)
+		}
+	}
+}
+
+// viewportZminMax finds the zmin and zmax of the values of every tile of the viewport with an autoscale mode. The moments are
+// gathered tile by tile, and the modes that use percentiles read the tiles again into a histogram of autoscaleBins bins, as
+// findAutoscaleZminMax does for a file. It returns false when there are no finite values.
+func (request *rdsRequest) viewportZminMax(viewport tileViewport, mode autoscaleMode) (float64, float64, bool) {
+	var moments statsAccumulator
+	request.scanViewport(viewport, func(values []float64) {
+		for i, value := range values {
+			moments.add(value, i, 0)
+		}
+	})
+	if moments.count == 0 {
+		return 0, 0, false
+	}
+	var hist *histogramResult
+	zmin, zmax := autoscaleZminMax(moments, mode, func(p float64) float64 {
+		if moments.min == moments.max { // Every value is the same, so there is no range to make a histogram of
+			return moments.min
+		}
+		if hist == nil {
+			hist = &histogramResult{Zmin: moments.min, Zmax: moments.max, Edges: histogramEdges(moments.min, moments.max, autoscaleBins, false),
+				Counts: make([]int64, autoscaleBins)}
+			binWidth := (moments.max - moments.min) / autoscaleBins
+			request.scanViewport(viewport, func(values []float64) {
+				for _, value := range values {
+					if math.IsNaN(value) || math.IsInf(value, 0) {
+						continue
+					}
+					bin := int(math.Min((value-moments.min)/binWidth, autoscaleBins-1)) // The top edge is included in the last bin
+					hist.Counts[bin]++
+				}
+			})
+		}
+		return histogramPercentile(*hist, p)
+	})
+	return zmin, zmax, true
+}
+
+// findViewportZminMax sets zmin and zmax of a tile request from the values of every tile of the viewport, so the tiles of a view are
+// scaled the same way. Each viewport is only read once. Tiles that ask for a viewport while it is being read wait for its range,
+// and the tiles after that use the remembered range until maxViewportScales newer viewports have been found.
+func (request *rdsRequest) findViewportZminMax(viewport tileViewport) {
+	key := fmt.Sprintf("%s_viewport%d_%d_%d_%d_%d_%d_%d_%d_%s_%s", request.rangeIndexKey(), request.TileXSize, request.TileYSize, request.DecX, request.DecY,
+		viewport.FirstX, viewport.FirstY, viewport.LastX, viewport.LastY, request.Transform, request.Autoscale)
+	viewportScalesMutex.Lock()
+	scale, found := viewportScales[key]
+	if !found {
+		scale = &viewportScale{done: make(chan struct{})}
+		viewportScales[key] = scale
+	}
+	viewportScalesMutex.Unlock()
+
+	if found {
+		<-scale.done
+	} else {
+		func() {
+			defer close(scale.done)
+			mode, _ := parseAutoscale(request.Autoscale)
+			scale.zmin, scale.zmax, scale.ok = request.viewportZminMax(viewport, mode)
+		}()
+		log.Println("Found viewport", viewport, "Zmin, Zmax to be", scale.zmin, scale.zmax)
+		// Only found ranges can be forgotten, so tiles waiting for a range never miss it
+		viewportScalesMutex.Lock()
+		viewportScaleOrder = append(viewportScaleOrder, key)
+		for len(viewportScaleOrder) > maxViewportScales {
+			delete(viewportScales, viewportScaleOrder[0])
+			viewportScaleOrder = viewportScaleOrder[1:]
+		}
+		viewportScalesMutex.Unlock()
+	}
+	if scale.ok {
+		request.Zmin, request.Zmax = scale.zmin, scale.zmax
+	}
+}